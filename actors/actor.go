@@ -10,6 +10,7 @@ import (
 	"github.com/eluleci/dock/auth"
 	"github.com/eluleci/dock/modifier"
 	"github.com/eluleci/dock/hooks"
+	"github.com/eluleci/dock/config"
 )
 
 const (
@@ -20,12 +21,28 @@ const (
 	ActorTypeFunctions = "functions"
 	ClassUsers = "users"
 	ClassFiles = "files"
+	ClassRoles = "roles"
+	ClassSessions = "sessions"
+	ClassTwoFactor = "twofactor"
 	ResourceTypeUsers = "/users"
 	ResourceTypeFiles = "/files"
+	ResourceTypeRoles = "/roles"
 	ResourceRegister = "/register"
 	ResourceLogin = "/login"
+	ResourceLoginTwoFactor = "/login/2fa"
 	ResourceResetPassword = "/resetpassword"
+	ResourceResetPasswordConfirm = "/resetpassword/confirm"
 	ResourceChangePassword = "/changepassword"
+	ResourceRefresh = "/refresh"
+	ResourceLogout = "/logout"
+	ResourceMe = "/users/me"
+	ResourceMySessions = "/users/me/sessions"
+	ResourceMyTwoFactor = "/users/me/2fa"
+	ResourceMyTwoFactorConfirm = "/users/me/2fa/confirm"
+	ResourceMyRecoveryCodes = "/users/me/2fa/recoverycodes"
+	ResourceMyProviders = "/users/me/providers"
+	ResourceMyExport = "/users/me/export"
+	ResourceVerifyEmail = "/verifyemail"
 )
 
 type Actor struct {
@@ -46,8 +63,12 @@ var CreateActor = func(res string, level int, parentInbox chan messages.RequestW
 
 	var isFunctionActor bool
 	var className string
-	if strings.EqualFold(res, ResourceLogin) || strings.EqualFold(res, ResourceRegister) || strings.EqualFold(res, ResourceResetPassword) || strings.EqualFold(res, ResourceChangePassword) {
+	if isAuthResource(res) || isProvidersResource(res) || strings.EqualFold(res, ResourceMyExport) {
 		className = ClassUsers
+	} else if isSessionsResource(res) {
+		className = ClassSessions
+	} else if isTwoFactorResource(res) {
+		className = ClassTwoFactor
 	} else {
 		resParts := strings.Split(res, "/")
 		resourceLevel := resParts[level]
@@ -141,6 +162,7 @@ var handleRequest = func(a *Actor, requestWrapper messages.RequestWrapper) (resp
 
 	var isGranted bool
 	var user map[string]interface{}
+	var roles []string
 	var err *utils.Error
 	var hookBody map[string]interface{}
 
@@ -148,10 +170,39 @@ var handleRequest = func(a *Actor, requestWrapper messages.RequestWrapper) (resp
 
 	//	isActorTypeFunctions := strings.EqualFold(a.actorType, ActorTypeFunctions)
 
-	isGranted, user, err = auth.IsGranted(a.class, requestWrapper, a.adapter)
+	// requests with api keys don't have a user
+	apiKey, err := auth.GetApiKey(requestWrapper)
+
+	// '/users/me' is handled as the object of the user of the access token
+	isCurrentUser := strings.EqualFold(a.res, ResourceMe)
+	if err == nil && isCurrentUser {
+		requestWrapper, err = auth.ResolveCurrentUser(requestWrapper)
+	}
+
+	if err == nil && apiKey != nil {
+		isGranted = auth.IsGrantedToApiKey(apiKey, a.class, requestWrapper)
+	} else if err == nil {
+		isGranted, user, roles, err = auth.IsGranted(a.class, requestWrapper, a.adapter)
+	}
+
+	if isGranted && err == nil && isObjectWriteRequest(a, requestWrapper) && !apiKey.IsMaster() {
+		var id string
+		if strings.EqualFold(a.actorType, ActorTypeModel) {
+			id = requestWrapper.Message.Res[strings.LastIndex(requestWrapper.Message.Res, "/") + 1:]
+		}
+		err = auth.CheckWritableFields(a.class, id, requestWrapper.Message.Body, user)
+	}
+
+	if isGranted && err == nil && isQueryRequest(a, requestWrapper) && !apiKey.IsMaster() {
+		err = auth.CheckQueryFields(a.class, requestWrapper.Message.Parameters, roles)
+	}
+
+	if isGranted && err == nil && isClassWriteRequest(a, requestWrapper) {
+		err = auth.CheckEmailVerified(a.class, user)
+	}
 
 	if isGranted && err == nil {
-		response, err = executeTrigger(a, user, requestWrapper, "before")
+		response, err = executeTrigger(a, getHookUser(user, roles), requestWrapper, "before")
 		if response.Body != nil {
 			// replace request body with the one that hook server returns
 			requestWrapper.Message.Body = response.Body
@@ -163,9 +214,37 @@ var handleRequest = func(a *Actor, requestWrapper messages.RequestWrapper) (resp
 	} else if !isGranted {
 		err = &utils.Error{http.StatusUnauthorized, "Unauthorized."}
 	} else if (strings.EqualFold(a.actorType, ActorTypeFunctions)) {
-		response, err = executeFunction(a, user, requestWrapper)
+		response, err = executeFunction(a, getHookUser(user, roles), requestWrapper)
+	} else if isSessionsResource(a.res) {
+		response, err = handleSessions(a, requestWrapper, user)
+	} else if isTwoFactorResource(a.res) {
+		response, err = handleTwoFactor(a, requestWrapper, user)
+	} else if isProvidersResource(a.res) {
+		response, err = handleProviders(a, requestWrapper, user)
+	} else if strings.EqualFold(a.res, ResourceMyExport) {
+		response, err = handleExport(a, requestWrapper, user)
+	} else if auth.IsUserActionResource(a.res) {
+		response, err = handleUserAction(a, requestWrapper, user)
+	} else if isUserDeleteRequest(a, requestWrapper) && !apiKey.IsMaster() {
+		// users delete their own accounts with the data rules of the classes. deleting the user object directly would
+		// leave the sessions, the roles and the data of the user behind.
+		id := requestWrapper.Message.Res[strings.LastIndex(requestWrapper.Message.Res, "/") + 1:]
+		if user != nil && user["_id"] == id {
+			response, err = auth.HandleDeleteAccount(requestWrapper, user)
+		} else {
+			err = &utils.Error{http.StatusForbidden, "Users can only delete their own accounts."}
+		}
 	} else if strings.EqualFold(requestWrapper.Message.Command, "get") {
-		response, err = handleGet(a, requestWrapper)
+		response, err = handleGet(a, requestWrapper, roles)
+		if err == nil && !apiKey.IsMaster() {
+			response.Body = filterFields(a, response.Body, user, roles)
+		}
+		if err == nil {
+			response.Body = modifier.RemoveClassNames(response.Body)
+		}
+		if err == nil && isCurrentUser && isExpanded(requestWrapper.Message.Parameters, "roles") {
+			response.Body["roles"] = auth.GetRoleNames(roles)
+		}
 	} else if strings.EqualFold(requestWrapper.Message.Command, "post") {
 		response, hookBody, err = handlePost(a, requestWrapper, user)
 	} else if strings.EqualFold(requestWrapper.Message.Command, "put") {
@@ -174,19 +253,58 @@ var handleRequest = func(a *Actor, requestWrapper messages.RequestWrapper) (resp
 		response, err = handleDelete(a, requestWrapper)
 	}
 
+	// triggers and functions are cached, so they are loaded again after they change
+	if err == nil && isClassWriteRequest(a, requestWrapper) && (a.class == hooks.ClassTriggers || a.class == hooks.ClassFunctions) {
+		hooks.InvalidateRegistry()
+	}
+
 	if err != nil {
 		if response.Status == 0 {response.Status = err.Code}
 		if response.Body == nil {response.Body = map[string]interface{}{"message":err.Message}}
 	}
 
-	// TODO: call hooks.ExecuteTrigger in goroutine
-	var hookRequestWrapper = messages.RequestWrapper{}
-	hookRequestWrapper.Message = requestWrapper.Message
-	hookRequestWrapper.Message.Body = hookBody
-	executeTrigger(a, user, hookRequestWrapper, "after")
+	if apiKey != nil {
+		auth.RecordApiKeyRequest(apiKey, requestWrapper, response.Status)
+	} else if auth.GetImpersonator(user) != "" {
+		auth.RecordImpersonatedRequest(user, requestWrapper, response.Status)
+	}
+
+	// after triggers are sent in background, so the response doesn't wait for the hook server
+	if err == nil {
+		var hookRequestWrapper = messages.RequestWrapper{}
+		hookRequestWrapper.Message = requestWrapper.Message
+		hookRequestWrapper.Message.Body = filterFields(a, hookBody, user, roles)
+		enqueueAfterTrigger(a, getHookUser(user, roles), hookRequestWrapper)
+	}
 	return
 }
 
+// users are sent to the hook servers without the fields that they cannot see themselves, like the password hash. the
+// after triggers are saved to the queue with them too.
+func getHookUser(user map[string]interface{}, roles []string) map[string]interface{} {
+
+	if user == nil {
+		return user
+	}
+	hookUser := make(map[string]interface{}, len(user))
+	for key, value := range user {
+		hookUser[key] = value
+	}
+	return auth.FilterFields(ClassUsers, hookUser, user, roles)
+}
+
+var enqueueAfterTrigger = func(a *Actor, user interface{}, requestWrapper messages.RequestWrapper) {
+
+	err := hooks.EnqueueTrigger(a.class, "after",
+		requestWrapper.Message.Command,
+		requestWrapper.Message.Parameters,
+		requestWrapper.Message.Body,
+		user)
+	if err != nil {
+		utils.Log("error", "Enqueuing after trigger failed: " + err.Message)
+	}
+}
+
 var executeTrigger = func(a *Actor, user interface{}, requestWrapper messages.RequestWrapper, when string) (response messages.Message, err *utils.Error) {
 
 	response.Body, err = hooks.ExecuteTrigger(a.class, when,
@@ -220,7 +338,12 @@ var executeFunction = func(a *Actor, user interface{}, requestWrapper messages.R
 	return
 }
 
-var handleGet = func(a *Actor, requestWrapper messages.RequestWrapper) (response messages.Message, err *utils.Error) {
+var handleGet = func(a *Actor, requestWrapper messages.RequestWrapper, roles []string) (response messages.Message, err *utils.Error) {
+
+	if strings.EqualFold(a.res, ResourceVerifyEmail) {                           // verify email with link
+		response, err = auth.HandleVerifyEmail(requestWrapper, nil)
+		return
+	}
 
 	isFileClass := strings.EqualFold(a.class, ClassFiles)
 	isObjectTypeActor := strings.EqualFold(a.actorType, ActorTypeModel)
@@ -234,7 +357,7 @@ var handleGet = func(a *Actor, requestWrapper messages.RequestWrapper) (response
 			response.Body, err = adapters.Get(a.class, id)
 		}
 	} else if isCollectionTypeActor {                    // query objects
-		response.Body, err = adapters.Query(a.class, requestWrapper.Message.Parameters)
+		response.Body, err = adapters.Query(a.class, requestWrapper.Message.Parameters, roles)
 	}
 
 	if err != nil {
@@ -252,8 +375,6 @@ var handleGet = func(a *Actor, requestWrapper messages.RequestWrapper) (response
 			return
 		}
 	}
-
-	response.Body = filterFields(a, response.Body)
 	return
 }
 
@@ -265,12 +386,28 @@ var handlePost = func(a *Actor, requestWrapper messages.RequestWrapper, user int
 		response, err = auth.HandleLogin(requestWrapper, a.adapter)
 	} else if strings.EqualFold(a.res, ResourceChangePassword) {                   // reset password
 		response, err = auth.HandleChangePassword(requestWrapper, a.adapter, user)
+	} else if strings.EqualFold(a.res, ResourceLoginTwoFactor) {                   // second step of login
+		response, err = auth.HandleLoginTwoFactor(requestWrapper)
 	} else if strings.EqualFold(a.res, ResourceResetPassword) {                    // reset password
 		response, err = auth.HandleResetPassword(requestWrapper, a.adapter)
+	} else if strings.EqualFold(a.res, ResourceResetPasswordConfirm) {             // set new password with reset link
+		response, err = auth.HandleResetPasswordConfirm(requestWrapper)
+	} else if strings.EqualFold(a.res, ResourceRefresh) {                          // refresh access token
+		response, err = auth.HandleRefresh(requestWrapper)
+	} else if strings.EqualFold(a.res, ResourceLogout) {                           // logout
+		response, err = auth.HandleLogout(requestWrapper, user)
+	} else if strings.EqualFold(a.res, ResourceVerifyEmail) {                      // verify email or resend link
+		response, err = auth.HandleVerifyEmail(requestWrapper, user)
 	} else if strings.EqualFold(a.res, ResourceTypeUsers) {                        // post on users not allowed
 		response.Status = http.StatusMethodNotAllowed
+	} else if strings.EqualFold(a.res, ResourceTypeRoles) {                        // create role request
+		response, hookBody, err = auth.HandleCreateRole(requestWrapper, user)
 	} else if strings.EqualFold(a.actorType, ActorTypeCollection) {                // create object request
 		if(!strings.EqualFold(a.class, ClassFiles)) {
+			if requestWrapper.Message.Body != nil {
+				userAsMap, _ := user.(map[string]interface{})
+				auth.ApplyDefaultAcl(a.class, requestWrapper.Message.Body, userAsMap)
+			}
 			response.Body, hookBody, err = adapters.Create(a.class, requestWrapper.Message.Body)
 		} else {
 			response.Body, hookBody, err = adapters.CreateFile(requestWrapper.Message.ReqBodyRaw)
@@ -287,9 +424,24 @@ var handlePut = func(a *Actor, requestWrapper messages.RequestWrapper) (response
 
 	if strings.EqualFold(a.actorType, ActorTypeCollection) {            // put on resources are not allowed
 		response.Status = http.StatusBadRequest
+	} else if strings.EqualFold(a.actorType, ActorTypeModel) && strings.EqualFold(a.class, ClassRoles) {    // update role
+		response, hookBody, err = auth.HandleUpdateRole(requestWrapper)
 	} else if strings.EqualFold(a.actorType, ActorTypeModel) {        // update object
 		id := requestWrapper.Message.Res[strings.LastIndex(requestWrapper.Message.Res, "/") + 1:]
+
+		var isEmailChanged bool
+		if strings.EqualFold(a.class, ClassUsers) {
+			isEmailChanged = auth.PrepareEmailChange(id, requestWrapper.Message.Body)
+		}
+
 		response.Body, hookBody, err = adapters.Update(a.class, id, requestWrapper.Message.Body)
+
+		if err == nil && isEmailChanged && config.SystemConfig.EmailVerification.Enabled {
+			email, _ := requestWrapper.Message.Body["email"].(string)
+			if sendErr := auth.SendVerificationEmail(id, email); sendErr != nil {
+				utils.Log("error", "Sending verification email failed: " + sendErr.Message)
+			}
+		}
 	}
 	return
 }
@@ -308,6 +460,75 @@ var handleDelete = func(a *Actor, requestWrapper messages.RequestWrapper) (respo
 	return
 }
 
+var handleSessions = func(a *Actor, requestWrapper messages.RequestWrapper, user interface{}) (response messages.Message, err *utils.Error) {
+
+	isSessionList := strings.EqualFold(a.res, ResourceMySessions)
+
+	if isSessionList && strings.EqualFold(requestWrapper.Message.Command, "get") {            // list sessions
+		response, err = auth.HandleListSessions(requestWrapper, user)
+	} else if !isSessionList && strings.EqualFold(requestWrapper.Message.Command, "delete") { // sign out a session
+		response, err = auth.HandleDeleteSession(requestWrapper, user)
+	} else {
+		err = &utils.Error{http.StatusMethodNotAllowed, "Method is not allowed on sessions."}
+	}
+	return
+}
+
+var handleTwoFactor = func(a *Actor, requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	command := strings.ToLower(requestWrapper.Message.Command)
+	if strings.EqualFold(a.res, ResourceMyTwoFactor) && command == "get" {                 // two-factor status
+		response, err = auth.HandleGetTwoFactor(requestWrapper, user)
+	} else if strings.EqualFold(a.res, ResourceMyTwoFactor) && command == "post" {         // enrol
+		response, err = auth.HandleEnrolTwoFactor(requestWrapper, user)
+	} else if strings.EqualFold(a.res, ResourceMyTwoFactor) && command == "delete" {       // disable
+		response, err = auth.HandleDisableTwoFactor(requestWrapper, user)
+	} else if strings.EqualFold(a.res, ResourceMyTwoFactorConfirm) && command == "post" {  // confirm enrolment
+		response, err = auth.HandleConfirmTwoFactor(requestWrapper, user)
+	} else if strings.EqualFold(a.res, ResourceMyRecoveryCodes) && command == "post" {     // new recovery codes
+		response, err = auth.HandleRegenerateRecoveryCodes(requestWrapper, user)
+	} else {
+		err = &utils.Error{http.StatusMethodNotAllowed, "Method is not allowed on two-factor authentication."}
+	}
+	return
+}
+
+var handleProviders = func(a *Actor, requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	isProviderList := strings.EqualFold(a.res, ResourceMyProviders)
+	command := strings.ToLower(requestWrapper.Message.Command)
+	if isProviderList && command == "get" {            // login methods
+		response, err = auth.HandleListProviders(requestWrapper, user)
+	} else if isProviderList && command == "post" {    // link a provider
+		response, err = auth.HandleLinkProvider(requestWrapper, user)
+	} else if !isProviderList && command == "delete" { // unlink a provider
+		response, err = auth.HandleUnlinkProvider(requestWrapper, user)
+	} else {
+		err = &utils.Error{http.StatusMethodNotAllowed, "Method is not allowed on providers."}
+	}
+	return
+}
+
+var handleExport = func(a *Actor, requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	if strings.EqualFold(requestWrapper.Message.Command, "get") {
+		response, err = auth.HandleExportAccount(requestWrapper, user)
+	} else {
+		err = &utils.Error{http.StatusMethodNotAllowed, "Method is not allowed on export."}
+	}
+	return
+}
+
+var handleUserAction = func(a *Actor, requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	if strings.EqualFold(requestWrapper.Message.Command, "post") {
+		response, err = auth.HandleManageUser(requestWrapper, user)
+	} else {
+		err = &utils.Error{http.StatusMethodNotAllowed, "Method is not allowed on user actions."}
+	}
+	return
+}
+
 func (a *Actor) checkAndSend(c chan messages.Message, m messages.Message) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -333,29 +554,94 @@ func getChildRes(res, parentRes string) (fullPath string) {
 	return
 }
 
-func filterFields(a *Actor, object map[string]interface{}) map[string]interface{} {
-
-	// filters 'password' fields of user objects
-	// TODO make a generic filter engine that takes the filter config from the configuration file such as:
-	//
-	//	{
-	//		filterOptions: {
-	//			"/users": ["password"],
-	//			"/comments": ["score"]
-	//		},
-	//		triggersUrl: "api2.miwi.com"
-	//	}
-	//
-	if strings.EqualFold(a.res, ResourceTypeUsers) {
-		users := object["data"]
-		for _, user := range users.([]map[string]interface{}) {
-			delete(user, "password")
+// returns true for the requests that write the fields of objects directly
+func isObjectWriteRequest(a *Actor, requestWrapper messages.RequestWrapper) bool {
+
+	if strings.EqualFold(requestWrapper.Message.Command, "put") {
+		return strings.EqualFold(a.actorType, ActorTypeModel)
+	}
+
+	if strings.EqualFold(requestWrapper.Message.Command, "post") {
+		return strings.EqualFold(a.actorType, ActorTypeCollection) && !isAuthResource(a.res)
+	}
+	return false
+}
+
+// returns true for the requests that query the objects of a class with the where, sort or aggregate parameters
+func isQueryRequest(a *Actor, requestWrapper messages.RequestWrapper) bool {
+	return strings.EqualFold(requestWrapper.Message.Command, "get") && strings.EqualFold(a.actorType, ActorTypeCollection)
+}
+
+// returns true for the requests that delete a user, including the current user on /users/me
+func isUserDeleteRequest(a *Actor, requestWrapper messages.RequestWrapper) bool {
+	return strings.EqualFold(requestWrapper.Message.Command, "delete") && strings.EqualFold(a.class, ClassUsers) &&
+	strings.EqualFold(a.actorType, ActorTypeModel)
+}
+
+// returns true for the resources that are handled by the auth package on behalf of users
+func isAuthResource(res string) bool {
+	return strings.EqualFold(res, ResourceLogin) || strings.EqualFold(res, ResourceRegister) ||
+	strings.EqualFold(res, ResourceResetPassword) || strings.EqualFold(res, ResourceChangePassword) ||
+	strings.EqualFold(res, ResourceRefresh) || strings.EqualFold(res, ResourceLogout) ||
+	strings.EqualFold(res, ResourceVerifyEmail) || strings.EqualFold(res, ResourceResetPasswordConfirm) ||
+	strings.EqualFold(res, ResourceLoginTwoFactor)
+}
+
+// returns true for the requests that create, update or delete the objects of a class
+func isClassWriteRequest(a *Actor, requestWrapper messages.RequestWrapper) bool {
+
+	if isAuthResource(a.res) || isSessionsResource(a.res) || isTwoFactorResource(a.res) || isProvidersResource(a.res) ||
+	strings.EqualFold(a.res, ResourceMyExport) || auth.IsUserActionResource(a.res) ||
+	strings.EqualFold(a.actorType, ActorTypeFunctions) {
+		return false
+	}
+	command := strings.ToLower(requestWrapper.Message.Command)
+
+	// users can delete their accounts without verifying their emails
+	if strings.EqualFold(a.res, ResourceMe) && command == "delete" {
+		return false
+	}
+	return command == "post" || command == "put" || command == "delete"
+}
+
+// returns true for the sessions of the current user and the individual sessions under it
+func isSessionsResource(res string) bool {
+	return strings.EqualFold(res, ResourceMySessions) || strings.HasPrefix(strings.ToLower(res), ResourceMySessions + "/")
+}
+
+// returns true for the two-factor authentication resources of the current user
+func isTwoFactorResource(res string) bool {
+	return strings.EqualFold(res, ResourceMyTwoFactor) || strings.HasPrefix(strings.ToLower(res), ResourceMyTwoFactor + "/")
+}
+
+// returns true for the login methods of the current user and the individual providers under it
+func isProvidersResource(res string) bool {
+	return strings.EqualFold(res, ResourceMyProviders) || strings.HasPrefix(strings.ToLower(res), ResourceMyProviders + "/")
+}
+
+// returns true if the field is in the top level of the expand parameter
+func isExpanded(parameters map[string][]string, field string) bool {
+
+	if parameters["expand"] == nil {
+		return false
+	}
+	for _, expandedField := range strings.Split(parameters["expand"][0], ",") {
+		if strings.TrimSpace(expandedField) == field {
+			return true
 		}
-	} else {
-		if strings.EqualFold(a.class, ClassUsers) {
-			delete(object, "password")
+	}
+	return false
+}
+
+func filterFields(a *Actor, object map[string]interface{}, user map[string]interface{}, roles []string) map[string]interface{} {
+
+	// query results are filtered one by one
+	if items, isArray := object["data"].([]map[string]interface{}); isArray && strings.EqualFold(a.actorType, ActorTypeCollection) {
+		for _, item := range items {
+			auth.FilterFields(a.class, item, user, roles)
 		}
+		return object
 	}
 
-	return object
-}
\ No newline at end of file
+	return auth.FilterFields(a.class, object, user, roles)
+}
@@ -19,7 +19,7 @@ var _handleRequest = func(a *Actor, requestWrapper messages.RequestWrapper) (res
 	return
 }
 
-var _handleGet = func(a *Actor, requestWrapper messages.RequestWrapper) (response messages.Message, err *utils.Error) {
+var _handleGet = func(a *Actor, requestWrapper messages.RequestWrapper, roles []string) (response messages.Message, err *utils.Error) {
 	return
 }
 
@@ -41,6 +41,10 @@ var _CreateActor = func(res string, level int, parentInbox chan messages.Request
 
 func TestMain(m *testing.M) {
 	saveRealFunctions()
+	// after triggers are not saved to the queue in the tests
+	hooks.EnqueueTrigger = func(className, when, method string, parameters map[string][]string, body map[string]interface{}, user interface{}) (err *utils.Error) {
+		return
+	}
 	os.Exit(m.Run())
 }
 
@@ -173,12 +177,12 @@ func TestHandleRequest(t *testing.T) {
 		return
 	}
 
-	isGrantedFuncThatReturnsTrue := func(collection string, requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (isGranted bool, user map[string]interface{}, err *utils.Error) {
+	isGrantedFuncThatReturnsTrue := func(collection string, requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (isGranted bool, user map[string]interface{}, roles []string, err *utils.Error) {
 		isGranted = true
 		return
 	}
 
-	isGrantedFuncThatReturnsFalse := func(collection string, requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (isGranted bool, user map[string]interface{}, err *utils.Error) {
+	isGrantedFuncThatReturnsFalse := func(collection string, requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (isGranted bool, user map[string]interface{}, roles []string, err *utils.Error) {
 		isGranted = false
 		return
 	}
@@ -187,7 +191,7 @@ func TestHandleRequest(t *testing.T) {
 	Convey("Should call auth.GetPermissions", t, func() {
 
 		var called bool
-		auth.IsGranted = func(collection string, requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (isGranted bool, user map[string]interface{}, err *utils.Error) {
+		auth.IsGranted = func(collection string, requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (isGranted bool, user map[string]interface{}, roles []string, err *utils.Error) {
 			called = true
 			return
 		}
@@ -200,7 +204,7 @@ func TestHandleRequest(t *testing.T) {
 
 	Convey("Should return permission error", t, func() {
 
-		auth.IsGranted = func(collection string, requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (isGranted bool, user map[string]interface{}, err *utils.Error) {
+		auth.IsGranted = func(collection string, requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (isGranted bool, user map[string]interface{}, roles []string, err *utils.Error) {
 			err = &utils.Error{http.StatusInternalServerError, ""}
 			return
 		}
@@ -220,7 +224,7 @@ func TestHandleRequest(t *testing.T) {
 		auth.IsGranted = isGrantedFuncThatReturnsTrue
 
 		var called bool
-		handleGet = func(a *Actor, requestWrapper messages.RequestWrapper) (response messages.Message, err *utils.Error) {
+		handleGet = func(a *Actor, requestWrapper messages.RequestWrapper, roles []string) (response messages.Message, err *utils.Error) {
 			called = true
 			return
 		}
@@ -237,6 +241,31 @@ func TestHandleRequest(t *testing.T) {
 		So(called, ShouldBeTrue)
 	})
 
+	Convey("Should not allow querying hidden fields", t, func() {
+
+		auth.IsGranted = isGrantedFuncThatReturnsTrue
+
+		var called bool
+		handleGet = func(a *Actor, requestWrapper messages.RequestWrapper, roles []string) (response messages.Message, err *utils.Error) {
+			called = true
+			return
+		}
+
+		var m messages.Message
+		m.Command = "get"
+		m.Res = "/users"
+		m.Parameters = map[string][]string{"aggregate": {`[{"$project":{"h":"$password"}}]`}}
+		var rw messages.RequestWrapper
+		rw.Message = m
+
+		actor := &Actor{}
+		actor.class = ClassUsers
+		actor.actorType = ActorTypeCollection
+		response := handleRequest(actor, rw)
+		So(response.Status, ShouldEqual, http.StatusForbidden)
+		So(called, ShouldBeFalse)
+	})
+
 	Convey("Should return Authorization error for GET", t, func() {
 
 		auth.IsGranted = isGrantedFuncThatReturnsFalse
@@ -320,6 +349,56 @@ func TestHandleRequest(t *testing.T) {
 		So(called, ShouldBeTrue)
 	})
 
+	Convey("Should not allow writing read-only fields", t, func() {
+
+		auth.IsGranted = isGrantedFuncThatReturnsTrue
+
+		var called bool
+		handlePut = func(a *Actor, requestWrapper messages.RequestWrapper) (response messages.Message, hookBody map[string]interface{}, err *utils.Error) {
+			called = true
+			return
+		}
+
+		var m messages.Message
+		m.Command = "put"
+		m.Res = "/users/123"
+		m.Body = map[string]interface{}{"_roles": []interface{}{"admin"}}
+		var rw messages.RequestWrapper
+		rw.Message = m
+
+		actor := &Actor{}
+		actor.class = ClassUsers
+		actor.actorType = ActorTypeModel
+		response := handleRequest(actor, rw)
+		So(response.Status, ShouldEqual, http.StatusForbidden)
+		So(called, ShouldBeFalse)
+	})
+
+	Convey("Should not allow changing the acl of an object", t, func() {
+
+		auth.IsGranted = isGrantedFuncThatReturnsTrue
+
+		var called bool
+		handlePut = func(a *Actor, requestWrapper messages.RequestWrapper) (response messages.Message, hookBody map[string]interface{}, err *utils.Error) {
+			called = true
+			return
+		}
+
+		var m messages.Message
+		m.Command = "put"
+		m.Res = "/posts/123"
+		m.Body = map[string]interface{}{"_acl": map[string]interface{}{"*": map[string]interface{}{"update": true}}}
+		var rw messages.RequestWrapper
+		rw.Message = m
+
+		actor := &Actor{}
+		actor.class = "posts"
+		actor.actorType = ActorTypeModel
+		response := handleRequest(actor, rw)
+		So(response.Status, ShouldEqual, http.StatusForbidden)
+		So(called, ShouldBeFalse)
+	})
+
 	Convey("Should return Authorization error for PUT", t, func() {
 
 		auth.IsGranted = isGrantedFuncThatReturnsFalse
@@ -397,6 +476,347 @@ func TestHandleRequest(t *testing.T) {
 	})
 }
 
+func TestHandleRequestWithApiKey(t *testing.T) {
+
+	hooks.ExecuteTrigger = func(className, when, method string,
+	parameters map[string][]string, body map[string]interface{}, multipart *multipart.Form,
+	user interface{}) (responseBody map[string]interface{}, err *utils.Error) {
+		return
+	}
+
+	originalGetApiKey := auth.GetApiKey
+	originalIsGranted := auth.IsGranted
+	originalCheckWritableFields := auth.CheckWritableFields
+	originalRecordApiKeyRequest := auth.RecordApiKeyRequest
+
+	var isGrantedCalled, checkWritableFieldsCalled bool
+	var recordedStatus int
+	auth.IsGranted = func(collection string, requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (isGranted bool, user map[string]interface{}, roles []string, err *utils.Error) {
+		isGrantedCalled = true
+		return
+	}
+	auth.CheckWritableFields = func(className, id string, body map[string]interface{}, user map[string]interface{}) (err *utils.Error) {
+		checkWritableFieldsCalled = true
+		return
+	}
+	auth.RecordApiKeyRequest = func(apiKey *auth.ApiKey, requestWrapper messages.RequestWrapper, status int) {
+		recordedStatus = status
+	}
+
+	resetFunctions()
+	Convey("Should grant master key without checking the user and the field rules", t, func() {
+
+		auth.GetApiKey = func(requestWrapper messages.RequestWrapper) (apiKey *auth.ApiKey, err *utils.Error) {
+			apiKey = &auth.ApiKey{Name: "backend", Scope: auth.ApiKeyScopeMaster}
+			return
+		}
+		handlePut = func(a *Actor, requestWrapper messages.RequestWrapper) (response messages.Message, hookBody map[string]interface{}, err *utils.Error) {
+			response.Status = http.StatusOK
+			return
+		}
+
+		actor := &Actor{actorType: ActorTypeModel, class: "users"}
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "put"
+		requestWrapper.Message.Res = "/users/userid"
+		requestWrapper.Message.Body = map[string]interface{}{"_roles": []string{"admin"}}
+
+		response := handleRequest(actor, requestWrapper)
+		So(response.Status, ShouldEqual, http.StatusOK)
+		So(isGrantedCalled, ShouldBeFalse)
+		So(checkWritableFieldsCalled, ShouldBeFalse)
+		So(recordedStatus, ShouldEqual, http.StatusOK)
+	})
+
+	Convey("Should not allow read-only key to write", t, func() {
+
+		auth.GetApiKey = func(requestWrapper messages.RequestWrapper) (apiKey *auth.ApiKey, err *utils.Error) {
+			apiKey = &auth.ApiKey{Name: "reports", Scope: auth.ApiKeyScopeReadOnly}
+			return
+		}
+
+		actor := &Actor{actorType: ActorTypeModel, class: "users"}
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "put"
+		requestWrapper.Message.Res = "/users/userid"
+
+		response := handleRequest(actor, requestWrapper)
+		So(response.Status, ShouldEqual, http.StatusUnauthorized)
+		So(recordedStatus, ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("Should return error for unknown keys", t, func() {
+
+		auth.GetApiKey = func(requestWrapper messages.RequestWrapper) (apiKey *auth.ApiKey, err *utils.Error) {
+			err = &utils.Error{http.StatusUnauthorized, "API key is not valid."}
+			return
+		}
+
+		isGrantedCalled = false
+		response := handleRequest(&Actor{class: "users"}, messages.RequestWrapper{})
+		So(response.Status, ShouldEqual, http.StatusUnauthorized)
+		So(isGrantedCalled, ShouldBeFalse)
+	})
+
+	resetFunctions()
+	auth.GetApiKey = originalGetApiKey
+	auth.IsGranted = originalIsGranted
+	auth.CheckWritableFields = originalCheckWritableFields
+	auth.RecordApiKeyRequest = originalRecordApiKeyRequest
+}
+
+func TestHandleRequestWhileImpersonating(t *testing.T) {
+
+	originalIsGranted := auth.IsGranted
+	originalRecordImpersonatedRequest := auth.RecordImpersonatedRequest
+
+	originalEnqueueTrigger := hooks.EnqueueTrigger
+
+	var triggerUsers []interface{}
+	hooks.ExecuteTrigger = func(className, when, method string,
+	parameters map[string][]string, body map[string]interface{}, multipart *multipart.Form,
+	user interface{}) (responseBody map[string]interface{}, err *utils.Error) {
+		triggerUsers = append(triggerUsers, user)
+		return
+	}
+	hooks.EnqueueTrigger = func(className, when, method string, parameters map[string][]string, body map[string]interface{}, user interface{}) (err *utils.Error) {
+		triggerUsers = append(triggerUsers, user)
+		return
+	}
+
+	resetFunctions()
+	Convey("Should record the requests of the admins who impersonate users", t, func() {
+
+		impersonatedUser := map[string]interface{}{"_id": "userid", "impersonatedBy": "adminid"}
+		auth.IsGranted = func(collection string, requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (isGranted bool, user map[string]interface{}, roles []string, err *utils.Error) {
+			isGranted = true
+			user = impersonatedUser
+			return
+		}
+		var recordedStatus int
+		auth.RecordImpersonatedRequest = func(user map[string]interface{}, requestWrapper messages.RequestWrapper, status int) {
+			recordedStatus = status
+		}
+		handleDelete = func(a *Actor, requestWrapper messages.RequestWrapper) (response messages.Message, err *utils.Error) {
+			response.Status = http.StatusNoContent
+			return
+		}
+
+		actor := &Actor{actorType: ActorTypeModel, class: "posts"}
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "delete"
+		requestWrapper.Message.Res = "/posts/postid"
+
+		handleRequest(actor, requestWrapper)
+		So(recordedStatus, ShouldEqual, http.StatusNoContent)
+
+		// after trigger gets the admin in the user
+		So(triggerUsers[len(triggerUsers) - 1], ShouldResemble, impersonatedUser)
+	})
+
+	resetFunctions()
+	auth.IsGranted = originalIsGranted
+	auth.RecordImpersonatedRequest = originalRecordImpersonatedRequest
+	hooks.EnqueueTrigger = originalEnqueueTrigger
+}
+
+func TestHandleRequestAfterTrigger(t *testing.T) {
+
+	originalIsGranted := auth.IsGranted
+	originalEnqueueTrigger := hooks.EnqueueTrigger
+
+	var enqueuedBodies []map[string]interface{}
+	var enqueuedUser interface{}
+	hooks.EnqueueTrigger = func(className, when, method string, parameters map[string][]string, body map[string]interface{}, user interface{}) (err *utils.Error) {
+		enqueuedBodies = append(enqueuedBodies, body)
+		enqueuedUser = user
+		return
+	}
+	requestUser := map[string]interface{}{"_id": "userid", "password": "hashedpassword"}
+	auth.IsGranted = func(collection string, requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (isGranted bool, user map[string]interface{}, roles []string, err *utils.Error) {
+		isGranted = true
+		user = requestUser
+		return
+	}
+
+	resetFunctions()
+	Convey("Should enqueue the after trigger only for the successful requests", t, func() {
+
+		var handleErr *utils.Error
+		handlePost = func(a *Actor, requestWrapper messages.RequestWrapper, user interface{}) (response messages.Message, hookBody map[string]interface{}, err *utils.Error) {
+			response.Status = http.StatusCreated
+			hookBody = map[string]interface{}{"_id": "postid"}
+			err = handleErr
+			return
+		}
+
+		actor := &Actor{actorType: ActorTypeCollection, class: "posts", res: "/posts"}
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "post"
+		requestWrapper.Message.Res = "/posts"
+		requestWrapper.Message.Body = map[string]interface{}{}
+
+		handleRequest(actor, requestWrapper)
+		So(len(enqueuedBodies), ShouldEqual, 1)
+		So(enqueuedBodies[0]["_id"], ShouldEqual, "postid")
+
+		// hidden fields of the user are not saved to the queue
+		So(enqueuedUser.(map[string]interface{})["_id"], ShouldEqual, "userid")
+		So(enqueuedUser, ShouldNotContainKey, "password")
+		So(requestUser["password"], ShouldEqual, "hashedpassword")
+
+		handleErr = &utils.Error{http.StatusBadRequest, "Invalid post."}
+		handleRequest(actor, requestWrapper)
+		So(len(enqueuedBodies), ShouldEqual, 1)
+	})
+
+	resetFunctions()
+	auth.IsGranted = originalIsGranted
+	hooks.EnqueueTrigger = originalEnqueueTrigger
+}
+
+func TestHandleCurrentUser(t *testing.T) {
+
+	hooks.ExecuteTrigger = func(className, when, method string,
+	parameters map[string][]string, body map[string]interface{}, multipart *multipart.Form,
+	user interface{}) (responseBody map[string]interface{}, err *utils.Error) {
+		return
+	}
+
+	originalResolveCurrentUser := auth.ResolveCurrentUser
+	originalIsGranted := auth.IsGranted
+	originalFilterFields := auth.FilterFields
+
+	auth.ResolveCurrentUser = func(requestWrapper messages.RequestWrapper) (resolved messages.RequestWrapper, err *utils.Error) {
+		resolved = requestWrapper
+		resolved.Res = "/users/userid"
+		resolved.Message.Res = "/users/userid"
+		return
+	}
+	auth.FilterFields = func(className string, object map[string]interface{}, user map[string]interface{}, roles []string) map[string]interface{} {
+		delete(object, "password")
+		return object
+	}
+
+	resetFunctions()
+	Convey("Should handle /users/me as the object of the user", t, func() {
+
+		var grantedRes string
+		auth.IsGranted = func(collection string, requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (isGranted bool, user map[string]interface{}, roles []string, err *utils.Error) {
+			grantedRes = requestWrapper.Res
+			isGranted = true
+			roles = []string{"role:editor", "role:admin", "user:userid", "*"}
+			return
+		}
+
+		var requestedRes string
+		handleGet = func(a *Actor, requestWrapper messages.RequestWrapper, roles []string) (response messages.Message, err *utils.Error) {
+			requestedRes = requestWrapper.Message.Res
+			response.Body = map[string]interface{}{"_id": "userid", "password": "hashedpassword"}
+			return
+		}
+
+		actor := &Actor{res: ResourceMe, actorType: ActorTypeModel, class: ClassUsers}
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Res = ResourceMe
+		requestWrapper.Message.Res = ResourceMe
+		requestWrapper.Message.Command = "get"
+
+		response := handleRequest(actor, requestWrapper)
+		So(grantedRes, ShouldEqual, "/users/userid")
+		So(requestedRes, ShouldEqual, "/users/userid")
+		So(response.Body, ShouldNotContainKey, "password")
+		So(response.Body, ShouldNotContainKey, "roles")
+
+		requestWrapper.Message.Parameters = map[string][]string{"expand": {"roles"}}
+		response = handleRequest(actor, requestWrapper)
+		So(response.Body["roles"], ShouldResemble, []string{"admin", "editor"})
+	})
+
+	Convey("Should return the error of resolving the user", t, func() {
+
+		auth.ResolveCurrentUser = func(requestWrapper messages.RequestWrapper) (resolved messages.RequestWrapper, err *utils.Error) {
+			err = &utils.Error{http.StatusUnauthorized, "Access token must be provided for /users/me."}
+			return
+		}
+
+		actor := &Actor{res: ResourceMe, actorType: ActorTypeModel, class: ClassUsers}
+		response := handleRequest(actor, messages.RequestWrapper{})
+		So(response.Status, ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("Should delete the account of the user instead of the object", t, func() {
+
+		auth.ResolveCurrentUser = func(requestWrapper messages.RequestWrapper) (resolved messages.RequestWrapper, err *utils.Error) {
+			resolved = requestWrapper
+			return
+		}
+		auth.IsGranted = func(collection string, requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (isGranted bool, user map[string]interface{}, roles []string, err *utils.Error) {
+			isGranted = true
+			user = map[string]interface{}{"_id": "userid"}
+			return
+		}
+
+		var deletedUser map[string]interface{}
+		auth.HandleDeleteAccount = func(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+			deletedUser = user
+			response.Status = http.StatusNoContent
+			return
+		}
+		var deleteCalled bool
+		handleDelete = func(a *Actor, requestWrapper messages.RequestWrapper) (response messages.Message, err *utils.Error) {
+			deleteCalled = true
+			return
+		}
+
+		actor := &Actor{res: ResourceMe, actorType: ActorTypeModel, class: ClassUsers}
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "delete"
+		requestWrapper.Message.Res = "/users/userid"
+
+		response := handleRequest(actor, requestWrapper)
+		So(response.Status, ShouldEqual, http.StatusNoContent)
+		So(deletedUser["_id"], ShouldEqual, "userid")
+		So(deleteCalled, ShouldBeFalse)
+
+		// the same user object on its own resource is deleted with the account too
+		deletedUser = nil
+		actor = &Actor{res: "/users/userid", actorType: ActorTypeModel, class: ClassUsers}
+		response = handleRequest(actor, requestWrapper)
+		So(response.Status, ShouldEqual, http.StatusNoContent)
+		So(deletedUser["_id"], ShouldEqual, "userid")
+		So(deleteCalled, ShouldBeFalse)
+	})
+
+	Convey("Should not allow deleting other users without the master key", t, func() {
+
+		auth.IsGranted = func(collection string, requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (isGranted bool, user map[string]interface{}, roles []string, err *utils.Error) {
+			isGranted = true
+			user = map[string]interface{}{"_id": "userid"}
+			return
+		}
+		var deleteCalled bool
+		handleDelete = func(a *Actor, requestWrapper messages.RequestWrapper) (response messages.Message, err *utils.Error) {
+			deleteCalled = true
+			return
+		}
+
+		actor := &Actor{res: "/users/otheruserid", actorType: ActorTypeModel, class: ClassUsers}
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "delete"
+		requestWrapper.Message.Res = "/users/otheruserid"
+
+		response := handleRequest(actor, requestWrapper)
+		So(response.Status, ShouldEqual, http.StatusForbidden)
+		So(deleteCalled, ShouldBeFalse)
+	})
+
+	resetFunctions()
+	auth.ResolveCurrentUser = originalResolveCurrentUser
+	auth.IsGranted = originalIsGranted
+	auth.FilterFields = originalFilterFields
+}
+
 func TestHandleGet(t *testing.T) {
 
 	resetFunctions()
@@ -427,7 +847,7 @@ func TestHandleGet(t *testing.T) {
 
 		var actor Actor
 		actor.actorType = ActorTypeModel
-		_, err := handleGet(&actor, messages.RequestWrapper{})
+		_, err := handleGet(&actor, messages.RequestWrapper{}, nil)
 		So(err, ShouldBeNil)
 		So(called, ShouldBeTrue)
 
@@ -437,19 +857,37 @@ func TestHandleGet(t *testing.T) {
 	Convey("Should call adapters.Query", t, func() {
 
 		var called bool
-		adapters.Query = func(collection string, parameters map[string][]string) (response map[string]interface{}, err *utils.Error) {
+		adapters.Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
 			called = true
 			return
 		}
 
 		var actor Actor
 		actor.actorType = ActorTypeCollection
-		_, err := handleGet(&actor, messages.RequestWrapper{})
+		_, err := handleGet(&actor, messages.RequestWrapper{}, nil)
 		So(err, ShouldBeNil)
 		So(called, ShouldBeTrue)
 
 	})
 
+	resetFunctions()
+	Convey("Should query with the roles of the user", t, func() {
+
+		var queriedRoles []string
+		adapters.Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
+			queriedRoles = roles
+			return
+		}
+
+		var actor Actor
+		actor.actorType = ActorTypeCollection
+		roles := []string{"role:admin", "user:123", "*"}
+		_, err := handleGet(&actor, messages.RequestWrapper{}, roles)
+		So(err, ShouldBeNil)
+		So(queriedRoles, ShouldResemble, roles)
+
+	})
+
 }
 
 func TestHandlePost(t *testing.T) {
@@ -538,6 +976,23 @@ func TestHandlePut(t *testing.T) {
 		So(err, ShouldBeNil)
 		So(called, ShouldBeTrue)
 	})
+
+	Convey("Should call auth.HandleUpdateRole", t, func() {
+
+		var actor Actor
+		actor.actorType = ActorTypeModel
+		actor.class = ClassRoles
+
+		var called bool
+		auth.HandleUpdateRole = func(requestWrapper messages.RequestWrapper) (response messages.Message, hookBody map[string]interface{}, err *utils.Error) {
+			called = true
+			return
+		}
+
+		_, _, err := handlePut(&actor, messages.RequestWrapper{})
+		So(err, ShouldBeNil)
+		So(called, ShouldBeTrue)
+	})
 }
 
 func TestHandleDelete(t *testing.T) {
@@ -569,6 +1024,180 @@ func TestHandleDelete(t *testing.T) {
 	})
 }
 
+func TestHandleSessions(t *testing.T) {
+
+	resetFunctions()
+	Convey("Should call auth.HandleListSessions", t, func() {
+
+		var actor Actor
+		actor.res = ResourceMySessions
+
+		var called bool
+		auth.HandleListSessions = func(requestWrapper messages.RequestWrapper, user interface{}) (response messages.Message, err *utils.Error) {
+			called = true
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "get"
+
+		_, err := handleSessions(&actor, requestWrapper, nil)
+		So(err, ShouldBeNil)
+		So(called, ShouldBeTrue)
+	})
+
+	Convey("Should call auth.HandleDeleteSession", t, func() {
+
+		var actor Actor
+		actor.res = ResourceMySessions + "/sessionid"
+
+		var called bool
+		auth.HandleDeleteSession = func(requestWrapper messages.RequestWrapper, user interface{}) (response messages.Message, err *utils.Error) {
+			called = true
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "delete"
+
+		_, err := handleSessions(&actor, requestWrapper, nil)
+		So(err, ShouldBeNil)
+		So(called, ShouldBeTrue)
+	})
+
+	Convey("Should return method not allowed", t, func() {
+
+		var actor Actor
+		actor.res = ResourceMySessions
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "delete"
+
+		_, err := handleSessions(&actor, requestWrapper, nil)
+		So(err.Code, ShouldEqual, http.StatusMethodNotAllowed)
+	})
+}
+
+func TestHandleProviders(t *testing.T) {
+
+	resetFunctions()
+	Convey("Should call auth.HandleLinkProvider", t, func() {
+
+		var actor Actor
+		actor.res = ResourceMyProviders
+
+		var called bool
+		auth.HandleLinkProvider = func(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+			called = true
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "post"
+
+		_, err := handleProviders(&actor, requestWrapper, nil)
+		So(err, ShouldBeNil)
+		So(called, ShouldBeTrue)
+	})
+
+	Convey("Should call auth.HandleUnlinkProvider", t, func() {
+
+		var actor Actor
+		actor.res = ResourceMyProviders + "/facebook"
+
+		var called bool
+		auth.HandleUnlinkProvider = func(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+			called = true
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "delete"
+
+		_, err := handleProviders(&actor, requestWrapper, nil)
+		So(err, ShouldBeNil)
+		So(called, ShouldBeTrue)
+	})
+
+	Convey("Should return method not allowed", t, func() {
+
+		var actor Actor
+		actor.res = ResourceMyProviders
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "delete"
+
+		_, err := handleProviders(&actor, requestWrapper, nil)
+		So(err.Code, ShouldEqual, http.StatusMethodNotAllowed)
+	})
+}
+
+func TestHandleExport(t *testing.T) {
+
+	resetFunctions()
+	Convey("Should call auth.HandleExportAccount", t, func() {
+
+		actor := &Actor{res: ResourceMyExport}
+
+		var called bool
+		auth.HandleExportAccount = func(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+			called = true
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "get"
+
+		_, err := handleExport(actor, requestWrapper, nil)
+		So(err, ShouldBeNil)
+		So(called, ShouldBeTrue)
+	})
+
+	Convey("Should return method not allowed", t, func() {
+
+		actor := &Actor{res: ResourceMyExport}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "post"
+
+		_, err := handleExport(actor, requestWrapper, nil)
+		So(err.Code, ShouldEqual, http.StatusMethodNotAllowed)
+	})
+}
+
+func TestHandleUserAction(t *testing.T) {
+
+	resetFunctions()
+	Convey("Should call auth.HandleManageUser", t, func() {
+
+		actor := &Actor{res: "/users/userid/disable"}
+
+		var called bool
+		auth.HandleManageUser = func(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+			called = true
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "post"
+
+		_, err := handleUserAction(actor, requestWrapper, nil)
+		So(err, ShouldBeNil)
+		So(called, ShouldBeTrue)
+	})
+
+	Convey("Should return method not allowed", t, func() {
+
+		actor := &Actor{res: "/users/userid/disable"}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "get"
+
+		_, err := handleUserAction(actor, requestWrapper, nil)
+		So(err.Code, ShouldEqual, http.StatusMethodNotAllowed)
+	})
+}
+
 func TestGetChildRes(t *testing.T) {
 
 	Convey("Should return correct res of the child", t, func() {
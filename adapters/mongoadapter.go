@@ -122,7 +122,22 @@ var Get = func(collection string, id string) (response map[string]interface{}, e
 	return
 }
 
-var Query = func(collection string, parameters map[string][]string) (response map[string]interface{}, err *utils.Error) {
+// Queries the objects of the collection. Only the objects that one of the given roles can 'get' are returned. Roles
+// must be nil for the queries that are made by the system itself, which are not restricted by the acl of the objects.
+var Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
+
+	queryParameters, err := ParseQueryParameters(parameters)
+	if err != nil {
+		return
+	}
+	whereParam := queryParameters.Where
+	aggregateParam := queryParameters.Aggregate
+	hasAggregateParam := queryParameters.HasAggregate
+	sortParam := queryParameters.Sort
+	hasSortParam := queryParameters.HasSort
+	limitParam := queryParameters.Limit
+	skipParam := queryParameters.Skip
+	countParam := queryParameters.Count
 
 	sessionCopy := Session.Copy()
 	defer sessionCopy.Close()
@@ -130,35 +145,42 @@ var Query = func(collection string, parameters map[string][]string) (response ma
 
 	response = make(map[string]interface{})
 
-	if parameters["aggregate"] != nil && parameters["where"] != nil {
-		err = &utils.Error{http.StatusBadRequest, "Where and aggregate parameters cannot be used at the same request."}
-		return
-	}
-
 	var results []map[string]interface{}
 	var getErr error
 
-	whereParam, hasWhereParam, whereParamErr := extractJsonParameter(parameters, "where")
-	aggregateParam, hasAggregateParam, aggregateParamErr := extractJsonParameter(parameters, "aggregate")
-	sortParam, hasSortParam, sortParamErr := extractStringParameter(parameters, "sort")
-	limitParam, _, limitParamErr := extractIntParameter(parameters, "limit")
-	skipParam, _, skipParamErr := extractIntParameter(parameters, "skip")
-
-	if aggregateParamErr != nil {err = aggregateParamErr}
-	if whereParamErr != nil {err = whereParamErr}
-	if sortParamErr != nil {err = sortParamErr}
-	if limitParamErr != nil {err = limitParamErr}
-	if skipParamErr != nil {err = skipParamErr}
-	if err != nil {return}
-
-	if hasWhereParam && hasAggregateParam {
-		err = &utils.Error{http.StatusInternalServerError, "Aggregation cannot be used with where parameter."};
-		return
-	}
-
 	if hasAggregateParam {
+		if roles != nil {
+			pipeline, isPipeline := aggregateParam.([]interface{})
+			if !isPipeline {
+				err = &utils.Error{http.StatusBadRequest, "Aggregate parameter must be an array of stages."}
+				return
+			}
+			err = checkAggregateStages(pipeline)
+			if err != nil {
+				return
+			}
+			aggregateParam = append([]interface{}{map[string]interface{}{"$match": aclPredicate(roles)}}, pipeline...)
+		}
 		getErr = connection.Pipe(aggregateParam).All(&results)
 	} else {
+		if roles != nil {
+			if whereParam != nil {
+				whereParam = map[string]interface{}{"$and": []interface{}{whereParam, aclPredicate(roles)}}
+			} else {
+				whereParam = aclPredicate(roles)
+			}
+		}
+
+		if countParam {
+			var count int
+			count, getErr = connection.Find(whereParam).Count()
+			if getErr != nil {
+				err = &utils.Error{http.StatusInternalServerError, "Counting items failed."};
+				return
+			}
+			response["count"] = count
+		}
+
 		query := connection.Find(whereParam).Skip(skipParam).Limit(limitParam)
 		if hasSortParam {
 			query = query.Sort(sortParam)
@@ -180,6 +202,106 @@ var Query = func(collection string, parameters map[string][]string) (response ma
 	return
 }
 
+// parameters of a query after they are parsed
+type QueryParameters struct {
+	Where        interface{}
+	Aggregate    interface{}
+	HasAggregate bool
+	Sort         string
+	HasSort      bool
+	Limit        int
+	Skip         int
+	Count        bool
+}
+
+// parses and validates the parameters of a query, like 'where' and 'sort'
+var ParseQueryParameters = func(parameters map[string][]string) (queryParameters QueryParameters, err *utils.Error) {
+
+	if parameters["aggregate"] != nil && parameters["where"] != nil {
+		err = &utils.Error{http.StatusBadRequest, "Where and aggregate parameters cannot be used at the same request."}
+		return
+	}
+
+	whereParam, _, whereParamErr := extractJsonParameter(parameters, "where")
+	aggregateParam, hasAggregateParam, aggregateParamErr := extractJsonParameter(parameters, "aggregate")
+	sortParam, hasSortParam, sortParamErr := extractStringParameter(parameters, "sort")
+	limitParam, _, limitParamErr := extractIntParameter(parameters, "limit")
+	skipParam, _, skipParamErr := extractIntParameter(parameters, "skip")
+
+	if aggregateParamErr != nil {err = aggregateParamErr}
+	if whereParamErr != nil {err = whereParamErr}
+	if sortParamErr != nil {err = sortParamErr}
+	if limitParamErr != nil {err = limitParamErr}
+	if skipParamErr != nil {err = skipParamErr}
+	if err != nil {return}
+
+	queryParameters = QueryParameters{
+		Where: whereParam,
+		Aggregate: aggregateParam,
+		HasAggregate: hasAggregateParam,
+		Sort: sortParam,
+		HasSort: hasSortParam,
+		Limit: limitParam,
+		Skip: skipParam,
+		Count: parameters["count"] != nil && parameters["count"][0] == "true",
+	}
+	return
+}
+
+// stages that only work on the objects of the queried collection. the other stages can read or write other
+// collections without their acl, like '$lookup' and '$out'.
+var allowedAggregateStages = map[string]bool{
+	"$match": true,
+	"$project": true,
+	"$addFields": true,
+	"$set": true,
+	"$unset": true,
+	"$group": true,
+	"$sort": true,
+	"$skip": true,
+	"$limit": true,
+	"$count": true,
+	"$unwind": true,
+	"$sample": true,
+	"$bucket": true,
+	"$bucketAuto": true,
+	"$sortByCount": true,
+	"$replaceRoot": true,
+	"$replaceWith": true,
+}
+
+func checkAggregateStages(pipeline []interface{}) (err *utils.Error) {
+
+	for _, stage := range pipeline {
+		stageAsMap, isMap := stage.(map[string]interface{})
+		if !isMap || len(stageAsMap) != 1 {
+			err = &utils.Error{http.StatusBadRequest, "Aggregation stages must be objects with one operator."}
+			return
+		}
+		for operator := range stageAsMap {
+			if !allowedAggregateStages[operator] {
+				err = &utils.Error{http.StatusBadRequest, "Aggregation stage '" + operator + "' is not allowed."}
+				return
+			}
+		}
+	}
+	return
+}
+
+// matches the objects that have no acl or that give 'get' permission to one of the roles
+func aclPredicate(roles []string) map[string]interface{} {
+
+	conditions := []interface{}{
+		map[string]interface{}{"_acl": nil},
+	}
+	for _, role := range roles {
+		conditions = append(conditions, map[string]interface{}{
+			"_acl." + role + ".get": map[string]interface{}{"$exists": true},
+		})
+	}
+	return map[string]interface{}{"$or": conditions}
+}
+
 var Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
 
 	sessionCopy := Session.Copy()
@@ -239,6 +361,66 @@ var Delete = func(collection string, id string) (response map[string]interface{}
 	return
 }
 
+var DeleteAll = func(collection string, where map[string]interface{}) (err *utils.Error) {
+
+	sessionCopy := Session.Copy()
+	defer sessionCopy.Close()
+	connection := sessionCopy.DB(Database).C(collection)
+
+	_, removeErr := connection.RemoveAll(where)
+	if removeErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Deleting items failed."};
+	}
+	return
+}
+
+// sets the given fields of all the objects that match the where clause
+var UpdateAll = func(collection string, where map[string]interface{}, data map[string]interface{}) (err *utils.Error) {
+
+	sessionCopy := Session.Copy()
+	defer sessionCopy.Close()
+	connection := sessionCopy.DB(Database).C(collection)
+
+	data["updatedAt"] = int32(time.Now().Unix())
+
+	_, updateErr := connection.UpdateAll(where, map[string]interface{}{"$set": data})
+	if updateErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Updating items failed."};
+	}
+	return
+}
+
+// sets the fields of the first object that matches the where clause in the given order and returns the updated object.
+// the object is found and updated atomically, so it is never returned to two callers.
+var FindAndUpdate = func(collection string, where map[string]interface{}, sort string, data map[string]interface{}) (response map[string]interface{}, err *utils.Error) {
+
+	sessionCopy := Session.Copy()
+	defer sessionCopy.Close()
+	connection := sessionCopy.DB(Database).C(collection)
+
+	change := mgo.Change{Update: map[string]interface{}{"$set": data}, ReturnNew: true}
+	_, updateErr := connection.Find(where).Sort(sort).Apply(change, &response)
+	if updateErr == mgo.ErrNotFound {
+		err = &utils.Error{http.StatusNotFound, "Item not found."};
+	} else if updateErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Updating item failed."};
+	}
+	return
+}
+
+// returns the names of the collections in the database, including the system ones
+var ListClasses = func() (classes []string, err *utils.Error) {
+
+	sessionCopy := Session.Copy()
+	defer sessionCopy.Close()
+
+	classes, listErr := sessionCopy.DB(Database).CollectionNames()
+	if listErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Listing classes failed."};
+	}
+	return
+}
+
 var CreateFile = func(data io.ReadCloser) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
 
 	sessionCopy := Session.Copy()
@@ -0,0 +1,60 @@
+package adapters
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+)
+
+func TestCheckAggregateStages(t *testing.T) {
+
+	Convey("Should allow the stages that work on the queried collection", t, func() {
+
+		pipeline := []interface{}{
+			map[string]interface{}{"$match": map[string]interface{}{"published": true}},
+			map[string]interface{}{"$group": map[string]interface{}{"_id": "$author", "count": map[string]interface{}{"$sum": 1}}},
+			map[string]interface{}{"$sort": map[string]interface{}{"count": -1}},
+		}
+		So(checkAggregateStages(pipeline), ShouldBeNil)
+	})
+
+	Convey("Should reject the stages that read or write other collections", t, func() {
+
+		for _, operator := range []string{"$lookup", "$graphLookup", "$unionWith", "$out", "$merge", "$facet"} {
+			pipeline := []interface{}{map[string]interface{}{operator: map[string]interface{}{}}}
+			err := checkAggregateStages(pipeline)
+			So(err.Code, ShouldEqual, http.StatusBadRequest)
+		}
+
+		err := checkAggregateStages([]interface{}{"$out"})
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+	})
+}
+
+func TestParseQueryParameters(t *testing.T) {
+
+	Convey("Should parse the query parameters", t, func() {
+
+		queryParameters, err := ParseQueryParameters(map[string][]string{
+			"where": {`{"published":true}`},
+			"sort": {`"-createdAt"`},
+			"limit": {"10"},
+			"count": {"true"},
+		})
+		So(err, ShouldBeNil)
+		So(queryParameters.Where, ShouldResemble, map[string]interface{}{"published": true})
+		So(queryParameters.Sort, ShouldEqual, "-createdAt")
+		So(queryParameters.HasSort, ShouldBeTrue)
+		So(queryParameters.Limit, ShouldEqual, 10)
+		So(queryParameters.Count, ShouldBeTrue)
+	})
+
+	Convey("Should reject the sort parameter that is not a string", t, func() {
+
+		_, err := ParseQueryParameters(map[string][]string{"sort": {`{"createdAt":-1}`}})
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+
+		_, err = ParseQueryParameters(map[string][]string{"where": {"{}"}, "aggregate": {"[]"}})
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+	})
+}
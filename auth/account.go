@@ -0,0 +1,445 @@
+package auth
+
+import (
+	"sort"
+	"bytes"
+	"strings"
+	"net/http"
+	"archive/zip"
+	"encoding/json"
+	"golang.org/x/crypto/bcrypt"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+	"github.com/eluleci/dock/hooks"
+)
+
+const (
+	AccountDataDelete = "delete"
+	AccountDataAnonymize = "anonymize"
+	AccountDataKeep = "keep"
+)
+
+// classes that are managed by dock itself. the data of the user in them is removed or exported separately.
+var accountSystemClasses = []string{ClassUsers, ClassRoles, ClassSessions, ClassPasswordResets, ClassTwoFactor, ClassAuditLogs,
+	hooks.ClassHookQueue, hooks.ClassHookDeadLetters}
+
+// deletes the account of the user after the password or a linked provider is confirmed again. the objects of the
+// user are deleted, anonymized or kept with the rules of their classes.
+var HandleDeleteAccount = func(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	if len(user) == 0 {
+		err = &utils.Error{http.StatusUnauthorized, "Access token must be provided for deleting the account."}
+		return
+	}
+
+	response, err = confirmAccount(requestWrapper, user)
+	if err != nil {
+		return
+	}
+
+	userId := user["_id"].(string)
+
+	// the user is deleted last, so a failed request can be sent again
+	err = applyAccountDataRules(userId)
+	if err != nil {
+		return
+	}
+
+	err = revokeSessions(userId)
+	if err != nil {
+		return
+	}
+	err = adapters.DeleteAll(ClassTwoFactor, map[string]interface{}{"userId": userId})
+	if err != nil {
+		return
+	}
+	err = adapters.DeleteAll(ClassPasswordResets, map[string]interface{}{"userId": userId})
+	if err != nil {
+		return
+	}
+	err = removeFromRoles(userId)
+	if err != nil {
+		return
+	}
+
+	_, err = adapters.Delete(ClassUsers, userId)
+	if err != nil {
+		return
+	}
+
+	WriteAuditLog(map[string]interface{}{
+		"action": "deleteAccount",
+		"userId": userId,
+		"ip": requestWrapper.Message.RemoteAddr,
+	})
+
+	response.Status = http.StatusNoContent
+	return
+}
+
+// returns all the data of the user as json, or as a zip archive together with the files of the user
+var HandleExportAccount = func(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	if len(user) == 0 {
+		err = &utils.Error{http.StatusUnauthorized, "Access token must be provided for exporting the account."}
+		return
+	}
+
+	format := "json"
+	if formats := requestWrapper.Message.Parameters["format"]; len(formats) > 0 {
+		format = strings.ToLower(formats[0])
+	}
+	if format != "json" && format != "zip" {
+		err = &utils.Error{http.StatusBadRequest, "Format must be 'json' or 'zip'."}
+		return
+	}
+
+	export, err := collectAccountData(user)
+	if err != nil {
+		return
+	}
+
+	if format == "json" {
+		response.Body = export
+		response.Status = http.StatusOK
+		return
+	}
+
+	response.RawBody, err = createExportArchive(export)
+	if err != nil {
+		return
+	}
+	response.Headers = map[string][]string{
+		"Content-Type": []string{"application/zip"},
+		"Content-Disposition": []string{`attachment; filename="export.zip"`},
+	}
+	response.Status = http.StatusOK
+	return
+}
+
+// the user confirms the deletion with the password, or with the credentials of a linked provider if the user doesn't
+// have a password
+func confirmAccount(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	body := requestWrapper.Message.Body
+
+	if hasPasswordLogin(user) {
+		password, _ := body["password"].(string)
+		if password == "" {
+			err = &utils.Error{http.StatusBadRequest, "Password must be provided in the body with field 'password'."}
+			return
+		}
+
+		accountKeys := getAccountKeys(user)
+		response, err = checkLockout(requestWrapper, accountKeys)
+		if err != nil {
+			return
+		}
+
+		passwordError := bcrypt.CompareHashAndPassword([]byte(user["password"].(string)), []byte(password))
+		if passwordError != nil {
+			recordFailedAttempt(requestWrapper, accountKeys)
+			err = &utils.Error{http.StatusUnauthorized, "Password is not correct."}
+			return
+		}
+		clearFailedAttempts(accountKeys)
+		return
+	}
+
+	providerName, provider, hasProvider := getProvider(body)
+	linkedData, _ := user[providerName].(map[string]interface{})
+	if !hasProvider || linkedData == nil {
+		err = &utils.Error{http.StatusBadRequest, "Credentials of a linked provider must be provided in the body."}
+		return
+	}
+
+	err = authenticateWithProvider(requestWrapper, providerName, provider)
+	if err != nil {
+		return
+	}
+
+	providerData := body[providerName].(map[string]interface{})
+	if providerData["id"] != linkedData["id"] {
+		err = &utils.Error{http.StatusUnauthorized, "Credentials don't belong to the account."}
+	}
+	return
+}
+
+// deletes or anonymizes the objects of the user in all the classes that have rules for it
+var applyAccountDataRules = func(userId string) (err *utils.Error) {
+
+	classNames, err := getAccountDataClasses()
+	if err != nil {
+		return
+	}
+
+	for _, className := range classNames {
+		rules := getAccountDataRules(className)
+
+		switch rules.OnDelete {
+		case AccountDataDelete:
+			err = adapters.DeleteAll(className, userReferenceWhere(rules.UserFields, userId))
+		case AccountDataAnonymize:
+			// only the fields that reference the user are removed, other users in the same object stay
+			for _, field := range rules.UserFields {
+				data := map[string]interface{}{field: nil}
+				for _, personalField := range rules.PersonalFields {
+					data[personalField] = nil
+				}
+				err = adapters.UpdateAll(className, userReferenceWhere([]string{field}, userId), data)
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+var removeFromRoles = func(userId string) (err *utils.Error) {
+
+	roles, err := queryRoles(map[string]interface{}{"users": map[string]interface{}{"$in": []string{userId}}})
+	if err != nil {
+		return
+	}
+
+	for _, role := range roles {
+		members, _ := toStringArray(role["users"])
+		remainingMembers := make([]string, 0, len(members))
+		for _, member := range members {
+			if member != userId {
+				remainingMembers = append(remainingMembers, member)
+			}
+		}
+		_, _, err = adapters.Update(ClassRoles, role["_id"].(string), map[string]interface{}{"users": remainingMembers})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// returns the user, the sessions, the roles and the objects of the user, and the ids of the files in them. the
+// objects are filtered with the field rules the same way they are returned to the user.
+var collectAccountData = func(user map[string]interface{}) (export map[string]interface{}, err *utils.Error) {
+
+	userId := user["_id"].(string)
+
+	roles, err := getRolesOfUser(user)
+	if err != nil {
+		return
+	}
+
+	userData := make(map[string]interface{})
+	for k, v := range user {
+		userData[k] = v
+	}
+	FilterFields(ClassUsers, userData, user, roles)
+
+	sessions, err := queryObjects(ClassSessions, map[string]interface{}{"userId": userId})
+	if err != nil {
+		return
+	}
+	sessionData := make([]map[string]interface{}, 0, len(sessions))
+	for _, session := range sessions {
+		userAgent, _ := session["userAgent"].(string)
+		sessionData = append(sessionData, map[string]interface{}{
+			"_id": session["_id"],
+			"device": parseUserAgent(userAgent),
+			"userAgent": userAgent,
+			"ip": session["ip"],
+			"createdAt": session["createdAt"],
+			"lastUsedAt": session["lastUsedAt"],
+		})
+	}
+
+	classNames, err := getAccountDataClasses()
+	if err != nil {
+		return
+	}
+
+	objects := make(map[string]interface{})
+	fileIds := collectFileIds(userData, nil)
+	for _, className := range classNames {
+		rules := getAccountDataRules(className)
+
+		var results []map[string]interface{}
+		results, err = queryObjects(className, userReferenceWhere(rules.UserFields, userId))
+		if err != nil {
+			return
+		}
+		if len(results) == 0 {
+			continue
+		}
+
+		for _, object := range results {
+			FilterFields(className, object, user, roles)
+			fileIds = collectFileIds(object, fileIds)
+		}
+		objects[className] = results
+	}
+
+	files := make([]string, 0, len(fileIds))
+	for id := range fileIds {
+		files = append(files, id)
+	}
+	sort.Strings(files)
+
+	export = map[string]interface{}{
+		"user": userData,
+		"sessions": sessionData,
+		"roles": GetRoleNames(roles),
+		"objects": objects,
+		"files": files,
+	}
+	return
+}
+
+// writes the data as 'data.json' and the files as 'files/<id>' to a zip archive
+func createExportArchive(export map[string]interface{}) (archive []byte, err *utils.Error) {
+
+	data, jsonErr := json.MarshalIndent(export, "", "  ")
+	if jsonErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Creating export data failed."}
+		return
+	}
+
+	var buffer bytes.Buffer
+	zipWriter := zip.NewWriter(&buffer)
+
+	names := []string{"data.json"}
+	entries := map[string][]byte{"data.json": data}
+	files, _ := export["files"].([]string)
+	for _, id := range files {
+		content, getErr := adapters.GetFile(id)
+		if getErr != nil {
+			// the objects may reference files that are already deleted
+			utils.Log("warn", "File '" + id + "' of the export is not found.")
+			continue
+		}
+		names = append(names, "files/" + id)
+		entries["files/" + id] = content
+	}
+
+	for _, name := range names {
+		entryWriter, createErr := zipWriter.Create(name)
+		if createErr == nil {
+			_, createErr = entryWriter.Write(entries[name])
+		}
+		if createErr != nil {
+			err = &utils.Error{http.StatusInternalServerError, "Creating export archive failed."}
+			return
+		}
+	}
+
+	if closeErr := zipWriter.Close(); closeErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Creating export archive failed."}
+		return
+	}
+	archive = buffer.Bytes()
+	return
+}
+
+// returns the classes that can contain the objects of users
+var getAccountDataClasses = func() (classNames []string, err *utils.Error) {
+
+	allClasses, err := adapters.ListClasses()
+	if err != nil {
+		return
+	}
+
+	for _, className := range allClasses {
+		isSystemClass := strings.HasPrefix(className, "system.") || strings.HasPrefix(className, "fs.")
+		for _, systemClass := range accountSystemClasses {
+			if className == systemClass {
+				isSystemClass = true
+			}
+		}
+		if !isSystemClass {
+			classNames = append(classNames, className)
+		}
+	}
+	sort.Strings(classNames)
+	return
+}
+
+func getAccountDataRules(className string) (rules config.AccountDataRules) {
+
+	var hasRules bool
+	if rules, hasRules = config.SystemConfig.AccountData[className]; !hasRules {
+		rules = config.SystemConfig.AccountData["*"]
+	}
+
+	if len(rules.UserFields) == 0 {
+		rules.UserFields = []string{"_owner"}
+	}
+	if rules.OnDelete == "" {
+		rules.OnDelete = AccountDataKeep
+	}
+	return
+}
+
+// matches the objects that have the user in one of the fields, either as id or as reference
+func userReferenceWhere(fields []string, userId string) map[string]interface{} {
+
+	conditions := make([]interface{}, 0, len(fields) * 2)
+	for _, field := range fields {
+		conditions = append(conditions,
+			map[string]interface{}{field: userId},
+			map[string]interface{}{field + "._id": userId})
+	}
+	return map[string]interface{}{"$or": conditions}
+}
+
+// adds the ids of the file references in the value to the set
+func collectFileIds(value interface{}, fileIds map[string]bool) map[string]bool {
+
+	if fileIds == nil {
+		fileIds = make(map[string]bool)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if v["_type"] == "reference" && v["_class"] == ClassFiles {
+			if id, isString := v["_id"].(string); isString && id != "" {
+				fileIds[id] = true
+			}
+			return fileIds
+		}
+		for _, item := range v {
+			collectFileIds(item, fileIds)
+		}
+	case []map[string]interface{}:
+		for _, item := range v {
+			collectFileIds(item, fileIds)
+		}
+	case []interface{}:
+		for _, item := range v {
+			collectFileIds(item, fileIds)
+		}
+	}
+	return fileIds
+}
+
+var queryObjects = func(className string, where map[string]interface{}) (objects []map[string]interface{}, err *utils.Error) {
+
+	whereParamsJson, jsonErr := json.Marshal(where)
+	if jsonErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Creating export request failed."}
+		return
+	}
+
+	parameters := map[string][]string{"where": []string{string(whereParamsJson)}}
+	results, err := adapters.Query(className, parameters, nil)
+	if err != nil {
+		return
+	}
+
+	objects, _ = results["data"].([]map[string]interface{})
+	return
+}
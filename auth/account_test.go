@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"bytes"
+	"testing"
+	"archive/zip"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+)
+
+func TestAccount(t *testing.T) {
+
+	originalQueryRoles := queryRoles
+	config.SystemConfig = config.Config{
+		AccountData: map[string]config.AccountDataRules{
+			"posts": {OnDelete: AccountDataDelete},
+			"comments": {UserFields: []string{"author"}, OnDelete: AccountDataAnonymize, PersonalFields: []string{"authorName"}},
+		},
+	}
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("ihaveamazinghair"), bcrypt.MinCost)
+	user := map[string]interface{}{"_id": "userid", "email": "johny@bravo.com", "password": string(hashedPassword)}
+
+	adapters.ListClasses = func() (classes []string, err *utils.Error) {
+		classes = []string{"comments", "posts", "messages", ClassUsers, ClassSessions, "fs.files", "system.indexes"}
+		return
+	}
+	queryRoles = func(where map[string]interface{}) (roles []map[string]interface{}, err *utils.Error) {
+		roles = []map[string]interface{}{
+			{"_id": "roleid", "name": "editor", "users": []interface{}{"userid", "otheruserid"}},
+		}
+		return
+	}
+	adapters.Create = func(collection string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+		return
+	}
+
+	Convey("Should delete the account and apply the data rules", t, func() {
+
+		deletedWhere := make(map[string]interface{})
+		adapters.DeleteAll = func(collection string, where map[string]interface{}) (err *utils.Error) {
+			deletedWhere[collection] = where
+			return
+		}
+		updatedData := make(map[string]interface{})
+		adapters.UpdateAll = func(collection string, where map[string]interface{}, data map[string]interface{}) (err *utils.Error) {
+			updatedData[collection] = data
+			return
+		}
+		var roleMembers interface{}
+		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			roleMembers = data["users"]
+			return
+		}
+		var deletedUserId string
+		adapters.Delete = func(collection string, id string) (response map[string]interface{}, err *utils.Error) {
+			deletedUserId = id
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"password": "ihaveamazinghair"}
+
+		response, err := HandleDeleteAccount(requestWrapper, user)
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusNoContent)
+		So(deletedUserId, ShouldEqual, "userid")
+		So(deletedWhere["posts"], ShouldResemble, map[string]interface{}{"$or": []interface{}{
+			map[string]interface{}{"_owner": "userid"},
+			map[string]interface{}{"_owner._id": "userid"},
+		}})
+		So(deletedWhere, ShouldContainKey, ClassSessions)
+		So(deletedWhere, ShouldContainKey, ClassTwoFactor)
+		So(deletedWhere, ShouldContainKey, ClassPasswordResets)
+		So(deletedWhere, ShouldNotContainKey, "messages")
+		So(updatedData["comments"], ShouldContainKey, "author")
+		So(updatedData["comments"], ShouldContainKey, "authorName")
+		So(roleMembers, ShouldResemble, []string{"otheruserid"})
+	})
+
+	Convey("Should not delete the account without the correct password", t, func() {
+
+		var deleted bool
+		adapters.Delete = func(collection string, id string) (response map[string]interface{}, err *utils.Error) {
+			deleted = true
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"password": "wrongpassword"}
+
+		_, err := HandleDeleteAccount(requestWrapper, user)
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+
+		requestWrapper.Message.Body = map[string]interface{}{}
+		_, err = HandleDeleteAccount(requestWrapper, user)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+		So(deleted, ShouldBeFalse)
+	})
+
+	Convey("Should confirm the accounts without password with a linked provider", t, func() {
+
+		RegisterProvider("myprovider", testProvider{})
+
+		providerUser := map[string]interface{}{"_id": "userid", "myprovider": map[string]interface{}{"id": "provideruserid"}}
+		_, err := confirmAccount(makeTestProviderRequest("validtoken"), providerUser)
+		So(err, ShouldBeNil)
+
+		providerUser["myprovider"] = map[string]interface{}{"id": "anotherprovideruserid"}
+		_, err = confirmAccount(makeTestProviderRequest("validtoken"), providerUser)
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+
+		_, err = confirmAccount(makeTestProviderRequest("validtoken"), map[string]interface{}{"_id": "userid"})
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+
+		providersLock.Lock()
+		delete(providers, "myprovider")
+		providersLock.Unlock()
+	})
+
+	Convey("Should export the data of the user", t, func() {
+
+		queryRoles = func(where map[string]interface{}) (roles []map[string]interface{}, err *utils.Error) {
+			return
+		}
+		queriedClasses := make(map[string]bool)
+		adapters.Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
+			queriedClasses[collection] = true
+			data := make([]map[string]interface{}, 0)
+			if collection == ClassSessions {
+				data = append(data, map[string]interface{}{"_id": "sessionid", "refreshToken": "hashedtoken", "userAgent": "okhttp/3.2.0"})
+			} else if collection == "posts" {
+				data = append(data, map[string]interface{}{
+					"_id": "postid",
+					"image": map[string]interface{}{"_type": "reference", "_class": "files", "_id": "fileid"},
+				})
+			}
+			response = map[string]interface{}{"data": data}
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		response, err := HandleExportAccount(requestWrapper, user)
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusOK)
+		So(response.Body["user"], ShouldNotContainKey, "password")
+		So(response.Body["sessions"], ShouldResemble, []map[string]interface{}{{
+			"_id": "sessionid", "device": "Android app on unknown device", "userAgent": "okhttp/3.2.0", "ip": nil, "createdAt": nil, "lastUsedAt": nil,
+		}})
+		So(response.Body["objects"], ShouldContainKey, "posts")
+		So(response.Body["objects"], ShouldNotContainKey, "comments")
+		So(response.Body["files"], ShouldResemble, []string{"fileid"})
+		So(queriedClasses, ShouldNotContainKey, "fs.files")
+	})
+
+	Convey("Should export the data with the files as zip", t, func() {
+
+		adapters.GetFile = func(id string) (response []byte, err *utils.Error) {
+			response = []byte("filecontent")
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Parameters = map[string][]string{"format": {"zip"}}
+		response, err := HandleExportAccount(requestWrapper, user)
+		So(err, ShouldBeNil)
+		So(response.Headers["Content-Type"], ShouldResemble, []string{"application/zip"})
+
+		reader, zipErr := zip.NewReader(bytes.NewReader(response.RawBody), int64(len(response.RawBody)))
+		So(zipErr, ShouldBeNil)
+		So(len(reader.File), ShouldEqual, 2)
+		So(reader.File[0].Name, ShouldEqual, "data.json")
+		So(reader.File[1].Name, ShouldEqual, "files/fileid")
+
+		requestWrapper.Message.Parameters = map[string][]string{"format": {"xml"}}
+		_, err = HandleExportAccount(requestWrapper, user)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+	})
+
+	queryRoles = originalQueryRoles
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"github.com/eluleci/dock/config"
+)
+
+const (
+	AclKeyCreator = "creator"
+	AclKeyOwner = "owner"
+)
+
+// templates that are used for system classes when they are not given in the configuration file
+var defaultAclTemplates = map[string]map[string]map[string]bool{
+	ClassRoles: {
+		AclKeyCreator: {"get": true, "update": true, "delete": true},
+	},
+	// users are the creators of themselves
+	ClassUsers: {
+		AclKeyCreator: {"get": true, "update": true, "delete": true},
+	},
+}
+
+// sets the default acl of the class to the object if the object doesn't have an acl
+var ApplyDefaultAcl = func(className string, object map[string]interface{}, user map[string]interface{}) {
+
+	if _, hasAcl := object["_acl"]; hasAcl {
+		return
+	}
+
+	template, hasTemplate := config.SystemConfig.DefaultAcl[className]
+	if !hasTemplate {
+		template, hasTemplate = defaultAclTemplates[className]
+	}
+	if !hasTemplate {
+		template, hasTemplate = config.SystemConfig.DefaultAcl["*"]
+	}
+	if !hasTemplate {
+		return
+	}
+
+	acl := make(map[string]interface{})
+	for key, permissions := range template {
+		switch key {
+		case AclKeyCreator:
+			if user == nil || user["_id"] == nil {
+				continue
+			}
+			key = "user:" + user["_id"].(string)
+		case AclKeyOwner:
+			owner, hasOwner := object["_owner"].(string)
+			if !hasOwner || owner == "" {
+				continue
+			}
+			key = "user:" + owner
+		}
+
+		// the same user can be both creator and owner
+		merged, _ := acl[key].(map[string]bool)
+		if merged == nil {
+			merged = make(map[string]bool)
+		}
+		for permission, isGranted := range permissions {
+			if isGranted {
+				merged[permission] = true
+			}
+		}
+		acl[key] = merged
+	}
+
+	object["_acl"] = acl
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/config"
+)
+
+func TestApplyDefaultAcl(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+	config.SystemConfig.DefaultAcl = map[string]map[string]map[string]bool{
+		"posts": {
+			"creator": {"get": true, "update": true, "delete": true},
+			"owner": {"get": true, "update": true},
+			"*": {"get": true},
+		},
+		"*": {
+			"role:admin": {"get": true, "update": true, "delete": true},
+		},
+	}
+	user := map[string]interface{}{"_id": "userid"}
+
+	Convey("Should replace the creator and owner placeholders", t, func() {
+
+		object := map[string]interface{}{"title": "Title", "_owner": "ownerid"}
+		ApplyDefaultAcl("posts", object, user)
+
+		acl := object["_acl"].(map[string]interface{})
+		So(acl["user:userid"], ShouldResemble, map[string]bool{"get": true, "update": true, "delete": true})
+		So(acl["user:ownerid"], ShouldResemble, map[string]bool{"get": true, "update": true})
+		So(acl["*"], ShouldResemble, map[string]bool{"get": true})
+		So(acl, ShouldNotContainKey, "creator")
+		So(acl, ShouldNotContainKey, "owner")
+	})
+
+	Convey("Should skip the placeholders that cannot be resolved", t, func() {
+
+		object := map[string]interface{}{"title": "Title"}
+		ApplyDefaultAcl("posts", object, nil)
+
+		acl := object["_acl"].(map[string]interface{})
+		So(len(acl), ShouldEqual, 1)
+		So(acl, ShouldContainKey, "*")
+	})
+
+	Convey("Should use the template of '*' for the other classes", t, func() {
+
+		object := map[string]interface{}{"title": "Title"}
+		ApplyDefaultAcl("comments", object, user)
+
+		So(object["_acl"], ShouldContainKey, "role:admin")
+	})
+
+	Convey("Should not change the given acl", t, func() {
+
+		acl := map[string]interface{}{"user:someone": map[string]interface{}{"get": true}}
+		object := map[string]interface{}{"_acl": acl}
+		ApplyDefaultAcl("posts", object, user)
+
+		So(object["_acl"], ShouldResemble, acl)
+	})
+
+	config.SystemConfig = config.Config{}
+}
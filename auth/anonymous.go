@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"net/http"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+)
+
+const (
+	ProviderAnonymous = "anonymous"
+	minDeviceIdLength = 16
+)
+
+// users who haven't signed up yet. they login with the random id that their device generates, like
+// {"anonymous": {"id": "7f1c9a4e-2b3d-4c8e-9f0a-1b2c3d4e5f6a"}}. only the hash of the id is stored.
+type anonymousProvider struct{}
+
+func (anonymousProvider) Authenticate(credentials map[string]interface{}) (providerUserId string, profile map[string]interface{}, err *utils.Error) {
+
+	deviceId, _ := credentials["id"].(string)
+	if len(deviceId) < minDeviceIdLength {
+		err = &utils.Error{http.StatusBadRequest, "Anonymous data must contain a random device id of at least 16 characters."}
+		return
+	}
+
+	providerUserId = hashToken(deviceId)
+	profile = make(map[string]interface{})
+	return
+}
+
+// returns the user of the access token if it is an anonymous user
+var getAnonymousUser = func(requestWrapper messages.RequestWrapper) (anonymousUser map[string]interface{}, err *utils.Error) {
+
+	user, err := getUser(requestWrapper)
+	if err != nil || user == nil {
+		return
+	}
+	if isAnonymousUser(user) {
+		anonymousUser = user
+	}
+	return
+}
+
+// users that have only the device id as login method
+func isAnonymousUser(user map[string]interface{}) bool {
+
+	linkedProviders := getLinkedProviders(user)
+	return len(linkedProviders) == 1 && linkedProviders[0] == ProviderAnonymous && !hasPasswordLogin(user)
+}
+
+// converts the anonymous user to a full account with the given email, username or provider. the id of the user stays
+// the same so the objects of the user still belong to the user.
+var upgradeAnonymousUser = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter, anonymousUser map[string]interface{}, providerName string, provider Provider) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+
+	body := requestWrapper.Message.Body
+	_, hasUsername := body["username"]
+	_, hasEmail := body["email"]
+
+	if hasUsername || hasEmail {
+		response, err = prepareLocalAccount(requestWrapper, dbAdapter)
+		if err != nil {
+			return
+		}
+	} else {
+		err = authenticateWithProvider(requestWrapper, providerName, provider)
+		if err != nil {
+			return
+		}
+
+		existingAccount, _ := getAccountData(requestWrapper, dbAdapter)
+		if existingAccount != nil {
+			err = &utils.Error{http.StatusConflict, "Account of the provider belongs to another user."}
+			return
+		}
+	}
+
+	// the device id cannot be used for login after the upgrade
+	body[ProviderAnonymous] = nil
+
+	userId := anonymousUser["_id"].(string)
+	_, hookBody, err = adapters.Update(ClassUsers, userId, body)
+	if err != nil {
+		return
+	}
+
+	response = make(map[string]interface{})
+	for k, v := range anonymousUser {
+		response[k] = v
+	}
+	for k, v := range body {
+		response[k] = v
+	}
+	delete(response, ProviderAnonymous)
+	delete(response, "password")
+	response["isNewUser"] = false
+	return
+}
@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"net/http"
+)
+
+const testDeviceId = "7f1c9a4e-2b3d-4c8e-9f0a-1b2c3d4e5f6a"
+
+func TestAnonymousUsers(t *testing.T) {
+
+	originalGetAccountData := getAccountData
+	originalStartSession := startSession
+	originalGetAnonymousUser := getAnonymousUser
+	originalHashPassword := hashPassword
+	config.SystemConfig = config.Config{}
+
+	startSession = func(requestWrapper messages.RequestWrapper, userId string, userData map[string]interface{}) (accessToken, refreshToken string, err *utils.Error) {
+		return "accesstoken", "refreshtoken", nil
+	}
+	hashPassword = func(password string) (hash string, err *utils.Error) {
+		return "hashedpassword", nil
+	}
+
+	anonymousUser := map[string]interface{}{"_id": "anonymoususerid", "anonymous": map[string]interface{}{"id": hashToken(testDeviceId)}}
+
+	Convey("Should create anonymous user with the hash of the device id", t, func() {
+
+		getAnonymousUser = originalGetAnonymousUser
+		getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
+			err = &utils.Error{http.StatusNotFound, "Account not found."}
+			return
+		}
+
+		var createdUser map[string]interface{}
+		adapters.Create = func(collection string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			createdUser = data
+			response = map[string]interface{}{"_id": "anonymoususerid"}
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"anonymous": map[string]interface{}{"id": testDeviceId}}
+
+		response, _, err := HandleSignUp(requestWrapper, &adapters.MongoAdapter{})
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusCreated)
+		So(response.Body["accessToken"], ShouldEqual, "accesstoken")
+		So(createdUser["anonymous"], ShouldResemble, map[string]interface{}{"id": hashToken(testDeviceId)})
+		So(isAnonymousUser(createdUser), ShouldBeTrue)
+
+		requestWrapper.Message.Body = map[string]interface{}{"anonymous": map[string]interface{}{"id": "short"}}
+		_, _, err = HandleSignUp(requestWrapper, &adapters.MongoAdapter{})
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+	})
+
+	Convey("Should upgrade the anonymous user with email and password", t, func() {
+
+		getAnonymousUser = func(requestWrapper messages.RequestWrapper) (user map[string]interface{}, err *utils.Error) {
+			return anonymousUser, nil
+		}
+
+		var createCalled bool
+		adapters.Create = func(collection string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			createCalled = true
+			return
+		}
+
+		var updatedId string
+		var updatedData map[string]interface{}
+		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			updatedId = id
+			updatedData = data
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"email": "johny@bravo.com", "password": "Correct-Horse-7"}
+
+		response, _, err := HandleSignUp(requestWrapper, &adapters.MongoAdapter{})
+		So(err, ShouldBeNil)
+		So(createCalled, ShouldBeFalse)
+		So(updatedId, ShouldEqual, "anonymoususerid")
+		So(updatedData["password"], ShouldEqual, "hashedpassword")
+		So(updatedData, ShouldContainKey, "anonymous")
+		So(updatedData["anonymous"], ShouldBeNil)
+		So(response.Body["_id"], ShouldEqual, "anonymoususerid")
+		So(response.Body["email"], ShouldEqual, "johny@bravo.com")
+		So(response.Body, ShouldNotContainKey, "password")
+		So(response.Body["accessToken"], ShouldEqual, "accesstoken")
+	})
+
+	Convey("Should not upgrade with an email or a provider account of another user", t, func() {
+
+		getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
+			accountData = map[string]interface{}{"_id": "otheruserid"}
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"email": "johny@bravo.com", "password": "Correct-Horse-7"}
+		_, _, err := HandleSignUp(requestWrapper, &adapters.MongoAdapter{})
+		So(err.Code, ShouldEqual, http.StatusConflict)
+
+		RegisterProvider("myprovider", testProvider{})
+		requestWrapper.Message.Body = map[string]interface{}{"myprovider": map[string]interface{}{"token": "validtoken"}}
+		_, _, err = HandleSignUp(requestWrapper, &adapters.MongoAdapter{})
+		So(err.Code, ShouldEqual, http.StatusConflict)
+
+		providersLock.Lock()
+		delete(providers, "myprovider")
+		providersLock.Unlock()
+	})
+
+	Convey("Should not save unverified providers or read-only fields on sign up", t, func() {
+
+		getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
+			err = &utils.Error{http.StatusNotFound, "Account not found."}
+			return
+		}
+		var updateCalled bool
+		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			updateCalled = true
+			return
+		}
+		var createdUser map[string]interface{}
+		adapters.Create = func(collection string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			createdUser = data
+			response = map[string]interface{}{"_id": "userid"}
+			return
+		}
+
+		// upgrading the anonymous user
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{
+			"email": "johny@bravo.com",
+			"password": "Correct-Horse-7",
+			"facebook": map[string]interface{}{"id": "victimid"},
+		}
+		_, _, err := HandleSignUp(requestWrapper, &adapters.MongoAdapter{})
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+		So(updateCalled, ShouldBeFalse)
+
+		// creating a local account
+		getAnonymousUser = func(requestWrapper messages.RequestWrapper) (user map[string]interface{}, err *utils.Error) {
+			return
+		}
+		requestWrapper.Message.Body = map[string]interface{}{
+			"username": "johnybravo",
+			"password": "Correct-Horse-7",
+			"facebook": map[string]interface{}{"id": "victimid"},
+		}
+		_, _, err = HandleSignUp(requestWrapper, &adapters.MongoAdapter{})
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+		So(createdUser, ShouldBeNil)
+
+		requestWrapper.Message.Body = map[string]interface{}{
+			"username": "johnybravo",
+			"password": "Correct-Horse-7",
+			"emailVerified": true,
+			"twoFactorEnabled": true,
+			"disabled": false,
+			"mustChangePassword": false,
+		}
+		_, _, err = HandleSignUp(requestWrapper, &adapters.MongoAdapter{})
+		So(err, ShouldBeNil)
+		So(createdUser["password"], ShouldEqual, "hashedpassword")
+		So(createdUser, ShouldNotContainKey, "emailVerified")
+		So(createdUser, ShouldNotContainKey, "twoFactorEnabled")
+		So(createdUser, ShouldNotContainKey, "disabled")
+		So(createdUser, ShouldNotContainKey, "mustChangePassword")
+	})
+
+	Convey("Should not change the password of the anonymous user", t, func() {
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"password": "", "newPassword": "Correct-Horse-7"}
+
+		_, err := HandleChangePassword(requestWrapper, &adapters.MongoAdapter{}, anonymousUser)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+
+		requestWrapper.Message.Body = map[string]interface{}{"password": 1234, "newPassword": "Correct-Horse-7"}
+		_, err = HandleChangePassword(requestWrapper, &adapters.MongoAdapter{}, anonymousUser)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+
+		requestWrapper.Message.Body = map[string]interface{}{"email": "johny@bravo.com", "password": 1234}
+		_, err = HandleLogin(requestWrapper, &adapters.MongoAdapter{})
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+	})
+
+	Convey("Should only treat users without other login methods as anonymous", t, func() {
+
+		So(isAnonymousUser(anonymousUser), ShouldBeTrue)
+		So(isAnonymousUser(map[string]interface{}{"_id": "userid", "password": "hashedpassword"}), ShouldBeFalse)
+		So(isAnonymousUser(map[string]interface{}{
+			"anonymous": map[string]interface{}{"id": "someid"},
+			"facebook": map[string]interface{}{"id": "facebookuserid"},
+		}), ShouldBeFalse)
+	})
+
+	getAccountData = originalGetAccountData
+	startSession = originalStartSession
+	getAnonymousUser = originalGetAnonymousUser
+	hashPassword = originalHashPassword
+}
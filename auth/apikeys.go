@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"strings"
+	"net/http"
+	"crypto/subtle"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"github.com/eluleci/dock/messages"
+)
+
+const (
+	HeaderApiKey = "X-Api-Key"
+	ApiKeyScopeMaster = "master"
+	ApiKeyScopeReadOnly = "readonly"
+	ApiKeyScopeClasses = "classes"
+)
+
+// a server key from the configuration. the key itself is not kept so that it is never logged.
+type ApiKey struct {
+	Name    string
+	Scope   string
+	Classes []string
+}
+
+// master key bypasses the acl and the field rules
+func (k *ApiKey) IsMaster() bool {
+	return k != nil && k.Scope == ApiKeyScopeMaster
+}
+
+// returns the api key in the header of the request. api key is nil if the request doesn't have one.
+var GetApiKey = func(requestWrapper messages.RequestWrapper) (apiKey *ApiKey, err *utils.Error) {
+
+	headers := requestWrapper.Message.Headers[HeaderApiKey]
+	if len(headers) == 0 || headers[0] == "" {
+		return
+	}
+
+	// all keys are compared so that the time doesn't reveal which key is close to the given one
+	var matchingKey *config.ApiKeyConfig
+	for i, keyConfig := range config.SystemConfig.ApiKeys {
+		if keyConfig.Key != "" && subtle.ConstantTimeCompare([]byte(keyConfig.Key), []byte(headers[0])) == 1 {
+			matchingKey = &config.SystemConfig.ApiKeys[i]
+		}
+	}
+	if matchingKey == nil {
+		err = &utils.Error{http.StatusUnauthorized, "API key is not valid."}
+		return
+	}
+
+	switch matchingKey.Scope {
+	case ApiKeyScopeMaster, ApiKeyScopeReadOnly, ApiKeyScopeClasses:
+	default:
+		err = &utils.Error{http.StatusInternalServerError, "API key has an unknown scope."}
+		return
+	}
+
+	apiKey = &ApiKey{Name: matchingKey.Name, Scope: matchingKey.Scope, Classes: matchingKey.Classes}
+	return
+}
+
+// api keys are not restricted by the acl. read-only keys can only read, and class keys can only access their classes.
+// the resources of the current user are not available to api keys since there is no user.
+var IsGrantedToApiKey = func(apiKey *ApiKey, collection string, requestWrapper messages.RequestWrapper) (isGranted bool) {
+
+	res := requestWrapper.Res
+	if isSessionsResource(res) || isTwoFactorResource(res) || isProvidersResource(res) || strings.EqualFold(res, ResourceMyExport) {
+		return
+	}
+
+	// accounts of the users are managed only with the master key
+	if IsUserActionResource(res) {
+		isGranted = apiKey.IsMaster()
+		return
+	}
+
+	switch apiKey.Scope {
+	case ApiKeyScopeMaster:
+		isGranted = true
+	case ApiKeyScopeReadOnly:
+		isGranted = strings.EqualFold(requestWrapper.Message.Command, "get")
+	case ApiKeyScopeClasses:
+		for _, className := range apiKey.Classes {
+			if className == collection {
+				isGranted = true
+			}
+		}
+	}
+	return
+}
+
+// records the request of the api key to the audit logs
+var RecordApiKeyRequest = func(apiKey *ApiKey, requestWrapper messages.RequestWrapper, status int) {
+
+	// responses without status are sent with 200
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	WriteAuditLog(map[string]interface{}{
+		"action": "request",
+		"apiKey": apiKey.Name,
+		"scope": apiKey.Scope,
+		"command": strings.ToLower(requestWrapper.Message.Command),
+		"res": requestWrapper.Message.Res,
+		"status": status,
+		"ip": requestWrapper.Message.RemoteAddr,
+	})
+}
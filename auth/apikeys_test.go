@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"net/http"
+)
+
+func makeApiKeyRequest(key, command, res string) (requestWrapper messages.RequestWrapper) {
+
+	requestWrapper.Res = res
+	requestWrapper.Message.Res = res
+	requestWrapper.Message.Command = command
+	requestWrapper.Message.Headers = map[string][]string{HeaderApiKey: {key}}
+	return
+}
+
+func TestApiKeys(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+	config.SystemConfig.ApiKeys = []config.ApiKeyConfig{
+		{Name: "backend", Key: "masterkey", Scope: ApiKeyScopeMaster},
+		{Name: "reports", Key: "readonlykey", Scope: ApiKeyScopeReadOnly},
+		{Name: "blog", Key: "classkey", Scope: ApiKeyScopeClasses, Classes: []string{"posts"}},
+		{Name: "broken", Key: "brokenkey", Scope: "everything"},
+	}
+
+	Convey("Should return the key in the header", t, func() {
+
+		apiKey, err := GetApiKey(messages.RequestWrapper{})
+		So(err, ShouldBeNil)
+		So(apiKey, ShouldBeNil)
+
+		apiKey, err = GetApiKey(makeApiKeyRequest("masterkey", "get", "/posts"))
+		So(err, ShouldBeNil)
+		So(apiKey.Name, ShouldEqual, "backend")
+		So(apiKey.IsMaster(), ShouldBeTrue)
+
+		_, err = GetApiKey(makeApiKeyRequest("unknownkey", "get", "/posts"))
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+
+		_, err = GetApiKey(makeApiKeyRequest("brokenkey", "get", "/posts"))
+		So(err.Code, ShouldEqual, http.StatusInternalServerError)
+
+		var noKey *ApiKey
+		So(noKey.IsMaster(), ShouldBeFalse)
+	})
+
+	Convey("Should grant the requests in the scope of the key", t, func() {
+
+		isGranted := func(key, command, res, collection string) bool {
+			requestWrapper := makeApiKeyRequest(key, command, res)
+			apiKey, _ := GetApiKey(requestWrapper)
+			return IsGrantedToApiKey(apiKey, collection, requestWrapper)
+		}
+
+		So(isGranted("masterkey", "delete", "/users/userid", "users"), ShouldBeTrue)
+		So(isGranted("masterkey", "get", ResourceMySessions, "sessions"), ShouldBeFalse)
+
+		So(isGranted("readonlykey", "get", "/users", "users"), ShouldBeTrue)
+		So(isGranted("readonlykey", "post", "/posts", "posts"), ShouldBeFalse)
+
+		So(isGranted("classkey", "post", "/posts", "posts"), ShouldBeTrue)
+		So(isGranted("classkey", "get", "/users", "users"), ShouldBeFalse)
+	})
+
+	Convey("Should write the requests of the keys to the audit logs", t, func() {
+
+		var createdClass string
+		var createdEntry map[string]interface{}
+		adapters.Create = func(collection string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			createdClass = collection
+			createdEntry = data
+			return
+		}
+
+		requestWrapper := makeApiKeyRequest("masterkey", "PUT", "/users/userid")
+		requestWrapper.Message.RemoteAddr = "10.0.0.1"
+		RecordApiKeyRequest(&ApiKey{Name: "backend", Scope: ApiKeyScopeMaster}, requestWrapper, 0)
+
+		So(createdClass, ShouldEqual, ClassAuditLogs)
+		So(createdEntry["apiKey"], ShouldEqual, "backend")
+		So(createdEntry["command"], ShouldEqual, "put")
+		So(createdEntry["res"], ShouldEqual, "/users/userid")
+		So(createdEntry["status"], ShouldEqual, http.StatusOK)
+		So(createdEntry["_acl"], ShouldResemble, map[string]interface{}{})
+		So(createdEntry, ShouldNotContainKey, "key")
+	})
+
+	config.SystemConfig = config.Config{}
+}
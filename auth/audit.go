@@ -0,0 +1,17 @@
+package auth
+
+import (
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/adapters"
+)
+
+const ClassAuditLogs = "auditlogs"
+
+// saves the entry to the audit logs. the logs can only be read with the master key.
+var WriteAuditLog = func(entry map[string]interface{}) {
+
+	entry["_acl"] = map[string]interface{}{}
+	if _, _, err := adapters.Create(ClassAuditLogs, entry); err != nil {
+		utils.Log("error", "Writing audit log failed: " + err.Message)
+	}
+}
@@ -1,13 +1,9 @@
 package auth
 
 import (
-	"fmt"
 	"time"
 	"strings"
 	"net/http"
-	"net/smtp"
-	"io/ioutil"
-	"math/rand"
 	"encoding/json"
 	"github.com/eluleci/dock/messages"
 	"golang.org/x/crypto/bcrypt"
@@ -25,23 +21,28 @@ const (
 	ActorTypeFunctions = "functions"
 	ClassUsers = "users"
 	ClassFiles = "files"
+	ClassRoles = "roles"
+	ClassSessions = "sessions"
+	ClassPasswordResets = "passwordresets"
+	ClassTwoFactor = "twofactor"
 	ResourceTypeUsers = "/users"
 	ResourceTypeFiles = "/files"
+	ResourceTypeRoles = "/roles"
 	ResourceRegister = "/register"
 	ResourceLogin = "/login"
+	ResourceLoginTwoFactor = "/login/2fa"
 	ResourceResetPassword = "/resetpassword"
+	ResourceResetPasswordConfirm = "/resetpassword/confirm"
 	ResourceChangePassword = "/changepassword"
+	ResourceRefresh = "/refresh"
+	ResourceLogout = "/logout"
+	ResourceMySessions = "/users/me/sessions"
+	ResourceMyTwoFactor = "/users/me/2fa"
+	ResourceMyProviders = "/users/me/providers"
+	ResourceMyExport = "/users/me/export"
+	ResourceVerifyEmail = "/verifyemail"
 )
 
-// used for password generation
-var fruits = []string{"apples", "appricots", "avocados", "bananas", "cherries", "coconuts", "cranberries", "damsons",
-	"dates", "durian", "grapes", "guavas", "jambuls", "jujubes", "kiwis", "lemons", "limes", "mangos", "melons",
-	"olives", "oranes", "mandarines", "papayas", "peaches", "pears", "plums", "pineapples", "pumpkins", "pomelos",
-	"raspberries", "satsumas", "strawberries", "tomatoes"}
-
-// used for password generation
-var quantities = []string{"two", "three", "four", "five", "six", "seven", "eight", "nine", "ten"}
-
 var commandPermissionMap = map[string]map[string]bool{
 	"get": {
 		"get": true,
@@ -58,9 +59,6 @@ var commandPermissionMap = map[string]map[string]bool{
 	},
 };
 
-var facebookTokenVerificationEndpoint = "https://graph.facebook.com/debug_token"
-var googleTokenVerificationEndpoint = "https://www.googleapis.com/oauth2/v3/tokeninfo?id_token="
-
 var defaultPermissions = map[string]bool{
 	"create": true,
 	"query": true,
@@ -70,217 +68,168 @@ var defaultPermissions = map[string]bool{
 
 }
 
-var httpClient = http.DefaultClient
-
-var HandleSignUp = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (response messages.Message, hookBody map[string]interface{}, err *utils.Error) {
+// requests to the identity providers time out, so that a provider that doesn't respond doesn't block the logins
+const providerRequestTimeout = 10 * time.Second
 
-	_, hasUsername := requestWrapper.Message.Body["username"]
-	_, hasEmail := requestWrapper.Message.Body["email"]
-	_, hasFacebook := requestWrapper.Message.Body["facebook"]
-	_, hasGoogle := requestWrapper.Message.Body["google"]
+var httpClient = &http.Client{Timeout: providerRequestTimeout}
 
-	if hasUsername || hasEmail {
-		response.Body, hookBody, err = createLocalAccount(requestWrapper, dbAdapter)
-	} else if hasFacebook {
-		response.Body, hookBody, err = handleFacebookAuth(requestWrapper, dbAdapter, httpClient)
-	}  else if hasGoogle {
-		response.Body, hookBody, err = handleGoogleAuth(requestWrapper, dbAdapter, httpClient)
-	} else {
-		err = &utils.Error{http.StatusBadRequest, "No suitable registration data found."}
-		return
-	}
+var HandleSignUp = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (response messages.Message, hookBody map[string]interface{}, err *utils.Error) {
 
-	if err != nil {
+	if _, hasRoles := requestWrapper.Message.Body["_roles"]; hasRoles {
+		err = &utils.Error{http.StatusForbidden, "Roles of users can only be changed through /roles."}
 		return
 	}
 
-	accessToken, tokenErr := generateToken(response.Body["_id"].(string), response.Body)
-	if tokenErr == nil {
-		response.Body["accessToken"] = accessToken
-		response.Status = http.StatusCreated
-	} else {
-		response.Status = http.StatusInternalServerError
-	}
-	return
-}
-
-var createLocalAccount = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
-
 	_, hasUsername := requestWrapper.Message.Body["username"]
 	_, hasEmail := requestWrapper.Message.Body["email"]
-	password, hasPassword := requestWrapper.Message.Body["password"]
+	providerName, provider, hasProvider := getProvider(requestWrapper.Message.Body)
 
-	if !(hasEmail || hasUsername) || !hasPassword {
-		err = &utils.Error{http.StatusBadRequest, "Username or email, and password must be provided."}
-		return
+	// local accounts don't verify any provider
+	verifiedProvider := providerName
+	if hasUsername || hasEmail {
+		verifiedProvider = ""
 	}
-
-	existingAccount, _ := getAccountData(requestWrapper, dbAdapter)
-	if existingAccount != nil {
-		err = &utils.Error{http.StatusConflict, "User with same email-username already exists."}
+	err = checkSignUpFields(requestWrapper.Message.Body, verifiedProvider)
+	if err != nil {
 		return
 	}
 
-	hashedPassword, hashErr := bcrypt.GenerateFromPassword([]byte(password.(string)), bcrypt.DefaultCost)
-	if hashErr != nil {
-		err = &utils.Error{http.StatusInternalServerError, "Hashing password failed."}
+	var anonymousUser map[string]interface{}
+	anonymousUser, err = getAnonymousUser(requestWrapper)
+	if err != nil {
 		return
 	}
-	requestWrapper.Message.Body["password"] = string(hashedPassword)
 
-	response, hookBody, err = adapters.Create(ClassUsers, requestWrapper.Message.Body)
-	return
-}
-
-var handleFacebookAuth = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter, HTTPClient *http.Client) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
-
-	facebookData, _ := requestWrapper.Message.Body["facebook"]
-	facebookDataAsMap := facebookData.(map[string]interface{})
-
-	userId, hasId := facebookDataAsMap["id"]
-	accessToken, hasAccessToken := facebookDataAsMap["accessToken"]
-
-	if !hasId || !hasAccessToken {
-		err = &utils.Error{http.StatusBadRequest, "Facebook data must contain id and access token."}
+	if anonymousUser != nil && (hasUsername || hasEmail || (hasProvider && providerName != ProviderAnonymous)) {
+		response.Body, hookBody, err = upgradeAnonymousUser(requestWrapper, dbAdapter, anonymousUser, providerName, provider)
+	} else if hasUsername || hasEmail {
+		response.Body, hookBody, err = createLocalAccount(requestWrapper, dbAdapter)
+	} else if hasProvider {
+		response.Body, hookBody, err = handleProviderAuth(requestWrapper, dbAdapter, providerName, provider)
+	} else {
+		err = &utils.Error{http.StatusBadRequest, "No suitable registration data found."}
 		return
 	}
 
-	appFacebookAccessToken := config.SystemConfig.Facebook["appToken"]
-	if appFacebookAccessToken == "" {
-		err = &utils.Error{http.StatusInternalServerError, "Facebook information is not provided in server configuration."}
+	if err != nil {
 		return
 	}
 
-	urlBuilder := []string{facebookTokenVerificationEndpoint, "?access_token=", appFacebookAccessToken, "&input_token=", accessToken.(string)}
-	verificationUrl := strings.Join(urlBuilder, "");
-
-	tokenResponse, verificationErr := HTTPClient.Get(verificationUrl)
-	if verificationErr != nil || tokenResponse.StatusCode != 200 {
-		err = &utils.Error{http.StatusInternalServerError, "Verifying token failed."}
-		return
-	}
+	verificationConfig := config.SystemConfig.EmailVerification
+	if hasEmail && verificationConfig.Enabled {
+		email, _ := requestWrapper.Message.Body["email"].(string)
+		if sendErr := SendVerificationEmail(response.Body["_id"].(string), email); sendErr != nil {
+			utils.Log("error", "Sending verification email failed: " + sendErr.Message)
+		}
 
-	var responseBody interface{}
-	data, readErr := ioutil.ReadAll(tokenResponse.Body)
-	if readErr != nil {
-		err = &utils.Error{http.StatusInternalServerError, "Reading token response failed."}
-		return
+		// users who cannot login yet don't get a session
+		if verificationConfig.BlockLogin {
+			response.Status = http.StatusCreated
+			return
+		}
 	}
 
-	parseErr := json.Unmarshal(data, &responseBody)
-	if parseErr != nil {
-		err = &utils.Error{http.StatusInternalServerError, "Parsing token response failed."}
+	// existing users who sign in with a provider pass the second step too
+	if isTwoFactorEnabled(response.Body) {
+		response.Body, err = startTwoFactorChallenge(response.Body["_id"].(string))
+		if err == nil {
+			response.Status = http.StatusOK
+		}
 		return
 	}
-	responseBodyAsMap := responseBody.(map[string]interface{})
 
-	tokenInfo, hasTokenInfo := responseBodyAsMap["data"]
-	if !hasTokenInfo {
-		err = &utils.Error{http.StatusInternalServerError, "Unexpected token response from platform."}
-		return
+	accessToken, refreshToken, tokenErr := startSession(requestWrapper, response.Body["_id"].(string), response.Body)
+	if tokenErr == nil {
+		response.Body["accessToken"] = accessToken
+		response.Body["refreshToken"] = refreshToken
+		response.Status = http.StatusCreated
+	} else {
+		response.Status = http.StatusInternalServerError
 	}
+	return
+}
 
-	tokenInfoAsMap := tokenInfo.(map[string]interface{})
+var createLocalAccount = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
 
-	tokensAppId, hasAppId := tokenInfoAsMap["app_id"]
-	tokensUserId, hasUserId := tokenInfoAsMap["user_id"]
-	isValid, hasIsValid := tokenInfoAsMap["is_valid"]
-	if !hasAppId || !hasUserId || !hasIsValid {
-		err = &utils.Error{http.StatusInternalServerError, "Unexpected response from Facebook while validating."}
+	response, err = prepareLocalAccount(requestWrapper, dbAdapter)
+	if err != nil {
 		return
 	}
 
-	if !strings.EqualFold(tokensAppId.(string), config.SystemConfig.Facebook["appId"]) {
-		err = &utils.Error{http.StatusInternalServerError, "App id doesn't match to the token's app id."}
-		return
-	}
+	response, hookBody, err = createUser(requestWrapper.Message.Body)
+	return
+}
 
-	if !strings.EqualFold(tokensUserId.(string), userId.(string)) {
-		err = &utils.Error{http.StatusBadRequest, "User id doesn't match to the token's user id."}
-		return
-	}
+// creates the user with the default acl of the users. users are the creators of themselves, so the acl is given after
+// the id of the user is known.
+var createUser = func(data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
 
-	if !isValid.(bool) {
-		err = &utils.Error{http.StatusBadRequest, "Token is not valid."}
+	response, hookBody, err = adapters.Create(ClassUsers, data)
+	if err != nil {
 		return
 	}
 
-	existingAccount, _ := getAccountData(requestWrapper, dbAdapter)
-
-	if existingAccount == nil {
-		response, hookBody, err = adapters.Create(ClassUsers,requestWrapper.Message.Body)
-		response["isNewUser"] = true
-	} else {
-		response = existingAccount
-		response["isNewUser"] = false
-		// TODO update existing token with the new token. (optionally check which expires later)
+	userId, _ := response["_id"].(string)
+	ApplyDefaultAcl(ClassUsers, data, map[string]interface{}{"_id": userId})
+	if acl, hasAcl := data["_acl"]; hasAcl {
+		_, _, err = adapters.Update(ClassUsers, userId, map[string]interface{}{"_acl": acl})
 	}
 	return
 }
 
-var handleGoogleAuth = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter, HTTPClient *http.Client) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
-
-	googleData, _ := requestWrapper.Message.Body["google"]
-	googleDataAsMap := googleData.(map[string]interface{})
+// removes the fields that users cannot set themselves, like 'emailVerified'. only the data of the provider that is
+// verified in the request can be saved, so that users cannot link the accounts of the others.
+func checkSignUpFields(body map[string]interface{}, verifiedProvider string) (err *utils.Error) {
 
-	_, hasId := googleDataAsMap["id"]
-	idToken, hasIdToken := googleDataAsMap["idToken"]
-
-	if !hasId || !hasIdToken {
-		err = &utils.Error{http.StatusBadRequest, "Google data must contain user id and id token."}
-		return
+	// only local accounts have passwords, which are hashed before they are saved
+	for _, field := range getFieldRules(ClassUsers).ReadOnly {
+		if field != "password" || verifiedProvider != "" {
+			delete(body, field)
+		}
 	}
 
-	googleClientId := config.SystemConfig.Google["clientId"]
-	if googleClientId == "" {
-		err = &utils.Error{http.StatusInternalServerError, "Google information is not provided in server configuration."}
-		return
+	// the acl of the users is given by the server, so the users cannot make themselves writable to others
+	delete(body, "_acl")
+
+	for field := range body {
+		if field != verifiedProvider && isProviderField(field) {
+			err = &utils.Error{http.StatusForbidden, "Field '" + field + "' can only be changed through /users/me/providers."}
+			return
+		}
 	}
+	return
+}
 
-	urlBuilder := []string{googleTokenVerificationEndpoint, idToken.(string)}
-	verificationUrl := strings.Join(urlBuilder, "");
+// checks the username, email and password of the new account and hashes the password in the body
+func prepareLocalAccount(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (response map[string]interface{}, err *utils.Error) {
 
-	tokenResponse, verificationErr := HTTPClient.Get(verificationUrl)
-	if verificationErr != nil || tokenResponse.StatusCode != 200 {
-		err = &utils.Error{http.StatusInternalServerError, "Verifying token failed. "}
-		return
-	}
+	_, hasUsername := requestWrapper.Message.Body["username"]
+	_, hasEmail := requestWrapper.Message.Body["email"]
+	password, hasPassword := requestWrapper.Message.Body["password"]
 
-	var responseBody interface{}
-	data, readErr := ioutil.ReadAll(tokenResponse.Body)
-	if readErr != nil {
-		err = &utils.Error{http.StatusInternalServerError, "Reading token response failed."}
+	passwordAsString, isString := password.(string)
+	if !(hasEmail || hasUsername) || !hasPassword || !isString {
+		err = &utils.Error{http.StatusBadRequest, "Username or email, and password must be provided."}
 		return
 	}
 
-	parseErr := json.Unmarshal(data, &responseBody)
-	if parseErr != nil {
-		err = &utils.Error{http.StatusInternalServerError, "Parsing token response failed."}
+	if reasons := checkPasswordPolicy(passwordAsString, requestWrapper.Message.Body); len(reasons) > 0 {
+		response, err = passwordPolicyError(reasons)
 		return
 	}
-	tokenInfoAsMap := responseBody.(map[string]interface{})
 
-	tokensClientId, hasClientId := tokenInfoAsMap["aud"]
-	if !hasClientId {
-		err = &utils.Error{http.StatusInternalServerError, "Unexpected token response from platform."}
+	existingAccount, _ := getAccountData(requestWrapper, dbAdapter)
+	if existingAccount != nil {
+		err = &utils.Error{http.StatusConflict, "User with same email-username already exists."}
 		return
 	}
 
-	if !strings.EqualFold(tokensClientId.(string), googleClientId) {
-		err = &utils.Error{http.StatusInternalServerError, "Client id doesn't match to the token's client id."}
+	var hashedPassword string
+	hashedPassword, err = hashPassword(passwordAsString)
+	if err != nil {
 		return
 	}
-
-	existingAccount, _ := getAccountData(requestWrapper, dbAdapter)
-
-	if existingAccount == nil {
-		response, hookBody, err = adapters.Create(ClassUsers, requestWrapper.Message.Body)
-		response["isNewUser"] = true
-	} else {
-		response = existingAccount
-		response["isNewUser"] = false
-		// TODO update existing token with the new token. (optionally check which expires later)
-	}
+	requestWrapper.Message.Body["password"] = hashedPassword
 	return
 }
 
@@ -288,35 +237,71 @@ var HandleLogin = func(requestWrapper messages.RequestWrapper, dbAdapter *adapte
 
 	_, hasEmail := requestWrapper.Message.Body["email"]
 	_, hasUsername := requestWrapper.Message.Body["username"]
-	password, hasPassword := requestWrapper.Message.Body["password"]
+	password, hasPassword := requestWrapper.Message.Body["password"].(string)
+
+	if providerName, provider, hasProvider := getProvider(requestWrapper.Message.Body); hasProvider && !(hasEmail || hasUsername) {
+		response, err = handleProviderLogin(requestWrapper, dbAdapter, providerName, provider)
+		return
+	}
 
 	if !(hasEmail || hasUsername) || !hasPassword {
 		err = &utils.Error{http.StatusBadRequest, "Login request must contain username or email, and password."}
 		return
 	}
 
+	// the attempts are counted whether the account exists or not
+	accountKeys := []string{getLoginAccountKey(requestWrapper.Message.Body)}
+	response, err = checkLockout(requestWrapper, accountKeys)
+	if err != nil {
+		return
+	}
+
 	accountData, getAccountErr := getAccountData(requestWrapper, dbAdapter)
 	if getAccountErr != nil {
 		err = getAccountErr
 		if getAccountErr.Code == http.StatusNotFound {
+			recordFailedAttempt(requestWrapper, accountKeys)
 			err = &utils.Error{http.StatusUnauthorized, "Credentials don't match or account doesn't exist."}
 		}
 		return
 	}
-	existingPassword := accountData["password"].(string)
+	// users who signed up with a provider may not have a password
+	existingPassword, _ := accountData["password"].(string)
 
-	passwordError := bcrypt.CompareHashAndPassword([]byte(existingPassword), []byte(password.(string)))
+	passwordError := bcrypt.CompareHashAndPassword([]byte(existingPassword), []byte(password))
 	if passwordError == nil {
+		clearFailedAttempts(accountKeys)
+		rehashPasswordIfNeeded(accountData["_id"].(string), existingPassword, password)
+		response, err = checkAccountStatus(accountData)
+		if err != nil {
+			return
+		}
+		if config.SystemConfig.EmailVerification.BlockLogin && isEmailUnverified(accountData) {
+			err = &utils.Error{http.StatusForbidden, "Email address is not verified."}
+			return
+		}
+
+		// the session is started after the second step
+		if isTwoFactorEnabled(accountData) {
+			response.Body, err = startTwoFactorChallenge(accountData["_id"].(string))
+			if err == nil {
+				response.Status = http.StatusOK
+			}
+			return
+		}
+
 		delete(accountData, "password")
 		response.Body = accountData
 
-		var accessToken string
-		accessToken, err = generateToken(accountData["_id"].(string), accountData)
+		var accessToken, refreshToken string
+		accessToken, refreshToken, err = startSession(requestWrapper, accountData["_id"].(string), accountData)
 		if err == nil {
 			response.Body["accessToken"] = accessToken
+			response.Body["refreshToken"] = refreshToken
 			response.Status = http.StatusOK
 		}
 	} else {
+		recordFailedAttempt(requestWrapper, accountKeys)
 		response.Status = http.StatusUnauthorized
 	}
 	return
@@ -331,117 +316,200 @@ var HandleChangePassword = func(requestWrapper messages.RequestWrapper, dbAdapte
 		return
 	}
 
-	password, hasPassword := requestWrapper.Message.Body["password"]
+	password, hasPassword := requestWrapper.Message.Body["password"].(string)
 	if !hasPassword {
 		err = &utils.Error{http.StatusBadRequest, "Password must be provided in the body with field 'password'."}
 		return
 	}
 
-	newPassword, hasNewPassword := requestWrapper.Message.Body["newPassword"]
+	newPassword, hasNewPassword := requestWrapper.Message.Body["newPassword"].(string)
 	if !hasNewPassword {
 		err = &utils.Error{http.StatusBadRequest, "New password must be provided in the body with field 'newPassword'."}
 		return
 	}
 
-	existingPassword := userAsMap["password"].(string)
+	// users who signed up with a provider or anonymously set a password by signing up with email or username
+	existingPassword, _ := userAsMap["password"].(string)
+	if existingPassword == "" {
+		err = &utils.Error{http.StatusBadRequest, "User doesn't have a password."}
+		return
+	}
+
+	accountKeys := getAccountKeys(userAsMap)
+	response, err = checkLockout(requestWrapper, accountKeys)
+	if err != nil {
+		return
+	}
 
-	passwordError := bcrypt.CompareHashAndPassword([]byte(existingPassword), []byte(password.(string)))
+	passwordError := bcrypt.CompareHashAndPassword([]byte(existingPassword), []byte(password))
 	if passwordError != nil {
+		recordFailedAttempt(requestWrapper, accountKeys)
 		err = &utils.Error{http.StatusUnauthorized, "Existing password is not correct."}
 		return
 	}
+	clearFailedAttempts(accountKeys)
 
-	hashedPassword, hashErr := bcrypt.GenerateFromPassword([]byte(newPassword.(string)), bcrypt.DefaultCost)
-	if hashErr != nil {
-		err = &utils.Error{http.StatusInternalServerError, "Hashing new password failed."}
+	if reasons := checkPasswordPolicy(newPassword, userAsMap); len(reasons) > 0 {
+		response.Body, err = passwordPolicyError(reasons)
 		return
 	}
 
-	body := map[string]interface{}{"password": string(hashedPassword)}
-	response.Body, _, err = adapters.Update(ClassUsers, userAsMap["_id"].(string), body)
+	var hashedPassword string
+	hashedPassword, err = hashPassword(newPassword)
 	if err != nil {
 		return
 	}
 
-	return
-}
+	userId := userAsMap["_id"].(string)
+	body := map[string]interface{}{"password": hashedPassword}
+	if userAsMap["mustChangePassword"] == true {
+		body["mustChangePassword"] = false
+	}
+	response.Body, _, err = adapters.Update(ClassUsers, userId, body)
+	if err != nil {
+		return
+	}
 
-var HandleResetPassword = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (response messages.Message, err *utils.Error) {
+	// all the other sessions are signed out. a new session is returned for the current client
+	err = revokeSessions(userId)
+	if err != nil {
+		return
+	}
 
-	resetPasswordConfig := config.SystemConfig.ResetPassword
-	if resetPasswordConfig == nil {
-		err = &utils.Error{http.StatusInternalServerError, "Email reset configuration is not set in configuration file."}
+	var accessToken, refreshToken string
+	accessToken, refreshToken, err = startSession(requestWrapper, userId, userAsMap)
+	if err != nil {
+		return
 	}
+	if response.Body == nil {
+		response.Body = make(map[string]interface{})
+	}
+	response.Body["accessToken"] = accessToken
+	response.Body["refreshToken"] = refreshToken
+	return
+}
 
-	senderEmail, hasSenderEmail := config.SystemConfig.ResetPassword["senderEmail"]
-	senderEmailPassword, hasSenderEmailPassword := config.SystemConfig.ResetPassword["senderEmailPassword"]
-	smtpServer, hasSmtpServer := config.SystemConfig.ResetPassword["smtpServer"]
-	smtpPort, hasSmtpPort := config.SystemConfig.ResetPassword["smtpPort"]
-	mailSubject, hasMailSubject := config.SystemConfig.ResetPassword["mailSubject"]
-	mailContentTemplate, hasMailContent := config.SystemConfig.ResetPassword["mailContentTemplate"]
+var HandleResetPassword = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (response messages.Message, err *utils.Error) {
 
-	if !hasSmtpServer || !hasSmtpPort || !hasSenderEmail || !hasSenderEmailPassword || !hasMailSubject || !hasMailContent {
-		err = &utils.Error{http.StatusInternalServerError, "Email reset configuration is not correct."}
+	_, err = getResetPasswordConfig()
+	if err != nil {
 		return
 	}
 
-	recipientEmail, hasRecipientEmail := requestWrapper.Message.Body["email"]
-	if !hasRecipientEmail {
+	email, isString := requestWrapper.Message.Body["email"].(string)
+	if !isString || email == "" {
 		err = &utils.Error{http.StatusBadRequest, "Email must be provided in the body."}
 		return
 	}
 
-	accountData, err := getAccountData(requestWrapper, dbAdapter)
+	// locked accounts can still request links since resetting the password unlocks them. locked addresses cannot.
+	response, err = checkLockout(requestWrapper, nil)
 	if err != nil {
 		return
 	}
 
-	// generating random password like: "twoapplesandfiveoranges" or "threekiwisandsevenbananas"
-	passwordFirstHalf := quantities[rand.Intn(len(quantities))] + fruits[rand.Intn(len(fruits))]
-	passwordSecondHalf := quantities[rand.Intn(len(quantities))] + fruits[rand.Intn(len(fruits))]
-	generatedPassword := passwordFirstHalf + "and" + passwordSecondHalf
-	hashedPassword, hashErr := bcrypt.GenerateFromPassword([]byte(generatedPassword), bcrypt.DefaultCost)
-	if hashErr != nil {
-		err = &utils.Error{http.StatusInternalServerError, "Hashing new password failed."}
+	// both limits are applied whether the account exists or not
+	emailKey := strings.ToLower(email)
+	isEmailAllowed := resetPasswordEmailLimiter.allow(emailKey)
+	isAddressAllowed := resetPasswordAddressLimiter.allow(requestWrapper.Message.RemoteAddr)
+	if !isEmailAllowed || !isAddressAllowed {
+		retryAfter := resetPasswordEmailLimiter.retryAfter(emailKey)
+		if addressRetryAfter := resetPasswordAddressLimiter.retryAfter(requestWrapper.Message.RemoteAddr); addressRetryAfter > retryAfter {
+			retryAfter = addressRetryAfter
+		}
+		response, err = tooManyRequests(retryAfter, "Too many reset password requests. Try again later.")
 		return
 	}
 
-	body := map[string]interface{}{"password": string(hashedPassword)}
-	response.Body, _, err = adapters.Update(ClassUsers, accountData["_id"].(string), body)
-	if err != nil {
+	if requestWrapper.Message.Parameters == nil {
+		requestWrapper.Message.Parameters = make(map[string][]string)
+	}
+	requestWrapper.Message.Body = map[string]interface{}{"email": email}
+
+	accountData, getAccountErr := getAccountData(requestWrapper, dbAdapter)
+	if getAccountErr != nil && getAccountErr.Code != http.StatusNotFound {
+		err = getAccountErr
 		return
 	}
 
-	err = sendNewPasswordEmail(smtpServer, smtpPort, senderEmail, senderEmailPassword, mailSubject, mailContentTemplate, recipientEmail.(string), generatedPassword)
+	// the link is sent in background so the response doesn't tell whether the account exists
+	if getAccountErr == nil {
+		go func() {
+			if sendErr := sendResetPasswordLink(accountData["_id"].(string), email); sendErr != nil {
+				utils.Log("error", "Sending reset password link failed: " + sendErr.Message)
+			}
+		}()
+	}
+
+	response.Body = map[string]interface{}{"message": "If there is an account with this email, a reset password link is sent to it."}
+	response.Status = http.StatusOK
 	return
 }
 
-var sendNewPasswordEmail = func(smtpServer, smtpPost, senderEmail, senderEmailPassword, subject, contentTemplate, recipientEmail, newPassword string) (err *utils.Error) {
+// sets the new password with the token in the reset password link
+var HandleResetPasswordConfirm = func(requestWrapper messages.RequestWrapper) (response messages.Message, err *utils.Error) {
+
+	token, hasToken := requestWrapper.Message.Body["token"].(string)
+	newPassword, hasNewPassword := requestWrapper.Message.Body["newPassword"].(string)
+	if !hasToken || token == "" || !hasNewPassword || newPassword == "" {
+		err = &utils.Error{http.StatusBadRequest, "Token and new password must be provided with fields 'token' and 'newPassword'."}
+		return
+	}
+
+	// the rules that don't need the user are checked before the token is used
+	if reasons := checkPasswordPolicy(newPassword, nil); len(reasons) > 0 {
+		response.Body, err = passwordPolicyError(reasons)
+		return
+	}
+
+	var passwordReset map[string]interface{}
+	passwordReset, err = usePasswordResetToken(token)
+	if err != nil {
+		return
+	}
+
+	userId := passwordReset["userId"].(string)
+	user, getErr := adapters.Get(ClassUsers, userId)
+	if getErr != nil {
+		err = &utils.Error{http.StatusBadRequest, "Token is not valid or expired."}
+		return
+	}
+
+	if reasons := checkPasswordPolicy(newPassword, user); len(reasons) > 0 {
+		response.Body, err = passwordPolicyError(reasons)
+		return
+	}
 
-	auth := smtp.PlainAuth("", senderEmail, senderEmailPassword, smtpServer)
+	var hashedPassword string
+	hashedPassword, err = hashPassword(newPassword)
+	if err != nil {
+		return
+	}
 
-	generatedContent := fmt.Sprintf(contentTemplate, newPassword)
-	to := []string{recipientEmail}
-	msg := []byte(
-	"From: " + senderEmail + "\r\n" +
-	"To: " + recipientEmail + "\r\n" +
-	"Subject: " + subject + "\r\n" +
-	"MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n" +
-	"\r\n" + generatedContent + "\r\n")
-	sendMailErr := smtp.SendMail(smtpServer + ":" + smtpPost, auth, senderEmail, to, msg)
+	body := map[string]interface{}{"password": hashedPassword}
+	if user["mustChangePassword"] == true {
+		body["mustChangePassword"] = false
+	}
+	response.Body, _, err = adapters.Update(ClassUsers, userId, body)
+	if err != nil {
+		return
+	}
 
-	if sendMailErr != nil {
-		fmt.Println(sendMailErr)
-		err = &utils.Error{http.StatusInternalServerError, "Sending email failed."}
+	err = revokeSessions(userId)
+	if err != nil {
+		return
 	}
+
+	// resetting the password unlocks the account
+	clearFailedAttempts(getAccountKeys(user))
+	response.Status = http.StatusOK
 	return
 }
 
-var IsGranted = func(collection string, requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (isGranted bool, user map[string]interface{}, err *utils.Error) {
+var IsGranted = func(collection string, requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (isGranted bool, user map[string]interface{}, roles []string, err *utils.Error) {
 
 	var permissions map[string]bool
 
-	var roles []string
 	user, err = getUser(requestWrapper)
 	if err != nil {
 		return
@@ -453,11 +521,39 @@ var IsGranted = func(collection string, requestWrapper messages.RequestWrapper,
 	}
 
 	res := requestWrapper.Res
-	if strings.EqualFold(res, ResourceLogin) || strings.EqualFold(res, ResourceRegister) || strings.Index(res, ResourceTypeFiles) == 0 {
+
+	// admins who impersonate users cannot change the credentials or the account of the users
+	if GetImpersonator(user) != "" && isForbiddenWhileImpersonating(requestWrapper, user) {
+		err = &utils.Error{http.StatusForbidden, "Request is not allowed while impersonating the user."}
+		return
+	}
+
+	// users who are forced to change their passwords cannot do anything else
+	if user["mustChangePassword"] == true && !isAllowedBeforePasswordChange(res) {
+		err = &utils.Error{http.StatusForbidden, "Password must be changed."}
+		return
+	}
+
+	if strings.EqualFold(res, ResourceLogin) || strings.EqualFold(res, ResourceRegister) || strings.EqualFold(res, ResourceRefresh) ||
+	strings.EqualFold(res, ResourceVerifyEmail) || strings.EqualFold(res, ResourceResetPassword) ||
+	strings.EqualFold(res, ResourceResetPasswordConfirm) || strings.EqualFold(res, ResourceLoginTwoFactor) ||
+	strings.Index(res, ResourceTypeFiles) == 0 {
 		isGranted = true
 		return
 	}
 
+	// sessions of a user are listed and deleted only by the user
+	if isSessionsResource(res) || isTwoFactorResource(res) || isProvidersResource(res) || strings.EqualFold(res, ResourceMyExport) {
+		isGranted = user != nil
+		return
+	}
+
+	// accounts of the users are managed only by the admins
+	if IsUserActionResource(res) {
+		isGranted = user != nil && canManageUsers(roles)
+		return
+	}
+
 	// if res contains ':' then this is a function uri. remove the function name and get the permissions on real uri
 	if strings.Index(res, "-") > 0 {
 		requestWrapper.Res = requestWrapper.Res[:strings.Index(requestWrapper.Res, "-") - 1]
@@ -484,6 +580,37 @@ var IsGranted = func(collection string, requestWrapper messages.RequestWrapper,
 	return
 }
 
+func isSessionsResource(res string) bool {
+	return strings.EqualFold(res, ResourceMySessions) || strings.HasPrefix(strings.ToLower(res), ResourceMySessions + "/")
+}
+
+func isTwoFactorResource(res string) bool {
+	return strings.EqualFold(res, ResourceMyTwoFactor) || strings.HasPrefix(strings.ToLower(res), ResourceMyTwoFactor + "/")
+}
+
+func isProvidersResource(res string) bool {
+	return strings.EqualFold(res, ResourceMyProviders) || strings.HasPrefix(strings.ToLower(res), ResourceMyProviders + "/")
+}
+
+// replaces '/users/me' in the request with the object of the user of the access token
+var ResolveCurrentUser = func(requestWrapper messages.RequestWrapper) (resolved messages.RequestWrapper, err *utils.Error) {
+
+	var user map[string]interface{}
+	user, err = getUser(requestWrapper)
+	if err != nil {
+		return
+	}
+	if user == nil {
+		err = &utils.Error{http.StatusUnauthorized, "Access token must be provided for /users/me."}
+		return
+	}
+
+	resolved = requestWrapper
+	resolved.Res = ResourceTypeUsers + "/" + user["_id"].(string)
+	resolved.Message.Res = resolved.Res
+	return
+}
+
 func getUser(requestWrapper messages.RequestWrapper) (user map[string]interface{}, err *utils.Error) {
 
 	var userDataFromToken map[string]interface{}
@@ -499,6 +626,12 @@ func getUser(requestWrapper messages.RequestWrapper) (user map[string]interface{
 		if err != nil {
 			return
 		}
+
+		// only the token tells whether the user is impersonated
+		delete(user, "impersonatedBy")
+		if impersonatedBy, _ := userDataFromToken["impersonatedBy"].(string); impersonatedBy != "" {
+			user["impersonatedBy"] = impersonatedBy
+		}
 	}
 
 	return
@@ -506,11 +639,22 @@ func getUser(requestWrapper messages.RequestWrapper) (user map[string]interface{
 
 func getRolesOfUser(user map[string]interface{}) (roles []string, err *utils.Error) {
 
-	// TODO: get roles recursively
+	if user != nil {
+		var assignedRoles []string
+		if user["_roles"] != nil {
+			for _, r := range user["_roles"].([]interface{}) {
+				assignedRoles = append(assignedRoles, r.(string))
+			}
+		}
 
-	if user != nil && user["_roles"] != nil {
-		for _, r := range user["_roles"].([]interface{}) {
-			roles = append(roles, "role:" + r.(string))
+		// roles are fetched on every request so the changes on roles take effect without logging in again
+		var roleNames []string
+		roleNames, err = getRoleMemberships(user["_id"].(string), assignedRoles)
+		if err != nil {
+			return
+		}
+		for _, r := range roleNames {
+			roles = append(roles, "role:" + r)
 		}
 		roles = append(roles, "user:" + user["_id"].(string))
 	}
@@ -562,31 +706,76 @@ func getPermissionsOnObject(collection string, id string, roles []string) (permi
 
 func getPermissionsOnResources(roles []string, requestWrapper messages.RequestWrapper) (permissions map[string]bool, err *utils.Error) {
 
-	// TODO get class type permissions and return them
 	permissions = map[string]bool{
 		"create": true,
 		"query": true,
 	}
 
+	className := strings.Trim(requestWrapper.Res, "/")
+	classPermissions, hasClassPermissions := config.SystemConfig.Permissions[className]
+	if !hasClassPermissions {
+		classPermissions, hasClassPermissions = defaultClassPermissions[className]
+	}
+	if !hasClassPermissions {
+		return
+	}
+
+	// actions that are given in class permissions are only allowed to the listed roles
+	for action, allowedRoles := range classPermissions {
+		permissions[action] = false
+		for _, allowedRole := range allowedRoles {
+			for _, role := range roles {
+				if role == allowedRole {
+					permissions[action] = true
+				}
+			}
+		}
+	}
+
 	return
 }
 
 func verifyToken(tokenString string) (userData map[string]interface{}, err *utils.Error) {
 
-	token, tokenErr := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
-		return []byte("SIGN_IN_KEY"), nil
-	})
+	token, tokenErr := jwt.Parse(tokenString, getVerificationKey)
+	if tokenErr != nil || !token.Valid {
+		err = &utils.Error{http.StatusUnauthorized, "Token is not valid."}
+		return
+	}
 
-	if tokenErr != nil {
-		err = &utils.Error{http.StatusInternalServerError, "Parsing token failed."}
+	// tokens that are signed for other purposes cannot be used as access tokens
+	userData, isMap := token.Claims["user"].(map[string]interface{})
+	if !isMap || token.Claims["purpose"] != nil {
+		err = &utils.Error{http.StatusUnauthorized, "Token is not valid."}
+		return
 	}
 
-	if !token.Valid {
+	// disabled users are rejected before the session, since disabling revokes their sessions
+	userId, _ := userData["userId"].(string)
+	account, accountErr := adapters.Get(ClassUsers, userId)
+	if accountErr != nil {
+		userData = nil
 		err = &utils.Error{http.StatusUnauthorized, "Token is not valid."}
+		return
+	}
+	if _, err = checkAccountStatus(account); err != nil {
+		userData = nil
+		return
 	}
 
-	userData = token.Claims["user"].(map[string]interface{})
+	// tokens of the revoked sessions are rejected
+	sessionId, _ := token.Claims["sid"].(string)
+	session, sessionErr := getSession(sessionId)
+	if sessionId == "" || sessionErr != nil || session["userId"] != userData["userId"] {
+		userData = nil
+		err = &utils.Error{http.StatusUnauthorized, "Session is not valid."}
+		return
+	}
+	touchSession(session)
 
+	if impersonatedBy, _ := token.Claims["impersonatedBy"].(string); impersonatedBy != "" {
+		userData["impersonatedBy"] = impersonatedBy
+	}
 	return
 }
 
@@ -601,14 +790,9 @@ var getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *ada
 	} else if email, hasEmail := requestWrapper.Message.Body["email"]; hasEmail && email != "" {
 		queryKey = "email"
 		queryParam = email.(string)
-	} else if facebookData, hasFacebookData := requestWrapper.Message.Body["facebook"]; hasFacebookData {
-		facebookDataAsMap := facebookData.(map[string]interface{})
-		queryParam = facebookDataAsMap["id"].(string)
-		queryKey = "facebook.id"
-	} else if googleData, hasGoogleData := requestWrapper.Message.Body["google"]; hasGoogleData {
-		googleDataAsMap := googleData.(map[string]interface{})
-		queryParam = googleDataAsMap["id"].(string)
-		queryKey = "google.id"
+	} else if providerName, _, hasProvider := getProvider(requestWrapper.Message.Body); hasProvider {
+		queryParam, _ = requestWrapper.Message.Body[providerName].(map[string]interface{})["id"].(string)
+		queryKey = providerName + ".id"
 	}
 
 	query := make(map[string]string)
@@ -622,7 +806,7 @@ var getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *ada
 	}
 	requestWrapper.Message.Parameters["where"] = []string{string(whereParamsJson)}
 
-	results, fetchErr := adapters.Query(ClassUsers, requestWrapper.Message.Parameters)
+	results, fetchErr := adapters.Query(ClassUsers, requestWrapper.Message.Parameters, nil)
 	resultsAsMap := results["data"].([]map[string]interface{})
 	if fetchErr != nil || len(resultsAsMap) == 0 {
 		err = &utils.Error{http.StatusNotFound, "Account not found."}
@@ -633,9 +817,21 @@ var getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *ada
 	return
 }
 
-var generateToken = func(userId string, userData map[string]interface{}) (tokenString string, err *utils.Error) {
+var generateToken = func(userId, sessionId string, userData map[string]interface{}) (tokenString string, err *utils.Error) {
+	return signAccessToken(userId, sessionId, userData, tokenLifetime, "")
+}
 
-	token := jwt.New(jwt.SigningMethodHS256)
+// signs an access token of the session. tokens of the impersonation sessions have the id of the admin.
+func signAccessToken(userId, sessionId string, userData map[string]interface{}, lifetime time.Duration, impersonatedBy string) (tokenString string, err *utils.Error) {
+
+	key, hasKey := signingKeys[currentSigningKeyId]
+	if !hasKey {
+		err = &utils.Error{http.StatusInternalServerError, "Token signing key is not configured."}
+		return
+	}
+
+	token := jwt.New(key.method)
+	token.Header["kid"] = currentSigningKeyId
 
 	userTokenData := make(map[string]interface{})
 	userTokenData["userId"] = userId
@@ -648,11 +844,15 @@ var generateToken = func(userId string, userData map[string]interface{}) (tokenS
 	}
 
 	token.Claims["ver"] = "0.1"
-	token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+	token.Claims["exp"] = time.Now().Add(lifetime).Unix()
 	token.Claims["user"] = userTokenData
+	token.Claims["sid"] = sessionId
+	if impersonatedBy != "" {
+		token.Claims["impersonatedBy"] = impersonatedBy
+	}
 
 	var signErr error
-	tokenString, signErr = token.SignedString([]byte("SIGN_IN_KEY"))
+	tokenString, signErr = token.SignedString(key.signKey)
 	if signErr != nil {
 		err = &utils.Error{http.StatusInternalServerError, "Generating token failed."}
 	}
@@ -11,7 +11,10 @@ import (
 	"net/url"
 	"fmt"
 	"github.com/eluleci/dock/config"
+	"github.com/eluleci/dock/mailer"
 	"strings"
+	"time"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func setDefaultServer(mockServer *httptest.Server) {
@@ -46,7 +49,7 @@ func makeValidFacebookRequest() messages.RequestWrapper {
 func makeValidGoogleRequest() messages.RequestWrapper {
 
 	googleData := make(map[string]interface{})
-	googleData["id"] = "someid"
+	googleData["id"] = "107419746647224140307"
 	googleData["idToken"] = "someidtoken"
 
 	var message messages.Message
@@ -109,7 +112,7 @@ func TestHandleSignUp(t *testing.T) {
 		}
 
 		var called bool
-		generateToken = func(userId string, userData map[string]interface{}) (tokenString string, err *utils.Error) {
+		generateToken = func(userId, sessionId string, userData map[string]interface{}) (tokenString string, err *utils.Error) {
 			called = true
 			err = &utils.Error{http.StatusConflict, "Exists."}
 			return
@@ -135,7 +138,7 @@ func TestHandleSignUp(t *testing.T) {
 			return
 		}
 
-		generateToken = func(userId string, userData map[string]interface{}) (tokenString string, err *utils.Error) {
+		generateToken = func(userId, sessionId string, userData map[string]interface{}) (tokenString string, err *utils.Error) {
 			err = &utils.Error{http.StatusInternalServerError, "Generating token failed."}
 			return
 		}
@@ -219,7 +222,7 @@ func TestHandleSignUp(t *testing.T) {
 			return
 		}
 
-		generateToken = func(userId string, userData map[string]interface{}) (tokenString string, err *utils.Error) {
+		generateToken = func(userId, sessionId string, userData map[string]interface{}) (tokenString string, err *utils.Error) {
 			tokenString = ""
 			return
 		}
@@ -457,12 +460,21 @@ func TestFacebookRegistration(t *testing.T) {
 			return
 		}
 
+		var updatedData map[string]interface{}
+		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			updatedData = data
+			return
+		}
+
 		requestWrapper := makeValidFacebookRequest()
 		response, _, err := HandleSignUp(requestWrapper, &adapters.MongoAdapter{})
 
 		So(err, ShouldBeNil)
 		So(called, ShouldBeTrue)
 		So(response.Status, ShouldEqual, http.StatusCreated)
+
+		// the new access token is saved
+		So(updatedData["facebook"].(map[string]interface{})["accessToken"], ShouldEqual, "facebookaccesstoken")
 	})
 }
 
@@ -591,6 +603,24 @@ func TestGoogleRegistration(t *testing.T) {
 		So(err.Code, ShouldEqual, http.StatusInternalServerError)
 	})
 
+	Convey("Should fail when the user id is not the user of the token.", t, func() {
+
+		mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(200)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, `{"iss": "accounts.google.com","aud": "googleclientid","sub": "107419746647224140307","email": "emir@miwi.com"}`)
+		}))
+		defer mockServer.Close()
+		setDefaultServer(mockServer)
+
+		requestWrapper := makeValidGoogleRequest()
+		requestWrapper.Message.Body["google"].(map[string]interface{})["id"] = "victimid"
+
+		_, _, err := HandleSignUp(requestWrapper, &adapters.MongoAdapter{})
+
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+	})
+
 	Convey("Should create new account.", t, func() {
 
 		mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -635,12 +665,19 @@ func TestGoogleRegistration(t *testing.T) {
 			return
 		}
 
+		var updatedData map[string]interface{}
+		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			updatedData = data
+			return
+		}
+
 		requestWrapper := makeValidGoogleRequest()
 		response, _, err := HandleSignUp(requestWrapper, &adapters.MongoAdapter{})
 
 		So(err, ShouldBeNil)
 		So(called, ShouldBeTrue)
 		So(response.Status, ShouldEqual, http.StatusCreated)
+		So(updatedData["google"], ShouldNotBeNil)
 	})
 
 }
@@ -764,7 +801,7 @@ func TestHandleLogin(t *testing.T) {
 			return
 		}
 
-		generateToken = func(userId string, userData map[string]interface{}) (tokenString string, err *utils.Error) {
+		generateToken = func(userId, sessionId string, userData map[string]interface{}) (tokenString string, err *utils.Error) {
 			err = &utils.Error{http.StatusInternalServerError, "Generating token failed."}
 			return
 		}
@@ -787,14 +824,14 @@ func TestResetPassword(t *testing.T) {
 
 	config.SystemConfig = config.Config{}
 	config.SystemConfig.ResetPassword = map[string]string {
-		"senderEmail": "info@rihtim.com",
-		"senderEmailPassword": "emailadresspassword",
-		"smtpServer":"mail.rihtim.com",
-		"smtpPort":"25",
-		"mailSubject":"Reset password!",
-		"mailContentTemplate":"Your new password is %s.",
+		"link":"https://myapp.com/resetpassword?token=",
 	}
 
+	originalSendResetPasswordLink := sendResetPasswordLink
+	originalGetAccountData := getAccountData
+	resetPasswordEmailLimiter = newRateLimiter(3, time.Hour)
+	resetPasswordAddressLimiter = newRateLimiter(20, time.Hour)
+
 	Convey("Should return internal server error", t, func() {
 
 		correctConfig := config.SystemConfig.ResetPassword
@@ -826,85 +863,202 @@ func TestResetPassword(t *testing.T) {
 		So(err.Code, ShouldEqual, http.StatusBadRequest)
 	})
 
-	Convey("Should return not found", t, func() {
+	Convey("Should return the same response whether the account exists or not", t, func() {
 
 		getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
-			err = &utils.Error{http.StatusNotFound, "Account not found."}
+			if requestWrapper.Message.Body["email"] == "email@domain.com" {
+				accountData = map[string]interface{}{"_id": "564f1a28e63bce219e1cc745"}
+			} else {
+				err = &utils.Error{http.StatusNotFound, "Account not found."}
+			}
 			return
 		}
 
-		var message messages.Message
-		message.Body = make(map[string]interface{})
-		message.Body["email"] = "email@domain.com"
+		sentLinks := make(chan string, 2)
+		sendResetPasswordLink = func(userId, email string) (err *utils.Error) {
+			sentLinks <- userId
+			return
+		}
 
 		var requestWrapper messages.RequestWrapper
-		requestWrapper.Message = message
+		requestWrapper.Message.Body = map[string]interface{}{"email": "notexisting@domain.com"}
+		responseOfNotExisting, err := HandleResetPassword(requestWrapper, &adapters.MongoAdapter{})
+		So(err, ShouldBeNil)
 
-		_, err := HandleResetPassword(requestWrapper, &adapters.MongoAdapter{})
+		requestWrapper.Message.Body = map[string]interface{}{"email": "email@domain.com"}
+		responseOfExisting, err := HandleResetPassword(requestWrapper, &adapters.MongoAdapter{})
+		So(err, ShouldBeNil)
 
-		So(err.Code, ShouldEqual, http.StatusNotFound)
+		So(responseOfExisting.Status, ShouldEqual, http.StatusOK)
+		So(responseOfExisting, ShouldResemble, responseOfNotExisting)
+		So(<-sentLinks, ShouldEqual, "564f1a28e63bce219e1cc745")
+		So(len(sentLinks), ShouldEqual, 0)
 	})
 
-	Convey("Should return the error from adapters.HandlePut", t, func() {
+	Convey("Should limit the requests for an email", t, func() {
 
 		getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
-			accountData = make(map[string]interface{})
-			accountData["_id"] = "564f1a28e63bce219e1cc745"
+			err = &utils.Error{http.StatusNotFound, "Account not found."}
 			return
 		}
 
-		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
-			err = &utils.Error{http.StatusInternalServerError, "Some error happened."}
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"email": "limited@domain.com"}
+
+		for i := 0; i < 3; i++ {
+			_, err := HandleResetPassword(requestWrapper, &adapters.MongoAdapter{})
+			So(err, ShouldBeNil)
+		}
+
+		requestWrapper.Message.Body = map[string]interface{}{"email": "LIMITED@domain.com"}
+		_, err := HandleResetPassword(requestWrapper, &adapters.MongoAdapter{})
+		So(err.Code, ShouldEqual, http.StatusTooManyRequests)
+	})
+
+	Convey("Should create a single use token and send it in a link", t, func() {
+
+		sendResetPasswordLink = originalSendResetPasswordLink
+
+		var deletedWhere map[string]interface{}
+		adapters.DeleteAll = func(collection string, where map[string]interface{}) (err *utils.Error) {
+			deletedWhere = where
 			return
 		}
 
-		var message messages.Message
-		message.Body = make(map[string]interface{})
-		message.Body["email"] = "email@domain.com"
+		var createdReset map[string]interface{}
+		adapters.Create = func(collection string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			createdReset = data
+			return
+		}
+
+		originalSendTemplate := mailer.SendTemplate
+		var sentTemplate, sentLink string
+		mailer.SendTemplate = func(templateName, to string, data map[string]interface{}) (err *utils.Error) {
+			sentTemplate = templateName
+			sentLink = data["link"].(string)
+			return
+		}
+
+		err := sendResetPasswordLink("564f1a28e63bce219e1cc745", "email@domain.com")
+		So(err, ShouldBeNil)
+		So(deletedWhere["userId"], ShouldEqual, "564f1a28e63bce219e1cc745")
+
+		So(sentTemplate, ShouldEqual, mailer.TemplateResetPassword)
+		token := strings.TrimPrefix(sentLink, "https://myapp.com/resetpassword?token=")
+		So(token, ShouldNotBeEmpty)
+		So(createdReset["token"], ShouldEqual, hashToken(token))
+
+		mailer.SendTemplate = originalSendTemplate
+	})
+
+	sendResetPasswordLink = originalSendResetPasswordLink
+	getAccountData = originalGetAccountData
+}
+
+func TestResetPasswordConfirm(t *testing.T) {
+
+	originalRevokeSessions := revokeSessions
+
+	Convey("Should return bad request", t, func() {
 
 		var requestWrapper messages.RequestWrapper
-		requestWrapper.Message = message
+		requestWrapper.Message.Body = map[string]interface{}{"token": "sometoken"}
 
-		_, err := HandleResetPassword(requestWrapper, &adapters.MongoAdapter{})
+		_, err := HandleResetPasswordConfirm(requestWrapper)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+	})
 
-		So(err, ShouldNotBeNil)
+	Convey("Should not accept unknown and expired tokens", t, func() {
+
+		adapters.DeleteAll = func(collection string, where map[string]interface{}) (err *utils.Error) {
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"token": "sometoken", "newPassword": "newpassword"}
+
+		adapters.Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
+			response = map[string]interface{}{"data": make([]map[string]interface{}, 0)}
+			return
+		}
+		_, err := HandleResetPasswordConfirm(requestWrapper)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+
+		adapters.Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
+			passwordReset := map[string]interface{}{"userId": "userid", "expiresAt": time.Now().Add(-time.Minute).Unix()}
+			response = map[string]interface{}{"data": []map[string]interface{}{passwordReset}}
+			return
+		}
+		_, err = HandleResetPasswordConfirm(requestWrapper)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
 	})
 
-	Convey("Should call adapters.HandlePut with new password and correct user resource", t, func() {
+	Convey("Should set the new password, use the token and revoke sessions", t, func() {
 
-		getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
-			accountData = make(map[string]interface{})
-			accountData["_id"] = "564f1a28e63bce219e1cc745"
+		var queriedWhere string
+		adapters.Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
+			queriedWhere = parameters["where"][0]
+			passwordReset := map[string]interface{}{"userId": "userid", "expiresAt": time.Now().Add(time.Minute).Unix()}
+			response = map[string]interface{}{"data": []map[string]interface{}{passwordReset}}
 			return
 		}
 
-		var isResCorrect bool
-		var isPasswordProvided bool
+		var isTokenDeleted bool
+		adapters.DeleteAll = func(collection string, where map[string]interface{}) (err *utils.Error) {
+			isTokenDeleted = collection == ClassPasswordResets && where["userId"] == "userid"
+			return
+		}
+
+		var updatedPassword string
 		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
-			isResCorrect = strings.EqualFold("users", collection) && strings.EqualFold("564f1a28e63bce219e1cc745", id)
-			isPasswordProvided = len(data["password"].(string)) > 0
+			updatedPassword = data["password"].(string)
 			return
 		}
 
-		var called bool
-		sendNewPasswordEmail = func(smtpServer, smtpPost, senderEmail, senderEmailPassword, subject, contentTemplate, recipientEmail, newPassword string) (err *utils.Error) {
-			called = true
+		var revokedUser string
+		revokeSessions = func(userId string) (err *utils.Error) {
+			revokedUser = userId
 			return
 		}
 
-		var message messages.Message
-		message.Body = make(map[string]interface{})
-		message.Body["email"] = "email@domain.com"
+		adapters.Get = func(collection string, id string) (response map[string]interface{}, err *utils.Error) {
+			response = map[string]interface{}{"_id": id, "email": "Johny@bravo.com"}
+			return
+		}
 
-		var requestWrapper messages.RequestWrapper
-		requestWrapper.Message = message
+		accountFailures = newFailureCounter()
+		accountFailures.fail("email:johny@bravo.com", 1)
 
-		HandleResetPassword(requestWrapper, &adapters.MongoAdapter{})
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"token": "sometoken", "newPassword": "newpassword"}
 
-		So(isResCorrect, ShouldBeTrue)
-		So(isPasswordProvided, ShouldBeTrue)
-		So(called, ShouldBeTrue)
+		response, err := HandleResetPasswordConfirm(requestWrapper)
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusOK)
+		So(queriedWhere, ShouldContainSubstring, hashToken("sometoken"))
+		So(isTokenDeleted, ShouldBeTrue)
+		So(bcrypt.CompareHashAndPassword([]byte(updatedPassword), []byte("newpassword")), ShouldBeNil)
+		So(revokedUser, ShouldEqual, "userid")
+		So(accountFailures.lockedFor("email:johny@bravo.com"), ShouldEqual, 0)
 	})
 
+	revokeSessions = originalRevokeSessions
 }
 
+func TestResolveCurrentUser(t *testing.T) {
+
+	Convey("Should require an access token", t, func() {
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Res = ResourceTypeUsers + "/me"
+
+		_, err := ResolveCurrentUser(requestWrapper)
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("Should return the names of the roles", t, func() {
+
+		So(GetRoleNames([]string{"role:editor", "user:userid", "role:admin", "*"}), ShouldResemble, []string{"admin", "editor"})
+		So(GetRoleNames(nil), ShouldBeEmpty)
+	})
+}
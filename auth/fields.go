@@ -0,0 +1,316 @@
+package auth
+
+import (
+	"strings"
+	"net/http"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"github.com/eluleci/dock/adapters"
+)
+
+// rules that are applied to all classes together with the ones in the configuration file
+var defaultFieldRules = config.FieldRules{
+	ReadOnly: []string{"_id", "createdAt", "updatedAt"},
+}
+
+// rules that are applied to system classes together with the ones in the configuration file
+var defaultClassFieldRules = map[string]config.FieldRules{
+	ClassUsers: {
+		Hidden: []string{"password"},
+		ReadOnly: []string{"password", "_roles", "emailVerified", "twoFactorEnabled", "disabled", "banned", "banReason",
+			"bannedAt", "mustChangePassword"},
+	},
+	ClassSessions: {
+		Hidden: []string{"refreshToken"},
+	},
+}
+
+// removes the fields that the user is not allowed to see. expanded objects are filtered with the rules of their own
+// classes.
+var FilterFields = func(className string, object map[string]interface{}, user map[string]interface{}, roles []string) map[string]interface{} {
+	return filterObjectFields(className, object, user, roles)
+}
+
+func filterObjectFields(className string, object map[string]interface{}, user map[string]interface{}, roles []string) map[string]interface{} {
+
+	if object == nil {
+		return object
+	}
+
+	rules := getFieldRules(className)
+
+	for _, field := range rules.Hidden {
+		delete(object, field)
+	}
+
+	for field, allowedRoles := range rules.VisibleTo {
+		if _, hasField := object[field]; hasField && !hasAnyRole(roles, allowedRoles, isOwner(className, object, user)) {
+			delete(object, field)
+		}
+	}
+
+	for _, value := range object {
+		switch nested := value.(type) {
+		case map[string]interface{}:
+			filterNestedObject(nested, user, roles)
+		case []map[string]interface{}:
+			for _, item := range nested {
+				filterNestedObject(item, user, roles)
+			}
+		case []interface{}:
+			for _, item := range nested {
+				if itemAsMap, isMap := item.(map[string]interface{}); isMap {
+					filterNestedObject(itemAsMap, user, roles)
+				}
+			}
+		}
+	}
+
+	return object
+}
+
+// returns error if the body contains a field that the user is not allowed to write. id is empty for create requests.
+var CheckWritableFields = func(className, id string, body map[string]interface{}, user map[string]interface{}) (err *utils.Error) {
+
+	rules := getFieldRules(className)
+
+	for _, field := range rules.ReadOnly {
+		if _, hasField := body[field]; hasField {
+			err = &utils.Error{http.StatusForbidden, "Field '" + field + "' is read-only."}
+			return
+		}
+	}
+
+	// accounts of the providers are verified, so they are linked only through /users/me/providers
+	if className == ClassUsers {
+		for field, value := range body {
+			if _, _, isProvider := getProvider(map[string]interface{}{field: value}); isProvider {
+				err = &utils.Error{http.StatusForbidden, "Field '" + field + "' can only be changed through /users/me/providers."}
+				return
+			}
+		}
+	}
+
+	// the creator of an object is its owner
+	if id == "" {
+		return
+	}
+
+	// acl is given when the object is created. changing it later would let the users give themselves permissions
+	if _, hasAcl := body["_acl"]; hasAcl {
+		err = &utils.Error{http.StatusForbidden, "Field '_acl' can only be given when the object is created."}
+		return
+	}
+
+	var object map[string]interface{}
+	for _, field := range rules.OwnerOnly {
+		if _, hasField := body[field]; !hasField {
+			continue
+		}
+
+		if object == nil {
+			object, err = adapters.Get(className, id)
+			if err != nil {
+				return
+			}
+		}
+
+		if !isOwner(className, object, user) {
+			err = &utils.Error{http.StatusForbidden, "Field '" + field + "' can only be changed by the owner."}
+			return
+		}
+	}
+	return
+}
+
+// operators that can read the fields without naming them, like the javascript of '$where' or the field name that is
+// built in '$getField'
+var fieldReadingOperators = map[string]bool{
+	"$where": true,
+	"$function": true,
+	"$accumulator": true,
+	"$getField": true,
+	"$setField": true,
+	"$unsetField": true,
+	"$$ROOT": true,
+	"$$CURRENT": true,
+}
+
+// stages that can move the values of the fields to other fields. their outputs cannot be filtered with the field rules.
+var reshapingAggregateStages = map[string]bool{
+	"$project": true,
+	"$addFields": true,
+	"$set": true,
+	"$group": true,
+	"$replaceRoot": true,
+	"$replaceWith": true,
+	"$bucket": true,
+	"$bucketAuto": true,
+}
+
+// returns error if the where, sort or aggregate parameter of a query uses a field that the user cannot see. the
+// results of the query would show the values of the field even though the field is removed from them, like with
+// '$regex' in where or with '$project' in aggregate.
+var CheckQueryFields = func(className string, parameters map[string][]string, roles []string) (err *utils.Error) {
+
+	restrictedFields := getRestrictedFields(className, roles)
+	if len(restrictedFields) == 0 {
+		return
+	}
+
+	queryParameters, err := adapters.ParseQueryParameters(parameters)
+	if err != nil {
+		return
+	}
+
+	if queryParameters.HasSort {
+		if field := strings.TrimLeft(queryParameters.Sort, "+-"); isRestrictedField(field, restrictedFields) {
+			err = &utils.Error{http.StatusForbidden, "Field '" + field + "' cannot be used in queries."}
+			return
+		}
+	}
+
+	if pipeline, isPipeline := queryParameters.Aggregate.([]interface{}); isPipeline {
+		for _, stage := range pipeline {
+			stageAsMap, _ := stage.(map[string]interface{})
+			for operator := range stageAsMap {
+				if reshapingAggregateStages[operator] {
+					err = &utils.Error{http.StatusForbidden, "Aggregation stage '" + operator + "' is not allowed on " + className + "."}
+					return
+				}
+			}
+		}
+	}
+
+	err = checkExpressionFields(queryParameters.Where, restrictedFields)
+	if err != nil {
+		return
+	}
+	err = checkExpressionFields(queryParameters.Aggregate, restrictedFields)
+	return
+}
+
+// returns the hidden fields of the class and the fields that are visible only to the roles that the user doesn't have.
+// the fields that are visible to the owners are restricted too, since a query is not limited to the objects of the user.
+func getRestrictedFields(className string, roles []string) (fields []string) {
+
+	rules := getFieldRules(className)
+	fields = append(fields, rules.Hidden...)
+	for field, allowedRoles := range rules.VisibleTo {
+		if !hasAnyRole(roles, allowedRoles, false) {
+			fields = append(fields, field)
+		}
+	}
+	return
+}
+
+// checks the keys and the field paths like '$password' in a where or an aggregate expression
+func checkExpressionFields(expression interface{}, restrictedFields []string) (err *utils.Error) {
+
+	switch value := expression.(type) {
+	case map[string]interface{}:
+		for key, nested := range value {
+			if fieldReadingOperators[key] {
+				err = &utils.Error{http.StatusForbidden, "Operator '" + key + "' is not allowed on this class."}
+				return
+			}
+			if isRestrictedField(key, restrictedFields) {
+				err = &utils.Error{http.StatusForbidden, "Field '" + key + "' cannot be used in queries."}
+				return
+			}
+			err = checkExpressionFields(nested, restrictedFields)
+			if err != nil {
+				return
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			err = checkExpressionFields(item, restrictedFields)
+			if err != nil {
+				return
+			}
+		}
+	case string:
+		if fieldReadingOperators[strings.SplitN(value, ".", 2)[0]] {
+			err = &utils.Error{http.StatusForbidden, "Variable '" + value + "' is not allowed on this class."}
+			return
+		}
+		if strings.HasPrefix(value, "$") && !strings.HasPrefix(value, "$$") && isRestrictedField(value[1:], restrictedFields) {
+			err = &utils.Error{http.StatusForbidden, "Field '" + value[1:] + "' cannot be used in queries."}
+			return
+		}
+	}
+	return
+}
+
+// paths like 'password.hash' are restricted with their root field
+func isRestrictedField(path string, restrictedFields []string) bool {
+
+	root := strings.SplitN(path, ".", 2)[0]
+	for _, field := range restrictedFields {
+		if root == field {
+			return true
+		}
+	}
+	return false
+}
+
+func getFieldRules(className string) (rules config.FieldRules) {
+
+	rules.VisibleTo = make(map[string][]string)
+
+	ruleSets := []config.FieldRules{defaultFieldRules}
+	if classRules, hasClassRules := defaultClassFieldRules[className]; hasClassRules {
+		ruleSets = append(ruleSets, classRules)
+	}
+	if configuredRules, hasConfiguredRules := config.SystemConfig.Fields[className]; hasConfiguredRules {
+		ruleSets = append(ruleSets, configuredRules)
+	}
+
+	for _, r := range ruleSets {
+		rules.Hidden = append(rules.Hidden, r.Hidden...)
+		rules.ReadOnly = append(rules.ReadOnly, r.ReadOnly...)
+		rules.OwnerOnly = append(rules.OwnerOnly, r.OwnerOnly...)
+		for field, allowedRoles := range r.VisibleTo {
+			rules.VisibleTo[field] = allowedRoles
+		}
+	}
+	return
+}
+
+func filterNestedObject(object map[string]interface{}, user map[string]interface{}, roles []string) {
+
+	// only expanded objects have class information
+	if className, hasClass := object["_class"].(string); hasClass {
+		filterObjectFields(className, object, user, roles)
+	}
+}
+
+// the owner of a user object is the user itself. the owner of other objects is given in '_owner' field.
+func isOwner(className string, object map[string]interface{}, user map[string]interface{}) bool {
+
+	if user == nil || user["_id"] == nil || object == nil {
+		return false
+	}
+
+	userId := user["_id"]
+	if className == ClassUsers && object["_id"] == userId {
+		return true
+	}
+	return object["_owner"] != nil && object["_owner"] == userId
+}
+
+func hasAnyRole(roles []string, allowedRoles []string, isOwner bool) bool {
+
+	for _, allowedRole := range allowedRoles {
+		if allowedRole == "owner" && isOwner {
+			return true
+		}
+		for _, role := range roles {
+			if role == allowedRole {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"net/http"
+)
+
+func TestFilterFields(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+	config.SystemConfig.Fields = map[string]config.FieldRules{
+		"users": {VisibleTo: map[string][]string{"email": {"owner", "role:admin"}}},
+		"posts": {Hidden: []string{"score"}},
+	}
+
+	Convey("Should remove hidden fields", t, func() {
+
+		object := map[string]interface{}{"_id": "postid", "title": "Title", "score": 12}
+		result := FilterFields("posts", object, nil, []string{"*"})
+
+		So(result, ShouldNotContainKey, "score")
+		So(result, ShouldContainKey, "title")
+	})
+
+	Convey("Should return fields only to the allowed roles", t, func() {
+
+		user := map[string]interface{}{"_id": "userid"}
+
+		object := map[string]interface{}{"_id": "otheruserid", "email": "other@domain.com", "password": "hash"}
+		result := FilterFields(ClassUsers, object, user, []string{"user:userid", "*"})
+		So(result, ShouldNotContainKey, "email")
+		So(result, ShouldNotContainKey, "password")
+
+		object = map[string]interface{}{"_id": "userid", "email": "user@domain.com"}
+		result = FilterFields(ClassUsers, object, user, []string{"user:userid", "*"})
+		So(result, ShouldContainKey, "email")
+
+		object = map[string]interface{}{"_id": "otheruserid", "email": "other@domain.com"}
+		result = FilterFields(ClassUsers, object, user, []string{"role:admin", "user:userid", "*"})
+		So(result, ShouldContainKey, "email")
+	})
+
+	Convey("Should filter expanded objects with the rules of their classes", t, func() {
+
+		author := map[string]interface{}{"_id": "authorid", "_class": "users", "password": "hash"}
+		comments := []interface{}{
+			map[string]interface{}{"_id": "commentid", "_class": "posts", "score": 3},
+		}
+		object := map[string]interface{}{"_id": "postid", "author": author, "comments": comments}
+
+		FilterFields("posts", object, nil, []string{"*"})
+		So(author, ShouldNotContainKey, "password")
+		So(comments[0], ShouldNotContainKey, "score")
+	})
+
+	config.SystemConfig = config.Config{}
+}
+
+func TestCheckWritableFields(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+	config.SystemConfig.Fields = map[string]config.FieldRules{
+		"posts": {ReadOnly: []string{"_acl"}, OwnerOnly: []string{"title"}},
+	}
+	user := map[string]interface{}{"_id": "userid"}
+
+	Convey("Should not allow writing read-only fields", t, func() {
+
+		err := CheckWritableFields("posts", "", map[string]interface{}{"_acl": map[string]interface{}{}}, user)
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+
+		err = CheckWritableFields(ClassUsers, "userid", map[string]interface{}{"_roles": []interface{}{}}, user)
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+
+		err = CheckWritableFields("posts", "postid", map[string]interface{}{"createdAt": 0}, user)
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+	})
+
+	Convey("Should allow acl only when the object is created", t, func() {
+
+		acl := map[string]interface{}{"*": map[string]interface{}{"get": true}}
+		err := CheckWritableFields("comments", "", map[string]interface{}{"_acl": acl}, user)
+		So(err, ShouldBeNil)
+
+		err = CheckWritableFields("comments", "commentid", map[string]interface{}{"_acl": acl}, user)
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+	})
+
+	Convey("Should allow owner-only fields only to the owner", t, func() {
+
+		adapters.Get = func(collection string, id string) (response map[string]interface{}, err *utils.Error) {
+			response = map[string]interface{}{"_id": id, "_owner": "otheruserid"}
+			return
+		}
+
+		err := CheckWritableFields("posts", "postid", map[string]interface{}{"title": "New title"}, user)
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+
+		err = CheckWritableFields("posts", "postid", map[string]interface{}{"body": "New body"}, user)
+		So(err, ShouldBeNil)
+
+		err = CheckWritableFields("posts", "", map[string]interface{}{"title": "Title"}, user)
+		So(err, ShouldBeNil)
+
+		adapters.Get = func(collection string, id string) (response map[string]interface{}, err *utils.Error) {
+			response = map[string]interface{}{"_id": id, "_owner": "userid"}
+			return
+		}
+
+		err = CheckWritableFields("posts", "postid", map[string]interface{}{"title": "New title"}, user)
+		So(err, ShouldBeNil)
+	})
+
+	config.SystemConfig = config.Config{}
+}
+
+func TestCheckQueryFields(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+	config.SystemConfig.Fields = map[string]config.FieldRules{
+		"users": {VisibleTo: map[string][]string{"email": {"owner", "role:admin"}}},
+	}
+	roles := []string{"user:userid", "*"}
+
+	Convey("Should allow the queries on the visible fields", t, func() {
+
+		err := CheckQueryFields(ClassUsers, map[string][]string{
+			"where": {`{"username":{"$regex":"^jo"}}`},
+			"sort": {`"-createdAt"`},
+		}, roles)
+		So(err, ShouldBeNil)
+
+		err = CheckQueryFields(ClassUsers, map[string][]string{
+			"aggregate": {`[{"$match":{"username":"john"}},{"$sort":{"createdAt":-1}}]`},
+		}, roles)
+		So(err, ShouldBeNil)
+
+		err = CheckQueryFields("posts", map[string][]string{
+			"aggregate": {`[{"$group":{"_id":"$author","count":{"$sum":1}}}]`},
+		}, roles)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Should not allow searching the hidden fields with where", t, func() {
+
+		err := CheckQueryFields(ClassUsers, map[string][]string{"where": {`{"password":{"$regex":"^\\$2a"}}`}}, roles)
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+
+		err = CheckQueryFields(ClassUsers, map[string][]string{
+			"where": {`{"$or":[{"username":"john"},{"$expr":{"$eq":["$password","hash"]}}]}`},
+		}, roles)
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+
+		err = CheckQueryFields(ClassUsers, map[string][]string{"where": {`{"$where":"this.password.length > 10"}`}}, roles)
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+
+		err = CheckQueryFields(ClassUsers, map[string][]string{"sort": {`"password"`}}, roles)
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+	})
+
+	Convey("Should not allow reading the hidden fields with aggregate", t, func() {
+
+		err := CheckQueryFields(ClassUsers, map[string][]string{"aggregate": {`[{"$project":{"h":"$password"}}]`}}, roles)
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+
+		err = CheckQueryFields(ClassUsers, map[string][]string{"aggregate": {`[{"$sortByCount":"$password"}]`}}, roles)
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+
+		err = CheckQueryFields(ClassUsers, map[string][]string{
+			"aggregate": {`[{"$match":{"$expr":{"$gt":[{"$strLenCP":{"$getField":{"$concat":["pass","word"]}}},10]}}}]`},
+		}, roles)
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+
+		err = CheckQueryFields(ClassUsers, map[string][]string{"aggregate": {`[{"$addFields":{"username":"$username"}}]`}}, roles)
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+	})
+
+	Convey("Should allow the fields that are visible to the roles of the user", t, func() {
+
+		parameters := map[string][]string{"where": {`{"email":{"$regex":"@domain.com$"}}`}}
+		err := CheckQueryFields(ClassUsers, parameters, roles)
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+
+		err = CheckQueryFields(ClassUsers, parameters, []string{"role:admin", "user:userid", "*"})
+		So(err, ShouldBeNil)
+	})
+
+	config.SystemConfig = config.Config{}
+}
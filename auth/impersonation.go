@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"time"
+	"strings"
+	"net/http"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+)
+
+const defaultImpersonationTokenLifetime = 15 * time.Minute
+
+var impersonationTokenLifetime = defaultImpersonationTokenLifetime
+
+// issues an access token of the user to the admin. the token has the id of the admin in 'impersonatedBy' claim, and
+// it cannot be refreshed.
+var startImpersonation = func(requestWrapper messages.RequestWrapper, account map[string]interface{}, adminId string) (response messages.Message, err *utils.Error) {
+
+	userId := account["_id"].(string)
+
+	if adminId == "" {
+		err = &utils.Error{http.StatusForbidden, "Users can only be impersonated by admins."}
+		return
+	}
+	if adminId == userId {
+		err = &utils.Error{http.StatusBadRequest, "Admins cannot impersonate themselves."}
+		return
+	}
+
+	response, err = checkAccountStatus(account)
+	if err != nil {
+		return
+	}
+
+	// admins cannot get the permissions of the other admins
+	roles, err := getRolesOfUser(account)
+	if err != nil {
+		return
+	}
+	if canManageUsers(roles) {
+		err = &utils.Error{http.StatusForbidden, "Admins cannot be impersonated."}
+		return
+	}
+
+	expiresAt := time.Now().Add(impersonationTokenLifetime).Unix()
+	session := map[string]interface{}{
+		"userId": userId,
+		"impersonatedBy": adminId,
+		"expiresAt": expiresAt,
+		"lastUsedAt": time.Now().Unix(),
+		"ip": requestWrapper.Message.RemoteAddr,
+		"userAgent": getUserAgent(requestWrapper),
+		"_acl": map[string]interface{}{},
+	}
+
+	createdSession, _, err := adapters.Create(ClassSessions, session)
+	if err != nil {
+		return
+	}
+
+	accessToken, err := signAccessToken(userId, createdSession["_id"].(string), account, impersonationTokenLifetime, adminId)
+	if err != nil {
+		return
+	}
+
+	WriteAuditLog(map[string]interface{}{
+		"action": "manageUser",
+		"operation": UserActionImpersonate,
+		"userId": userId,
+		"adminId": adminId,
+		"expiresAt": expiresAt,
+		"ip": requestWrapper.Message.RemoteAddr,
+	})
+
+	response.Body = map[string]interface{}{
+		"userId": userId,
+		"accessToken": accessToken,
+		"expiresAt": expiresAt,
+	}
+	response.Status = http.StatusOK
+	return
+}
+
+// returns the id of the admin who impersonates the user, empty if the request is made by the user
+func GetImpersonator(user map[string]interface{}) string {
+	impersonatedBy, _ := user["impersonatedBy"].(string)
+	return impersonatedBy
+}
+
+// saves the requests that the admins make as the users to the audit logs
+var RecordImpersonatedRequest = func(user map[string]interface{}, requestWrapper messages.RequestWrapper, status int) {
+
+	// responses without status are sent with 200
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	WriteAuditLog(map[string]interface{}{
+		"action": "impersonatedRequest",
+		"userId": user["_id"],
+		"adminId": GetImpersonator(user),
+		"command": strings.ToLower(requestWrapper.Message.Command),
+		"res": requestWrapper.Message.Res,
+		"status": status,
+		"ip": requestWrapper.Message.RemoteAddr,
+	})
+}
+
+// credentials, login methods, sessions and the account itself stay in the control of the user
+func isForbiddenWhileImpersonating(requestWrapper messages.RequestWrapper, user map[string]interface{}) bool {
+
+	res := requestWrapper.Res
+	if strings.EqualFold(res, ResourceChangePassword) || strings.EqualFold(res, ResourceRegister) ||
+	strings.EqualFold(res, ResourceMyExport) || isSessionsResource(res) || isTwoFactorResource(res) ||
+	isProvidersResource(res) || IsUserActionResource(res) {
+		return true
+	}
+
+	userId, _ := user["_id"].(string)
+	isOwnUser := strings.EqualFold(res, ResourceTypeUsers + "/" + userId) || strings.EqualFold(res, ResourceTypeUsers + "/me")
+	if !isOwnUser {
+		return false
+	}
+
+	command := requestWrapper.Message.Command
+	if strings.EqualFold(command, "delete") {
+		return true
+	}
+
+	// the email, the username and the providers are used for logging in, like the password
+	if strings.EqualFold(command, "put") || strings.EqualFold(command, "post") {
+		for field := range requestWrapper.Message.Body {
+			if field == "email" || field == "username" || isProviderField(field) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"net/http"
+	"time"
+)
+
+func TestImpersonation(t *testing.T) {
+
+	originalQueryRoles := queryRoles
+	originalGetSession := getSession
+	config.SystemConfig = config.Config{}
+	LoadSigningKeys(config.TokenConfig{
+		SigningKey: "key1",
+		Keys: []config.SigningKey{{Kid: "key1", Algorithm: "HS256", Secret: "secret1"}},
+		ImpersonationLifetime: 300,
+	})
+
+	admin := map[string]interface{}{"_id": "adminid", "_roles": []interface{}{"admin"}}
+	account := map[string]interface{}{"_id": "userid", "email": "johny@bravo.com"}
+
+	var memberRoles []map[string]interface{}
+	queryRoles = func(where map[string]interface{}) (roles []map[string]interface{}, err *utils.Error) {
+		roles = memberRoles
+		return
+	}
+	adapters.Get = func(collection string, id string) (response map[string]interface{}, err *utils.Error) {
+		if id == "adminid" {
+			response = admin
+		} else {
+			response = map[string]interface{}{"_id": "userid", "email": "johny@bravo.com"}
+		}
+		return
+	}
+	var createdSession map[string]interface{}
+	var auditLogs []map[string]interface{}
+	adapters.Create = func(collection string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+		if collection == ClassSessions {
+			createdSession = data
+			response = map[string]interface{}{"_id": "sessionid"}
+		} else {
+			auditLogs = append(auditLogs, data)
+		}
+		return
+	}
+	getSession = func(sessionId string) (session map[string]interface{}, err *utils.Error) {
+		session = map[string]interface{}{"_id": sessionId, "userId": "userid", "lastUsedAt": time.Now().Unix()}
+		return
+	}
+
+	Convey("Should issue a short-lived token of the user to the admin", t, func() {
+
+		response, err := HandleManageUser(makeUserActionRequest("userid", UserActionImpersonate), admin)
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusOK)
+		So(createdSession["userId"], ShouldEqual, "userid")
+		So(createdSession["impersonatedBy"], ShouldEqual, "adminid")
+		So(createdSession, ShouldNotContainKey, "refreshToken")
+		So(auditLogs[len(auditLogs) - 1]["operation"], ShouldEqual, UserActionImpersonate)
+
+		accessToken := response.Body["accessToken"].(string)
+		token, _ := jwt.Parse(accessToken, getVerificationKey)
+		So(token.Claims["impersonatedBy"], ShouldEqual, "adminid")
+		So(token.Claims["exp"], ShouldBeLessThanOrEqualTo, time.Now().Add(5 * time.Minute).Unix())
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Headers = map[string][]string{"Authorization": {accessToken}}
+		user, err := getUser(requestWrapper)
+		So(err, ShouldBeNil)
+		So(user["_id"], ShouldEqual, "userid")
+		So(GetImpersonator(user), ShouldEqual, "adminid")
+	})
+
+	Convey("Should not impersonate admins, own account or with the master key", t, func() {
+
+		_, err := HandleManageUser(makeUserActionRequest("userid", UserActionImpersonate), nil)
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+
+		_, err = startImpersonation(messages.RequestWrapper{}, admin, "adminid")
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+
+		memberRoles = []map[string]interface{}{{"name": "admin"}}
+		_, err = startImpersonation(messages.RequestWrapper{}, account, "adminid")
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+		memberRoles = nil
+	})
+
+	Convey("Should forbid the sensitive requests while impersonating", t, func() {
+
+		user := map[string]interface{}{"_id": "userid", "impersonatedBy": "adminid"}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Res = ResourceChangePassword
+		So(isForbiddenWhileImpersonating(requestWrapper, user), ShouldBeTrue)
+
+		requestWrapper.Res = ResourceMyTwoFactor
+		So(isForbiddenWhileImpersonating(requestWrapper, user), ShouldBeTrue)
+
+		requestWrapper.Res = "/users/userid"
+		requestWrapper.Message.Command = "delete"
+		So(isForbiddenWhileImpersonating(requestWrapper, user), ShouldBeTrue)
+
+		requestWrapper.Message.Command = "get"
+		So(isForbiddenWhileImpersonating(requestWrapper, user), ShouldBeFalse)
+
+		// the credentials of the user cannot be changed
+		requestWrapper.Message.Command = "put"
+		for _, field := range []string{"email", "username", "google"} {
+			requestWrapper.Res = "/users/userid"
+			requestWrapper.Message.Body = map[string]interface{}{field: "value"}
+			So(isForbiddenWhileImpersonating(requestWrapper, user), ShouldBeTrue)
+
+			requestWrapper.Res = "/users/me"
+			So(isForbiddenWhileImpersonating(requestWrapper, user), ShouldBeTrue)
+		}
+
+		requestWrapper.Message.Body = map[string]interface{}{"nickname": "johny"}
+		So(isForbiddenWhileImpersonating(requestWrapper, user), ShouldBeFalse)
+
+		requestWrapper.Res = "/posts"
+		requestWrapper.Message.Command = "post"
+		So(isForbiddenWhileImpersonating(requestWrapper, user), ShouldBeFalse)
+	})
+
+	Convey("Should record the requests that are made while impersonating", t, func() {
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Command = "POST"
+		requestWrapper.Message.Res = "/posts"
+
+		RecordImpersonatedRequest(map[string]interface{}{"_id": "userid", "impersonatedBy": "adminid"}, requestWrapper, 0)
+		entry := auditLogs[len(auditLogs) - 1]
+		So(entry["action"], ShouldEqual, "impersonatedRequest")
+		So(entry["adminId"], ShouldEqual, "adminid")
+		So(entry["command"], ShouldEqual, "post")
+		So(entry["status"], ShouldEqual, http.StatusOK)
+	})
+
+	queryRoles = originalQueryRoles
+	getSession = originalGetSession
+}
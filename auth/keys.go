@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"time"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"crypto/rsa"
+	"crypto/ecdsa"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+)
+
+type signingKey struct {
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// keys that are used for verifying tokens, by their ids
+var signingKeys = make(map[string]signingKey)
+
+// id of the key that is used for signing new tokens
+var currentSigningKeyId string
+
+const defaultTokenLifetime = time.Hour
+
+var tokenLifetime = defaultTokenLifetime
+
+var LoadSigningKeys = func(tokenConfig config.TokenConfig) (err *utils.Error) {
+
+	keys := make(map[string]signingKey)
+
+	for _, keyConfig := range tokenConfig.Keys {
+		if keyConfig.Kid == "" {
+			err = &utils.Error{http.StatusInternalServerError, "All token keys must have a 'kid'."}
+			return
+		}
+		if _, exists := keys[keyConfig.Kid]; exists {
+			err = &utils.Error{http.StatusInternalServerError, "Token key '" + keyConfig.Kid + "' is defined more than once."}
+			return
+		}
+
+		var key signingKey
+		key, err = parseSigningKey(keyConfig)
+		if err != nil {
+			return
+		}
+		keys[keyConfig.Kid] = key
+	}
+
+	currentKey, hasCurrentKey := keys[tokenConfig.SigningKey]
+	if !hasCurrentKey {
+		err = &utils.Error{http.StatusInternalServerError, "Token 'signingKey' must be one of the token keys in configuration file."}
+		return
+	}
+	if currentKey.signKey == nil {
+		err = &utils.Error{http.StatusInternalServerError, "Token key '" + tokenConfig.SigningKey + "' cannot sign tokens without a private key."}
+		return
+	}
+
+	if tokenConfig.Lifetime < 0 || tokenConfig.RefreshLifetime < 0 || tokenConfig.ImpersonationLifetime < 0 {
+		err = &utils.Error{http.StatusInternalServerError, "Token lifetimes cannot be negative."}
+		return
+	}
+
+	signingKeys = keys
+	currentSigningKeyId = tokenConfig.SigningKey
+	tokenLifetime = defaultTokenLifetime
+	if tokenConfig.Lifetime > 0 {
+		tokenLifetime = time.Duration(tokenConfig.Lifetime) * time.Second
+	}
+	refreshTokenLifetime = defaultRefreshTokenLifetime
+	if tokenConfig.RefreshLifetime > 0 {
+		refreshTokenLifetime = time.Duration(tokenConfig.RefreshLifetime) * time.Second
+	}
+	impersonationTokenLifetime = defaultImpersonationTokenLifetime
+	if tokenConfig.ImpersonationLifetime > 0 {
+		impersonationTokenLifetime = time.Duration(tokenConfig.ImpersonationLifetime) * time.Second
+	}
+	return
+}
+
+func parseSigningKey(keyConfig config.SigningKey) (key signingKey, err *utils.Error) {
+
+	key.method = jwt.GetSigningMethod(keyConfig.Algorithm)
+	if key.method == nil {
+		err = &utils.Error{http.StatusInternalServerError, "Algorithm of token key '" + keyConfig.Kid + "' is not supported."}
+		return
+	}
+
+	if strings.HasPrefix(keyConfig.Algorithm, "HS") {
+		if keyConfig.Secret == "" {
+			err = &utils.Error{http.StatusInternalServerError, "Token key '" + keyConfig.Kid + "' must have a 'secret'."}
+			return
+		}
+		key.signKey = []byte(keyConfig.Secret)
+		key.verifyKey = []byte(keyConfig.Secret)
+		return
+	}
+
+	privateKeyPem, readErr := readKey(keyConfig.PrivateKey, keyConfig.PrivateKeyFile)
+	if readErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Reading private key of token key '" + keyConfig.Kid + "' failed."}
+		return
+	}
+	publicKeyPem, readErr := readKey(keyConfig.PublicKey, keyConfig.PublicKeyFile)
+	if readErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Reading public key of token key '" + keyConfig.Kid + "' failed."}
+		return
+	}
+
+	var parseErr error
+	if strings.HasPrefix(keyConfig.Algorithm, "RS") || strings.HasPrefix(keyConfig.Algorithm, "PS") {
+		var privateKey *rsa.PrivateKey
+		if privateKeyPem != nil {
+			privateKey, parseErr = jwt.ParseRSAPrivateKeyFromPEM(privateKeyPem)
+			if parseErr == nil {
+				key.signKey = privateKey
+				key.verifyKey = &privateKey.PublicKey
+			}
+		} else if publicKeyPem != nil {
+			key.verifyKey, parseErr = jwt.ParseRSAPublicKeyFromPEM(publicKeyPem)
+		}
+	} else if strings.HasPrefix(keyConfig.Algorithm, "ES") {
+		var privateKey *ecdsa.PrivateKey
+		if privateKeyPem != nil {
+			privateKey, parseErr = jwt.ParseECPrivateKeyFromPEM(privateKeyPem)
+			if parseErr == nil {
+				key.signKey = privateKey
+				key.verifyKey = &privateKey.PublicKey
+			}
+		} else if publicKeyPem != nil {
+			key.verifyKey, parseErr = jwt.ParseECPublicKeyFromPEM(publicKeyPem)
+		}
+	}
+
+	if parseErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Parsing token key '" + keyConfig.Kid + "' failed."}
+		return
+	}
+
+	if key.verifyKey == nil {
+		err = &utils.Error{http.StatusInternalServerError, "Token key '" + keyConfig.Kid + "' must have a private or public key."}
+	}
+	return
+}
+
+// returns the key from the configuration or reads it from the file. returns nil if none of them is given.
+func readKey(key, keyFile string) (keyPem []byte, err error) {
+
+	if key != "" {
+		keyPem = []byte(key)
+	} else if keyFile != "" {
+		keyPem, err = ioutil.ReadFile(keyFile)
+	}
+	return
+}
+
+// signs a token that is used only for the given purpose, like verifying emails. these tokens are not access tokens.
+func signPurposeToken(purpose string, claims map[string]interface{}, lifetime time.Duration) (tokenString string, err *utils.Error) {
+
+	key, hasKey := signingKeys[currentSigningKeyId]
+	if !hasKey {
+		err = &utils.Error{http.StatusInternalServerError, "Token signing key is not loaded."}
+		return
+	}
+
+	token := jwt.New(key.method)
+	token.Header["kid"] = currentSigningKeyId
+	for k, v := range claims {
+		token.Claims[k] = v
+	}
+	token.Claims["purpose"] = purpose
+	token.Claims["exp"] = time.Now().Add(lifetime).Unix()
+
+	var signErr error
+	tokenString, signErr = token.SignedString(key.signKey)
+	if signErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Generating token failed."}
+	}
+	return
+}
+
+// verifies the token and returns its claims if it is signed for the given purpose
+func parsePurposeToken(tokenString, purpose string) (claims map[string]interface{}, err *utils.Error) {
+
+	token, tokenErr := jwt.Parse(tokenString, getVerificationKey)
+	if tokenErr != nil || !token.Valid || token.Claims["purpose"] != purpose {
+		err = &utils.Error{http.StatusBadRequest, "Token is not valid or expired."}
+		return
+	}
+	claims = token.Claims
+	return
+}
+
+// finds the key of the token by its 'kid' header
+func getVerificationKey(token *jwt.Token) (verifyKey interface{}, err error) {
+
+	kid, _ := token.Header["kid"].(string)
+	key, hasKey := signingKeys[kid]
+	if !hasKey {
+		err = &utils.Error{http.StatusUnauthorized, "Token key is not known."}
+		return
+	}
+
+	// tokens must be signed with the algorithm of the key
+	if token.Method.Alg() != key.method.Alg() {
+		err = &utils.Error{http.StatusUnauthorized, "Token algorithm doesn't match."}
+		return
+	}
+
+	verifyKey = key.verifyKey
+	return
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/config"
+	"github.com/eluleci/dock/utils"
+	"github.com/dgrijalva/jwt-go"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"time"
+)
+
+// other tests replace generateToken with mocks
+var realGenerateToken = generateToken
+
+func TestLoadSigningKeys(t *testing.T) {
+
+	originalGetSession := getSession
+	getSession = func(sessionId string) (session map[string]interface{}, err *utils.Error) {
+		session = map[string]interface{}{"_id": sessionId, "userId": "userid", "lastUsedAt": time.Now().Unix()}
+		return
+	}
+
+	Convey("Should fail when signing key is not defined", t, func() {
+
+		err := LoadSigningKeys(config.TokenConfig{
+			SigningKey: "key2",
+			Keys: []config.SigningKey{{Kid: "key1", Algorithm: "HS256", Secret: "secret1"}},
+		})
+		So(err.Code, ShouldEqual, http.StatusInternalServerError)
+
+		err = LoadSigningKeys(config.TokenConfig{})
+		So(err.Code, ShouldEqual, http.StatusInternalServerError)
+	})
+
+	Convey("Should fail for invalid keys", t, func() {
+
+		err := LoadSigningKeys(config.TokenConfig{
+			SigningKey: "key1",
+			Keys: []config.SigningKey{{Kid: "key1", Algorithm: "HS256"}},
+		})
+		So(err.Code, ShouldEqual, http.StatusInternalServerError)
+
+		err = LoadSigningKeys(config.TokenConfig{
+			SigningKey: "key1",
+			Keys: []config.SigningKey{{Kid: "key1", Algorithm: "RS256", PrivateKey: "notapemkey"}},
+		})
+		So(err.Code, ShouldEqual, http.StatusInternalServerError)
+
+		err = LoadSigningKeys(config.TokenConfig{
+			SigningKey: "key1",
+			Keys: []config.SigningKey{{Kid: "key1", Algorithm: "none"}},
+		})
+		So(err.Code, ShouldEqual, http.StatusInternalServerError)
+	})
+
+	Convey("Should sign and verify tokens with the configured lifetime", t, func() {
+
+		err := LoadSigningKeys(config.TokenConfig{
+			Lifetime: 60,
+			SigningKey: "key1",
+			Keys: []config.SigningKey{{Kid: "key1", Algorithm: "HS256", Secret: "secret1"}},
+		})
+		So(err, ShouldBeNil)
+
+		tokenString, err := realGenerateToken("userid", "sessionid", map[string]interface{}{"email": "email@domain.com"})
+		So(err, ShouldBeNil)
+
+		userData, err := verifyToken(tokenString)
+		So(err, ShouldBeNil)
+		So(userData["userId"], ShouldEqual, "userid")
+
+		token, _ := jwt.Parse(tokenString, getVerificationKey)
+		So(token.Header["kid"], ShouldEqual, "key1")
+		So(token.Claims["exp"], ShouldBeLessThanOrEqualTo, time.Now().Add(time.Minute).Unix())
+	})
+
+	Convey("Should verify tokens of the old keys after rotation", t, func() {
+
+		privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+		privateKeyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+
+		oldKey := config.SigningKey{Kid: "key1", Algorithm: "HS256", Secret: "secret1"}
+		newKey := config.SigningKey{Kid: "key2", Algorithm: "RS256", PrivateKey: string(privateKeyPem)}
+
+		LoadSigningKeys(config.TokenConfig{SigningKey: "key1", Keys: []config.SigningKey{oldKey}})
+		oldToken, _ := realGenerateToken("userid", "sessionid", map[string]interface{}{})
+
+		err := LoadSigningKeys(config.TokenConfig{SigningKey: "key2", Keys: []config.SigningKey{oldKey, newKey}})
+		So(err, ShouldBeNil)
+		newToken, _ := realGenerateToken("userid", "sessionid", map[string]interface{}{})
+
+		_, err = verifyToken(oldToken)
+		So(err, ShouldBeNil)
+		_, err = verifyToken(newToken)
+		So(err, ShouldBeNil)
+
+		// removing the old key invalidates its tokens
+		LoadSigningKeys(config.TokenConfig{SigningKey: "key2", Keys: []config.SigningKey{newKey}})
+		_, err = verifyToken(oldToken)
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+		_, err = verifyToken(newToken)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Should reject tokens that are signed with another algorithm", t, func() {
+
+		LoadSigningKeys(config.TokenConfig{
+			SigningKey: "key1",
+			Keys: []config.SigningKey{{Kid: "key1", Algorithm: "HS256", Secret: "secret1"}},
+		})
+
+		token := jwt.New(jwt.SigningMethodHS512)
+		token.Header["kid"] = "key1"
+		token.Claims["user"] = map[string]interface{}{"userId": "userid"}
+		tokenString, _ := token.SignedString([]byte("secret1"))
+
+		_, err := verifyToken(tokenString)
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+	})
+
+	getSession = originalGetSession
+}
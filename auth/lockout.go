@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"sync"
+	"time"
+	"math"
+	"strings"
+	"strconv"
+	"net/http"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"github.com/eluleci/dock/messages"
+)
+
+const (
+	defaultLockoutMaxAttempts = 5
+	defaultLockoutMaxAddressAttempts = 50
+	defaultLockoutWindow = 15 * time.Minute
+	defaultLockoutDuration = time.Minute
+	defaultLockoutMaxDuration = time.Hour
+)
+
+// failed password attempts of the accounts and of the ip addresses
+var accountFailures = newFailureCounter()
+var addressFailures = newFailureCounter()
+
+type failureRecord struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// counts the failed attempts of keys and locks them out with exponential back-off
+type failureCounter struct {
+	sync.Mutex
+	records map[string]*failureRecord
+}
+
+func newFailureCounter() *failureCounter {
+	return &failureCounter{records: make(map[string]*failureRecord)}
+}
+
+// returns how long the key is locked for. zero if it is not locked.
+func (c *failureCounter) lockedFor(key string) time.Duration {
+
+	c.Lock()
+	defer c.Unlock()
+
+	record, hasRecord := c.records[key]
+	if !hasRecord {
+		return 0
+	}
+	if remaining := record.lockedUntil.Sub(time.Now()); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// records a failed attempt. every attempt after the limit doubles the lockout duration.
+func (c *failureCounter) fail(key string, maxAttempts int) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	lockoutConfig := config.SystemConfig.Lockout
+	window := secondsOrDefault(lockoutConfig.Window, defaultLockoutWindow)
+	now := time.Now()
+
+	if len(c.records) > rateLimiterSweepSize {
+		for k, record := range c.records {
+			if now.Sub(record.lastFailure) > window && now.After(record.lockedUntil) {
+				delete(c.records, k)
+			}
+		}
+	}
+
+	record, hasRecord := c.records[key]
+	if !hasRecord || (now.Sub(record.lastFailure) > window && now.After(record.lockedUntil)) {
+		record = &failureRecord{}
+		c.records[key] = record
+	}
+	record.count++
+	record.lastFailure = now
+
+	if record.count < maxAttempts {
+		return
+	}
+
+	duration := secondsOrDefault(lockoutConfig.Duration, defaultLockoutDuration)
+	maxDuration := secondsOrDefault(lockoutConfig.MaxDuration, defaultLockoutMaxDuration)
+	duration = time.Duration(float64(duration) * math.Pow(2, float64(record.count - maxAttempts)))
+	if duration > maxDuration || duration <= 0 {
+		duration = maxDuration
+	}
+	record.lockedUntil = now.Add(duration)
+}
+
+func (c *failureCounter) reset(key string) {
+
+	c.Lock()
+	defer c.Unlock()
+	delete(c.records, key)
+}
+
+// returns the response of the requests that are locked out, if the account or the ip address is locked
+func checkLockout(requestWrapper messages.RequestWrapper, accountKeys []string) (response messages.Message, err *utils.Error) {
+
+	lockedFor := addressFailures.lockedFor(requestWrapper.Message.RemoteAddr)
+	for _, accountKey := range accountKeys {
+		if accountLockedFor := accountFailures.lockedFor(accountKey); accountLockedFor > lockedFor {
+			lockedFor = accountLockedFor
+		}
+	}
+
+	if lockedFor > 0 {
+		response, err = tooManyRequests(lockedFor, "Too many failed attempts. Try again later.")
+	}
+	return
+}
+
+// counts a failed password attempt for the accounts and for the ip address of the request
+func recordFailedAttempt(requestWrapper messages.RequestWrapper, accountKeys []string) {
+
+	lockoutConfig := config.SystemConfig.Lockout
+
+	maxAttempts := lockoutConfig.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultLockoutMaxAttempts
+	}
+	for _, accountKey := range accountKeys {
+		accountFailures.fail(accountKey, maxAttempts)
+	}
+
+	maxAddressAttempts := lockoutConfig.MaxAddressAttempts
+	if maxAddressAttempts <= 0 {
+		maxAddressAttempts = defaultLockoutMaxAddressAttempts
+	}
+	if requestWrapper.Message.RemoteAddr != "" {
+		addressFailures.fail(requestWrapper.Message.RemoteAddr, maxAddressAttempts)
+	}
+}
+
+// unlocks the accounts. failures of the ip address are not cleared by a successful attempt
+func clearFailedAttempts(accountKeys []string) {
+
+	for _, accountKey := range accountKeys {
+		accountFailures.reset(accountKey)
+	}
+}
+
+// returns the keys that the failed attempts of the user are counted with
+func getAccountKeys(user map[string]interface{}) (accountKeys []string) {
+
+	if username, isString := user["username"].(string); isString && username != "" {
+		accountKeys = append(accountKeys, "username:" + strings.ToLower(username))
+	}
+	if email, isString := user["email"].(string); isString && email != "" {
+		accountKeys = append(accountKeys, "email:" + strings.ToLower(email))
+	}
+	return
+}
+
+// returns the key of the account that a login request is made for. it doesn't depend on whether the account exists.
+func getLoginAccountKey(body map[string]interface{}) string {
+
+	if username, isString := body["username"].(string); isString && username != "" {
+		return "username:" + strings.ToLower(username)
+	}
+	email, _ := body["email"].(string)
+	return "email:" + strings.ToLower(email)
+}
+
+func tooManyRequests(retryAfter time.Duration, message string) (response messages.Message, err *utils.Error) {
+
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	response.Headers = map[string][]string{"Retry-After": []string{strconv.Itoa(seconds)}}
+	err = &utils.Error{http.StatusTooManyRequests, message}
+	return
+}
+
+func secondsOrDefault(seconds int, defaultDuration time.Duration) time.Duration {
+
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultDuration
+}
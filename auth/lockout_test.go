@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"net/http"
+	"time"
+)
+
+func makeLoginRequest(email, password, remoteAddr string) (requestWrapper messages.RequestWrapper) {
+
+	requestWrapper.Message.Body = map[string]interface{}{"email": email, "password": password}
+	requestWrapper.Message.RemoteAddr = remoteAddr
+	return
+}
+
+func TestFailureCounter(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+
+	Convey("Should lock the key after the limit and double the lockout on each failure", t, func() {
+
+		counter := newFailureCounter()
+		counter.fail("key", 3)
+		counter.fail("key", 3)
+		So(counter.lockedFor("key"), ShouldEqual, 0)
+
+		counter.fail("key", 3)
+		So(counter.lockedFor("key"), ShouldBeBetween, 59 * time.Second, time.Minute + time.Second)
+
+		counter.fail("key", 3)
+		So(counter.lockedFor("key"), ShouldBeBetween, 119 * time.Second, 2 * time.Minute + time.Second)
+
+		counter.reset("key")
+		So(counter.lockedFor("key"), ShouldEqual, 0)
+	})
+
+	Convey("Should not lock longer than the max duration", t, func() {
+
+		config.SystemConfig.Lockout = config.LockoutConfig{Duration: 60, MaxDuration: 90}
+
+		counter := newFailureCounter()
+		for i := 0; i < 10; i++ {
+			counter.fail("key", 1)
+		}
+		So(counter.lockedFor("key"), ShouldBeBetween, 89 * time.Second, 90 * time.Second + time.Second)
+
+		config.SystemConfig.Lockout = config.LockoutConfig{}
+	})
+}
+
+func TestLoginLockout(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+	config.SystemConfig.Lockout = config.LockoutConfig{MaxAttempts: 3, MaxAddressAttempts: 5}
+
+	originalGetAccountData := getAccountData
+	originalStartSession := startSession
+
+	getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
+		if requestWrapper.Message.Body["email"] != "johny@bravo.com" {
+			err = &utils.Error{http.StatusNotFound, "Account not found."}
+			return
+		}
+		// hash of 'zuhaha'
+		accountData = map[string]interface{}{
+			"_id": "userid",
+			"password": "$2a$10$wqvcYHiRvoCy5ZUurNz9wuokDH1DyXjfd8k6Hk4DSJKui76gx1yrO",
+		}
+		return
+	}
+	startSession = func(requestWrapper messages.RequestWrapper, userId string, userData map[string]interface{}) (accessToken, refreshToken string, err *utils.Error) {
+		return "accesstoken", "refreshtoken", nil
+	}
+
+	Convey("Should lock the account after failed attempts even with the correct password", t, func() {
+
+		accountFailures = newFailureCounter()
+		addressFailures = newFailureCounter()
+
+		for i := 0; i < 3; i++ {
+			response, _ := HandleLogin(makeLoginRequest("johny@bravo.com", "wrong", "1.1.1.1"), nil)
+			So(response.Status, ShouldEqual, http.StatusUnauthorized)
+		}
+
+		response, err := HandleLogin(makeLoginRequest("Johny@bravo.com", "zuhaha", "2.2.2.2"), nil)
+		So(err.Code, ShouldEqual, http.StatusTooManyRequests)
+		So(response.Headers["Retry-After"], ShouldResemble, []string{"60"})
+
+		response, err = HandleLogin(makeLoginRequest("someone@bravo.com", "zuhaha", "1.1.1.1"), nil)
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("Should lock the accounts that don't exist in the same way", t, func() {
+
+		accountFailures = newFailureCounter()
+		addressFailures = newFailureCounter()
+
+		for i := 0; i < 3; i++ {
+			HandleLogin(makeLoginRequest("nobody@bravo.com", "wrong", "1.1.1.1"), nil)
+		}
+
+		_, err := HandleLogin(makeLoginRequest("nobody@bravo.com", "wrong", "2.2.2.2"), nil)
+		So(err.Code, ShouldEqual, http.StatusTooManyRequests)
+	})
+
+	Convey("Should lock the ip address after failed attempts on different accounts", t, func() {
+
+		accountFailures = newFailureCounter()
+		addressFailures = newFailureCounter()
+
+		for _, email := range []string{"a@bravo.com", "b@bravo.com", "c@bravo.com", "d@bravo.com", "e@bravo.com"} {
+			HandleLogin(makeLoginRequest(email, "wrong", "1.1.1.1"), nil)
+		}
+
+		_, err := HandleLogin(makeLoginRequest("johny@bravo.com", "zuhaha", "1.1.1.1"), nil)
+		So(err.Code, ShouldEqual, http.StatusTooManyRequests)
+
+		response, err := HandleLogin(makeLoginRequest("johny@bravo.com", "zuhaha", "2.2.2.2"), nil)
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusOK)
+	})
+
+	Convey("Should clear the failed attempts of the account after a successful login", t, func() {
+
+		accountFailures = newFailureCounter()
+		addressFailures = newFailureCounter()
+
+		HandleLogin(makeLoginRequest("johny@bravo.com", "wrong", "1.1.1.1"), nil)
+		HandleLogin(makeLoginRequest("johny@bravo.com", "wrong", "1.1.1.1"), nil)
+		HandleLogin(makeLoginRequest("johny@bravo.com", "zuhaha", "1.1.1.1"), nil)
+		HandleLogin(makeLoginRequest("johny@bravo.com", "wrong", "1.1.1.1"), nil)
+
+		response, err := HandleLogin(makeLoginRequest("johny@bravo.com", "zuhaha", "1.1.1.1"), nil)
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusOK)
+	})
+
+	accountFailures = newFailureCounter()
+	addressFailures = newFailureCounter()
+	getAccountData = originalGetAccountData
+	startSession = originalStartSession
+	config.SystemConfig = config.Config{}
+}
+
+func TestChangePasswordLockout(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+	config.SystemConfig.Lockout = config.LockoutConfig{MaxAttempts: 2}
+
+	Convey("Should lock the account after failed attempts with the existing password", t, func() {
+
+		accountFailures = newFailureCounter()
+		addressFailures = newFailureCounter()
+
+		user := map[string]interface{}{
+			"_id": "userid",
+			"email": "johny@bravo.com",
+			"password": "$2a$10$wqvcYHiRvoCy5ZUurNz9wuokDH1DyXjfd8k6Hk4DSJKui76gx1yrO",
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"password": "wrong", "newPassword": "newpassword"}
+
+		_, err := HandleChangePassword(requestWrapper, nil, user)
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+		_, err = HandleChangePassword(requestWrapper, nil, user)
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+
+		requestWrapper.Message.Body["password"] = "zuhaha"
+		response, err := HandleChangePassword(requestWrapper, nil, user)
+		So(err.Code, ShouldEqual, http.StatusTooManyRequests)
+		So(response.Headers["Retry-After"], ShouldNotBeEmpty)
+
+		// the login of the same account is locked too
+		_, err = HandleLogin(makeLoginRequest("johny@bravo.com", "zuhaha", "1.1.1.1"), nil)
+		So(err.Code, ShouldEqual, http.StatusTooManyRequests)
+	})
+
+	accountFailures = newFailureCounter()
+	addressFailures = newFailureCounter()
+	config.SystemConfig = config.Config{}
+}
+
+func TestResetPasswordLockout(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+	config.SystemConfig.ResetPassword = map[string]string{"link": "https://myapp.com/resetpassword?token="}
+	config.SystemConfig.Lockout = config.LockoutConfig{MaxAttempts: 1, MaxAddressAttempts: 2}
+
+	originalGetAccountData := getAccountData
+	originalSendResetPasswordLink := sendResetPasswordLink
+
+	getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
+		err = &utils.Error{http.StatusNotFound, "Account not found."}
+		return
+	}
+	sendResetPasswordLink = func(userId, email string) (err *utils.Error) {
+		return
+	}
+
+	Convey("Should allow locked accounts to request a reset link", t, func() {
+
+		accountFailures = newFailureCounter()
+		addressFailures = newFailureCounter()
+		resetPasswordEmailLimiter = newRateLimiter(3, time.Hour)
+		resetPasswordAddressLimiter = newRateLimiter(20, time.Hour)
+
+		accountFailures.fail("email:johny@bravo.com", 1)
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"email": "johny@bravo.com"}
+		requestWrapper.Message.RemoteAddr = "1.1.1.1"
+
+		response, err := HandleResetPassword(requestWrapper, nil)
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusOK)
+	})
+
+	Convey("Should not allow locked ip addresses to request a reset link", t, func() {
+
+		accountFailures = newFailureCounter()
+		addressFailures = newFailureCounter()
+
+		addressFailures.fail("1.1.1.1", 1)
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"email": "johny@bravo.com"}
+		requestWrapper.Message.RemoteAddr = "1.1.1.1"
+
+		response, err := HandleResetPassword(requestWrapper, nil)
+		So(err.Code, ShouldEqual, http.StatusTooManyRequests)
+		So(response.Headers["Retry-After"], ShouldNotBeEmpty)
+	})
+
+	Convey("Should return when to retry if the reset password requests are limited", t, func() {
+
+		addressFailures = newFailureCounter()
+		resetPasswordEmailLimiter = newRateLimiter(1, time.Hour)
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"email": "johny@bravo.com"}
+		requestWrapper.Message.RemoteAddr = "1.1.1.1"
+
+		HandleResetPassword(requestWrapper, nil)
+		requestWrapper.Message.Body = map[string]interface{}{"email": "johny@bravo.com"}
+		response, err := HandleResetPassword(requestWrapper, nil)
+		So(err.Code, ShouldEqual, http.StatusTooManyRequests)
+		So(response.Headers["Retry-After"], ShouldResemble, []string{"3600"})
+	})
+
+	resetPasswordEmailLimiter = newRateLimiter(3, time.Hour)
+	resetPasswordAddressLimiter = newRateLimiter(20, time.Hour)
+	accountFailures = newFailureCounter()
+	addressFailures = newFailureCounter()
+	getAccountData = originalGetAccountData
+	sendResetPasswordLink = originalSendResetPasswordLink
+	config.SystemConfig = config.Config{}
+}
@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"sync"
+	"time"
+	"errors"
+	"math/big"
+	"net/http"
+	"io/ioutil"
+	"crypto/rsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/json"
+	"encoding/base64"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+)
+
+const (
+	defaultJwksCacheLifetime = time.Hour
+	// key sets are fetched at most once in this interval, also when the fetch fails or the key id is unknown
+	jwksRefetchInterval = time.Minute
+)
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	keys      map[string]interface{}
+	expiresAt time.Time
+}
+
+// key sets of the providers and the times they are last fetched by their urls
+var jwksCache = make(map[string]*jsonWebKeySet)
+var jwksFetchedAt = make(map[string]time.Time)
+var jwksCacheLock sync.Mutex
+
+// provider that verifies the id tokens of an OpenID Connect provider in the configuration
+type oidcProvider struct {
+	config config.OidcProviderConfig
+}
+
+func (p oidcProvider) Authenticate(credentials map[string]interface{}) (providerUserId string, profile map[string]interface{}, err *utils.Error) {
+
+	idToken, _ := credentials["idToken"].(string)
+	nonce, _ := credentials["nonce"].(string)
+	if idToken == "" {
+		err = &utils.Error{http.StatusBadRequest, "Provider data must contain id token."}
+		return
+	}
+
+	var claims map[string]interface{}
+	claims, err = verifyIdToken(p.config, idToken, nonce)
+	if err != nil {
+		return
+	}
+
+	// only the verified data of the token is stored
+	providerUserId = claims["sub"].(string)
+	profile = map[string]interface{}{"issuer": claims["iss"]}
+	if email, hasEmail := claims["email"].(string); hasEmail {
+		profile["email"] = email
+		profile["emailVerified"] = claims["email_verified"] == true || claims["email_verified"] == "true"
+	}
+	return
+}
+
+// verifies the signature of the id token with the keys of the provider, and its issuer, audience, expiry and nonce
+func verifyIdToken(providerConfig config.OidcProviderConfig, idToken, nonce string) (claims map[string]interface{}, err *utils.Error) {
+
+	if providerConfig.Issuer == "" || providerConfig.JwksUrl == "" || len(providerConfig.ClientIds) == 0 {
+		err = &utils.Error{http.StatusInternalServerError, "OpenID Connect provider must have issuer, client ids and jwks url in configuration."}
+		return
+	}
+
+	token, parseErr := jwt.Parse(idToken, func(token *jwt.Token) (key interface{}, keyErr error) {
+
+		// the algorithms with shared secrets are never accepted for id tokens
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			keyErr = errors.New("Signing method is not accepted.")
+			return
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		key, keyErr = getJwksKey(providerConfig.JwksUrl, kid)
+		return
+	})
+	if parseErr != nil || !token.Valid {
+		err = &utils.Error{http.StatusBadRequest, "Id token is not valid."}
+		return
+	}
+	claims = token.Claims
+
+	// expiry is checked while parsing if it exists, but it is required for id tokens
+	if _, hasExpiry := claims["exp"].(float64); !hasExpiry {
+		err = &utils.Error{http.StatusBadRequest, "Id token is not valid."}
+		return
+	}
+
+	if claims["iss"] != providerConfig.Issuer {
+		err = &utils.Error{http.StatusBadRequest, "Id token is not issued by the provider."}
+		return
+	}
+
+	if subject, _ := claims["sub"].(string); subject == "" {
+		err = &utils.Error{http.StatusBadRequest, "Id token doesn't have a subject."}
+		return
+	}
+
+	audiences, isValidAudience := getAudiences(claims["aud"])
+	if !isValidAudience || !containsAny(audiences, providerConfig.ClientIds) {
+		err = &utils.Error{http.StatusBadRequest, "Id token is not issued for this app."}
+		return
+	}
+
+	// the authorized party is the client that the token is issued to when there are multiple audiences
+	if authorizedParty, hasAuthorizedParty := claims["azp"].(string); hasAuthorizedParty && len(audiences) > 1 &&
+	!containsAny([]string{authorizedParty}, providerConfig.ClientIds) {
+		err = &utils.Error{http.StatusBadRequest, "Id token is not issued for this app."}
+		return
+	}
+
+	tokenNonce, _ := claims["nonce"].(string)
+	if (nonce != "" || providerConfig.RequireNonce) && (tokenNonce == "" || tokenNonce != nonce) {
+		err = &utils.Error{http.StatusBadRequest, "Nonce of the id token doesn't match."}
+		return
+	}
+	return
+}
+
+// returns the key of the key set. the key set is fetched again if it expires or if it doesn't contain the key. the
+// lock is not held while fetching, so a slow provider doesn't block the logins with the other providers.
+func getJwksKey(jwksUrl, kid string) (key interface{}, err error) {
+
+	now := time.Now()
+	jwksCacheLock.Lock()
+	keySet, isCached := jwksCache[jwksUrl]
+	if isCached && now.Before(keySet.expiresAt) {
+		if key, hasKey := keySet.keys[kid]; hasKey {
+			jwksCacheLock.Unlock()
+			return key, nil
+		}
+	}
+
+	// the time is recorded before fetching, so the failed fetches and the concurrent requests don't fetch again
+	canFetch := now.Sub(jwksFetchedAt[jwksUrl]) >= jwksRefetchInterval
+	if canFetch {
+		jwksFetchedAt[jwksUrl] = now
+	}
+	jwksCacheLock.Unlock()
+
+	if !canFetch {
+		return nil, errors.New("Key is not known.")
+	}
+
+	keySet, err = fetchJwks(jwksUrl)
+	if err != nil {
+		return
+	}
+	jwksCacheLock.Lock()
+	jwksCache[jwksUrl] = keySet
+	jwksCacheLock.Unlock()
+
+	key, hasKey := keySet.keys[kid]
+	if !hasKey {
+		err = errors.New("Key is not known.")
+	}
+	return
+}
+
+func fetchJwks(jwksUrl string) (keySet *jsonWebKeySet, err error) {
+
+	jwksResponse, getErr := httpClient.Get(jwksUrl)
+	if getErr != nil {
+		return nil, getErr
+	}
+	defer jwksResponse.Body.Close()
+	if jwksResponse.StatusCode != http.StatusOK {
+		return nil, errors.New("Fetching keys failed.")
+	}
+
+	data, readErr := ioutil.ReadAll(jwksResponse.Body)
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if parseErr := json.Unmarshal(data, &document); parseErr != nil {
+		return nil, parseErr
+	}
+
+	keySet = &jsonWebKeySet{
+		keys: make(map[string]interface{}),
+		expiresAt: time.Now().Add(defaultJwksCacheLifetime),
+	}
+	for _, webKey := range document.Keys {
+		if webKey.Use != "" && webKey.Use != "sig" {
+			continue
+		}
+		// keys that cannot be parsed are skipped so that the others can be used
+		if publicKey, keyErr := parseJsonWebKey(webKey); keyErr == nil {
+			keySet.keys[webKey.Kid] = publicKey
+		}
+	}
+	return
+}
+
+func parseJsonWebKey(webKey jsonWebKey) (publicKey interface{}, err error) {
+
+	switch webKey.Kty {
+	case "RSA":
+		n, nErr := decodeBigInt(webKey.N)
+		e, eErr := decodeBigInt(webKey.E)
+		if nErr != nil || eErr != nil || !e.IsInt64() {
+			return nil, errors.New("RSA key is not valid.")
+		}
+		publicKey = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch webKey.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("Curve is not supported.")
+		}
+		x, xErr := decodeBigInt(webKey.X)
+		y, yErr := decodeBigInt(webKey.Y)
+		if xErr != nil || yErr != nil || !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC key is not valid.")
+		}
+		publicKey = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	default:
+		err = errors.New("Key type is not supported.")
+	}
+	return
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+
+	bytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bytes), nil
+}
+
+// audience of a token is a string or an array of strings
+func getAudiences(aud interface{}) (audiences []string, isValid bool) {
+
+	if audience, isString := aud.(string); isString {
+		return []string{audience}, true
+	}
+	return toStringArray(aud)
+}
+
+func containsAny(values []string, accepted []string) bool {
+
+	for _, value := range values {
+		for _, acceptedValue := range accepted {
+			if value == acceptedValue {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,375 @@
+package auth
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"github.com/dgrijalva/jwt-go"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/json"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// getAccountData is mocked by the other tests
+var realGetAccountData = getAccountData
+
+// serves the public keys of an identity provider and counts the requests
+type testIdentityProvider struct {
+	server      *httptest.Server
+	rsaKey      *rsa.PrivateKey
+	ecKey       *ecdsa.PrivateKey
+	fetchCount  int
+}
+
+func newTestIdentityProvider() (provider *testIdentityProvider) {
+
+	provider = &testIdentityProvider{}
+	provider.rsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	provider.ecKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	provider.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provider.fetchCount++
+		encode := func(value *big.Int) string {
+			return base64.RawURLEncoding.EncodeToString(value.Bytes())
+		}
+		keys := map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsakey", "use": "sig", "n": encode(provider.rsaKey.N), "e": encode(big.NewInt(int64(provider.rsaKey.E)))},
+			{"kty": "EC", "kid": "eckey", "crv": "P-256", "x": encode(provider.ecKey.X), "y": encode(provider.ecKey.Y)},
+			{"kty": "oct", "kid": "secretkey", "k": "c2VjcmV0"},
+		}}
+		json.NewEncoder(w).Encode(keys)
+	}))
+	return
+}
+
+func (p *testIdentityProvider) config() config.OidcProviderConfig {
+	return config.OidcProviderConfig{
+		Issuer: "https://id.myapp.com",
+		ClientIds: []string{"webclient", "mobileclient"},
+		JwksUrl: p.server.URL + "/keys",
+	}
+}
+
+func (p *testIdentityProvider) claims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss": "https://id.myapp.com",
+		"aud": "mobileclient",
+		"sub": "subjectid",
+		"email": "johny@bravo.com",
+		"email_verified": true,
+		"nonce": "somenonce",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func (p *testIdentityProvider) sign(method jwt.SigningMethod, kid string, claims map[string]interface{}) string {
+
+	token := jwt.New(method)
+	token.Header["kid"] = kid
+	for k, v := range claims {
+		token.Claims[k] = v
+	}
+
+	var key interface{} = p.rsaKey
+	if _, isEC := method.(*jwt.SigningMethodECDSA); isEC {
+		key = p.ecKey
+	} else if _, isHMAC := method.(*jwt.SigningMethodHMAC); isHMAC {
+		key = []byte("secret")
+	}
+	tokenString, _ := token.SignedString(key)
+	return tokenString
+}
+
+func TestVerifyIdToken(t *testing.T) {
+
+	originalHttpClient := httpClient
+	httpClient = &http.Client{Timeout: providerRequestTimeout}
+
+	provider := newTestIdentityProvider()
+	defer provider.server.Close()
+
+	Convey("Should verify RSA and EC signed tokens with the keys of the provider", t, func() {
+
+		claims, err := verifyIdToken(provider.config(), provider.sign(jwt.SigningMethodRS256, "rsakey", provider.claims()), "somenonce")
+		So(err, ShouldBeNil)
+		So(claims["sub"], ShouldEqual, "subjectid")
+
+		_, err = verifyIdToken(provider.config(), provider.sign(jwt.SigningMethodES256, "eckey", provider.claims()), "somenonce")
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Should cache the keys of the provider", t, func() {
+
+		jwksCache = make(map[string]*jsonWebKeySet)
+		jwksFetchedAt = make(map[string]time.Time)
+		provider.fetchCount = 0
+
+		verifyIdToken(provider.config(), provider.sign(jwt.SigningMethodRS256, "rsakey", provider.claims()), "somenonce")
+		verifyIdToken(provider.config(), provider.sign(jwt.SigningMethodES256, "eckey", provider.claims()), "somenonce")
+		So(provider.fetchCount, ShouldEqual, 1)
+
+		// unknown keys don't cause a fetch on every request
+		verifyIdToken(provider.config(), provider.sign(jwt.SigningMethodRS256, "newkey", provider.claims()), "somenonce")
+		verifyIdToken(provider.config(), provider.sign(jwt.SigningMethodRS256, "newkey", provider.claims()), "somenonce")
+		So(provider.fetchCount, ShouldEqual, 1)
+
+		jwksFetchedAt[provider.config().JwksUrl] = time.Now().Add(-time.Hour)
+		verifyIdToken(provider.config(), provider.sign(jwt.SigningMethodRS256, "newkey", provider.claims()), "somenonce")
+		So(provider.fetchCount, ShouldEqual, 2)
+	})
+
+	Convey("Should not fetch the keys again on every request when the fetch fails or returns no keys", t, func() {
+
+		var fetchCount int
+		failingProvider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fetchCount++
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer failingProvider.Close()
+
+		for i := 0; i < 3; i++ {
+			_, err := getJwksKey(failingProvider.URL, "somekey")
+			So(err, ShouldNotBeNil)
+		}
+		So(fetchCount, ShouldEqual, 1)
+
+		fetchCount = 0
+		emptyProvider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fetchCount++
+			w.Write([]byte(`{"keys":[]}`))
+		}))
+		defer emptyProvider.Close()
+
+		for i := 0; i < 3; i++ {
+			_, err := getJwksKey(emptyProvider.URL, "somekey")
+			So(err, ShouldNotBeNil)
+		}
+		So(fetchCount, ShouldEqual, 1)
+
+		// expired key sets are fetched again after the interval
+		jwksCache[emptyProvider.URL].expiresAt = time.Now().Add(-time.Second)
+		getJwksKey(emptyProvider.URL, "somekey")
+		So(fetchCount, ShouldEqual, 1)
+
+		jwksFetchedAt[emptyProvider.URL] = time.Now().Add(-time.Hour)
+		getJwksKey(emptyProvider.URL, "somekey")
+		So(fetchCount, ShouldEqual, 2)
+	})
+
+	Convey("Should reject the tokens that are signed with other keys or algorithms", t, func() {
+
+		otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+		token := jwt.New(jwt.SigningMethodRS256)
+		token.Header["kid"] = "rsakey"
+		for k, v := range provider.claims() {
+			token.Claims[k] = v
+		}
+		forged, _ := token.SignedString(otherKey)
+
+		_, err := verifyIdToken(provider.config(), forged, "somenonce")
+		So(err, ShouldNotBeNil)
+
+		_, err = verifyIdToken(provider.config(), provider.sign(jwt.SigningMethodHS256, "secretkey", provider.claims()), "somenonce")
+		So(err, ShouldNotBeNil)
+
+		_, err = verifyIdToken(provider.config(), provider.sign(jwt.SigningMethodES256, "rsakey", provider.claims()), "somenonce")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should check issuer, audience, expiry and nonce", t, func() {
+
+		invalidClaims := []map[string]interface{}{
+			{"iss": "https://other.com"},
+			{"aud": "otherclient"},
+			{"aud": []interface{}{"otherclient", "thirdclient"}},
+			{"aud": []interface{}{"mobileclient", "otherclient"}, "azp": "otherclient"},
+			{"exp": time.Now().Add(-time.Minute).Unix()},
+			{"exp": nil},
+			{"sub": ""},
+			{"nonce": "othernonce"},
+		}
+
+		for _, invalid := range invalidClaims {
+			claims := provider.claims()
+			for k, v := range invalid {
+				if v == nil {
+					delete(claims, k)
+				} else {
+					claims[k] = v
+				}
+			}
+			_, err := verifyIdToken(provider.config(), provider.sign(jwt.SigningMethodRS256, "rsakey", claims), "somenonce")
+			So(err, ShouldNotBeNil)
+		}
+
+		claims := provider.claims()
+		claims["aud"] = []interface{}{"webclient", "otherclient"}
+		claims["azp"] = "webclient"
+		_, err := verifyIdToken(provider.config(), provider.sign(jwt.SigningMethodRS256, "rsakey", claims), "somenonce")
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Should require nonce if it is configured", t, func() {
+
+		claims := provider.claims()
+		delete(claims, "nonce")
+		idToken := provider.sign(jwt.SigningMethodRS256, "rsakey", claims)
+
+		_, err := verifyIdToken(provider.config(), idToken, "")
+		So(err, ShouldBeNil)
+
+		providerConfig := provider.config()
+		providerConfig.RequireNonce = true
+		_, err = verifyIdToken(providerConfig, idToken, "")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should not block the other providers while fetching the keys of a slow provider", t, func() {
+
+		jwksCache = make(map[string]*jsonWebKeySet)
+		jwksFetchedAt = make(map[string]time.Time)
+		_, err := verifyIdToken(provider.config(), provider.sign(jwt.SigningMethodRS256, "rsakey", provider.claims()), "somenonce")
+		So(err, ShouldBeNil)
+
+		released := make(chan bool)
+		slowProvider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-released
+		}))
+		defer slowProvider.Close()
+		defer close(released)
+		httpClient = &http.Client{Timeout: 500 * time.Millisecond}
+
+		fetched := make(chan error)
+		go func() {
+			_, fetchErr := getJwksKey(slowProvider.URL, "somekey")
+			fetched <- fetchErr
+		}()
+
+		// waiting for the slow fetch to start
+		time.Sleep(50 * time.Millisecond)
+		startedAt := time.Now()
+		_, err = verifyIdToken(provider.config(), provider.sign(jwt.SigningMethodRS256, "rsakey", provider.claims()), "somenonce")
+		So(err, ShouldBeNil)
+		So(time.Since(startedAt), ShouldBeLessThan, 200 * time.Millisecond)
+
+		So(<-fetched, ShouldNotBeNil)
+		httpClient = &http.Client{Timeout: providerRequestTimeout}
+	})
+
+	jwksCache = make(map[string]*jsonWebKeySet)
+	jwksFetchedAt = make(map[string]time.Time)
+	httpClient = originalHttpClient
+}
+
+func TestOidcRegistration(t *testing.T) {
+
+	originalHttpClient := httpClient
+	originalGetAccountData := getAccountData
+	originalStartSession := startSession
+	httpClient = &http.Client{Timeout: providerRequestTimeout}
+
+	provider := newTestIdentityProvider()
+	defer provider.server.Close()
+
+	config.SystemConfig = config.Config{}
+	config.SystemConfig.Oidc = map[string]config.OidcProviderConfig{"myid": provider.config()}
+
+	startSession = func(requestWrapper messages.RequestWrapper, userId string, userData map[string]interface{}) (accessToken, refreshToken string, err *utils.Error) {
+		return "accesstoken", "refreshtoken", nil
+	}
+
+	Convey("Should create the user with the verified data of the token", t, func() {
+
+		var queriedWhere string
+		adapters.Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
+			queriedWhere = parameters["where"][0]
+			response = map[string]interface{}{"data": make([]map[string]interface{}, 0)}
+			return
+		}
+		getAccountData = realGetAccountData
+
+		var createdUser map[string]interface{}
+		adapters.Create = func(collection string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			createdUser = data
+			response = map[string]interface{}{"_id": "userid"}
+			return
+		}
+		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Parameters = make(map[string][]string)
+		requestWrapper.Message.Body = map[string]interface{}{
+			"myid": map[string]interface{}{
+				"idToken": provider.sign(jwt.SigningMethodRS256, "rsakey", provider.claims()),
+				"nonce": "somenonce",
+				"id": "someoneelse",
+			},
+			"emailVerified": true,
+		}
+
+		response, _, err := HandleSignUp(requestWrapper, &adapters.MongoAdapter{})
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusCreated)
+		So(response.Body["isNewUser"], ShouldBeTrue)
+		So(response.Body["accessToken"], ShouldEqual, "accesstoken")
+		So(queriedWhere, ShouldContainSubstring, "myid.id")
+		So(queriedWhere, ShouldContainSubstring, "subjectid")
+		So(createdUser["myid"], ShouldResemble, map[string]interface{}{
+			"id": "subjectid",
+			"issuer": "https://id.myapp.com",
+			"email": "johny@bravo.com",
+			"emailVerified": true,
+		})
+		So(createdUser["emailVerified"], ShouldBeNil)
+	})
+
+	Convey("Should login the existing user", t, func() {
+
+		getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
+			accountData = map[string]interface{}{"_id": "userid"}
+			return
+		}
+		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{
+			"myid": map[string]interface{}{"idToken": provider.sign(jwt.SigningMethodES256, "eckey", provider.claims()), "nonce": "somenonce"},
+		}
+
+		response, _, err := HandleSignUp(requestWrapper, &adapters.MongoAdapter{})
+		So(err, ShouldBeNil)
+		So(response.Body["isNewUser"], ShouldBeFalse)
+	})
+
+	Convey("Should return error for invalid tokens", t, func() {
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{
+			"myid": map[string]interface{}{"idToken": provider.sign(jwt.SigningMethodRS256, "rsakey", provider.claims()), "nonce": "othernonce"},
+		}
+
+		_, _, err := HandleSignUp(requestWrapper, &adapters.MongoAdapter{})
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+	})
+
+	jwksCache = make(map[string]*jsonWebKeySet)
+	jwksFetchedAt = make(map[string]time.Time)
+	httpClient = originalHttpClient
+	getAccountData = originalGetAccountData
+	startSession = originalStartSession
+	config.SystemConfig = config.Config{}
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"strings"
+	"unicode"
+	"net/http"
+	"unicode/utf8"
+	"strconv"
+	"golang.org/x/crypto/bcrypt"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"github.com/eluleci/dock/adapters"
+)
+
+const defaultPasswordMinLength = 8
+
+// most common passwords that are never accepted
+var commonPasswords = []string{
+	"123456", "123456789", "12345678", "1234567890", "12345", "1234567", "111111", "123123", "000000", "654321",
+	"password", "password1", "password123", "passw0rd", "qwerty", "qwerty123", "qwertyuiop", "1q2w3e4r", "1qaz2wsx",
+	"abc123", "abcd1234", "iloveyou", "admin", "admin123", "welcome", "welcome1", "letmein", "monkey", "dragon",
+	"football", "baseball", "sunshine", "princess", "master", "shadow", "superman", "trustno1", "whatever",
+	"starwars", "michael", "computer", "internet", "asdfghjkl", "zaq12wsx", "changeme", "secret", "login",
+}
+
+// returns the reasons that the password doesn't meet the password policy for. user can be nil.
+var checkPasswordPolicy = func(password string, user map[string]interface{}) (reasons []string) {
+
+	policy := config.SystemConfig.Password
+
+	minLength := policy.MinLength
+	if minLength <= 0 {
+		minLength = defaultPasswordMinLength
+	}
+	if utf8.RuneCountInString(password) < minLength {
+		reasons = append(reasons, "Password must be at least " + strconv.Itoa(minLength) + " characters long.")
+	}
+
+	var hasLower, hasUpper, hasDigit, hasSymbol bool
+	for _, character := range password {
+		switch {
+		case unicode.IsLower(character):
+			hasLower = true
+		case unicode.IsUpper(character):
+			hasUpper = true
+		case unicode.IsDigit(character):
+			hasDigit = true
+		case unicode.IsPunct(character) || unicode.IsSymbol(character) || unicode.IsSpace(character):
+			hasSymbol = true
+		}
+	}
+	if policy.RequireLowercase && !hasLower {
+		reasons = append(reasons, "Password must contain a lowercase letter.")
+	}
+	if policy.RequireUppercase && !hasUpper {
+		reasons = append(reasons, "Password must contain an uppercase letter.")
+	}
+	if policy.RequireDigit && !hasDigit {
+		reasons = append(reasons, "Password must contain a digit.")
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		reasons = append(reasons, "Password must contain a symbol.")
+	}
+
+	if isDeniedPassword(password, policy.Denylist) {
+		reasons = append(reasons, "Password is too common.")
+	}
+
+	for _, field := range []string{"username", "email"} {
+		if value, isString := user[field].(string); isString && value != "" && strings.EqualFold(value, password) {
+			reasons = append(reasons, "Password must not be the same as the " + field + ".")
+		}
+	}
+	return
+}
+
+// returns the body and the error of the responses to the passwords that don't meet the password policy
+func passwordPolicyError(reasons []string) (body map[string]interface{}, err *utils.Error) {
+
+	err = &utils.Error{http.StatusUnprocessableEntity, "Password doesn't meet the requirements."}
+	body = map[string]interface{}{"message": err.Message, "reasons": reasons}
+	return
+}
+
+func isDeniedPassword(password string, denylist []string) bool {
+
+	for _, list := range [][]string{commonPasswords, denylist} {
+		for _, denied := range list {
+			if strings.EqualFold(denied, password) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hashes the password with the configured cost
+var hashPassword = func(password string) (hash string, err *utils.Error) {
+
+	hashed, hashErr := bcrypt.GenerateFromPassword([]byte(password), getHashCost())
+	if hashErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Hashing password failed."}
+		return
+	}
+	hash = string(hashed)
+	return
+}
+
+// hashes the password again if it is hashed with a lower cost than the configured one. the password must be verified
+// before.
+func rehashPasswordIfNeeded(userId, hash, password string) {
+
+	cost, costErr := bcrypt.Cost([]byte(hash))
+	if costErr != nil || cost >= getHashCost() {
+		return
+	}
+
+	newHash, err := hashPassword(password)
+	if err == nil {
+		_, _, err = adapters.Update(ClassUsers, userId, map[string]interface{}{"password": newHash})
+	}
+	if err != nil {
+		utils.Log("error", "Rehashing password failed: " + err.Message)
+	}
+}
+
+// checks the password configuration when the server starts. bcrypt fails to hash with a cost out of its range, which
+// would break the sign ups and the password changes.
+var CheckPasswordConfig = func(passwordConfig config.PasswordConfig) (err *utils.Error) {
+
+	cost := passwordConfig.HashCost
+	if cost != 0 && (cost < bcrypt.MinCost || cost > bcrypt.MaxCost) {
+		err = &utils.Error{http.StatusInternalServerError, "Password 'hashCost' must be between " +
+		strconv.Itoa(bcrypt.MinCost) + " and " + strconv.Itoa(bcrypt.MaxCost) + "."}
+	}
+	return
+}
+
+func getHashCost() int {
+
+	if cost := config.SystemConfig.Password.HashCost; cost > 0 {
+		return cost
+	}
+	return bcrypt.DefaultCost
+}
@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+)
+
+func TestCheckPasswordPolicy(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+
+	Convey("Should apply the default rules", t, func() {
+
+		So(checkPasswordPolicy("", nil), ShouldHaveLength, 1)
+		So(checkPasswordPolicy("short", nil), ShouldHaveLength, 1)
+		So(checkPasswordPolicy("Password1", nil), ShouldResemble, []string{"Password is too common."})
+		So(checkPasswordPolicy("ihaveamazinghair", nil), ShouldBeEmpty)
+		So(checkPasswordPolicy("şifreşifre", nil), ShouldBeEmpty)
+	})
+
+	Convey("Should not accept the username or the email as the password", t, func() {
+
+		user := map[string]interface{}{"username": "JohnyBravo", "email": "johny@bravo.com"}
+		So(checkPasswordPolicy("johnybravo", user), ShouldResemble, []string{"Password must not be the same as the username."})
+		So(checkPasswordPolicy("johny@bravo.com", user), ShouldResemble, []string{"Password must not be the same as the email."})
+	})
+
+	Convey("Should apply the configured rules", t, func() {
+
+		config.SystemConfig.Password = config.PasswordConfig{
+			MinLength: 4,
+			RequireLowercase: true,
+			RequireUppercase: true,
+			RequireDigit: true,
+			RequireSymbol: true,
+			Denylist: []string{"Dock2016!"},
+		}
+
+		So(checkPasswordPolicy("abcd", nil), ShouldHaveLength, 3)
+		So(checkPasswordPolicy("ABC1!", nil), ShouldResemble, []string{"Password must contain a lowercase letter."})
+		So(checkPasswordPolicy("dock2016!", nil), ShouldResemble, []string{"Password must contain an uppercase letter.", "Password is too common."})
+		So(checkPasswordPolicy("aB1!", nil), ShouldBeEmpty)
+
+		config.SystemConfig.Password = config.PasswordConfig{}
+	})
+}
+
+func TestPasswordPolicyErrors(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+	originalGetAccountData := getAccountData
+
+	Convey("Should return the reasons on sign up", t, func() {
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"email": "johny@bravo.com", "password": "qwerty"}
+
+		response, _, err := HandleSignUp(requestWrapper, &adapters.MongoAdapter{})
+		So(err.Code, ShouldEqual, http.StatusUnprocessableEntity)
+		So(response.Body["reasons"], ShouldResemble, []string{"Password must be at least 8 characters long.", "Password is too common."})
+	})
+
+	Convey("Should return the reasons on change password", t, func() {
+
+		accountFailures = newFailureCounter()
+		user := map[string]interface{}{
+			"_id": "userid",
+			"username": "johnybravo",
+			"password": "$2a$10$wqvcYHiRvoCy5ZUurNz9wuokDH1DyXjfd8k6Hk4DSJKui76gx1yrO",
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"password": "zuhaha", "newPassword": "JohnyBravo"}
+
+		response, err := HandleChangePassword(requestWrapper, &adapters.MongoAdapter{}, user)
+		So(err.Code, ShouldEqual, http.StatusUnprocessableEntity)
+		So(response.Body["reasons"], ShouldResemble, []string{"Password must not be the same as the username."})
+	})
+
+	Convey("Should not use the reset password token if the password is not accepted", t, func() {
+
+		var isQueried bool
+		adapters.Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
+			isQueried = true
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"token": "sometoken", "newPassword": "short"}
+
+		_, err := HandleResetPasswordConfirm(requestWrapper)
+		So(err.Code, ShouldEqual, http.StatusUnprocessableEntity)
+		So(isQueried, ShouldBeFalse)
+	})
+
+	getAccountData = originalGetAccountData
+}
+
+func TestHashCost(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+	originalGetAccountData := getAccountData
+	originalStartSession := startSession
+
+	Convey("Should hash with the configured cost", t, func() {
+
+		config.SystemConfig.Password.HashCost = 11
+		hash, err := hashPassword("ihaveamazinghair")
+		So(err, ShouldBeNil)
+
+		cost, _ := bcrypt.Cost([]byte(hash))
+		So(cost, ShouldEqual, 11)
+	})
+
+	Convey("Should reject the costs that bcrypt doesn't support", t, func() {
+
+		So(CheckPasswordConfig(config.PasswordConfig{}), ShouldBeNil)
+		So(CheckPasswordConfig(config.PasswordConfig{HashCost: 12}), ShouldBeNil)
+
+		err := CheckPasswordConfig(config.PasswordConfig{HashCost: 2})
+		So(err.Code, ShouldEqual, http.StatusInternalServerError)
+
+		err = CheckPasswordConfig(config.PasswordConfig{HashCost: 40})
+		So(err.Code, ShouldEqual, http.StatusInternalServerError)
+
+		err = CheckPasswordConfig(config.PasswordConfig{HashCost: -1})
+		So(err.Code, ShouldEqual, http.StatusInternalServerError)
+	})
+
+	Convey("Should rehash the password on login if the cost is raised", t, func() {
+
+		accountFailures = newFailureCounter()
+		config.SystemConfig.Password.HashCost = 11
+
+		getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
+			// hash of 'zuhaha' with cost 10
+			accountData = map[string]interface{}{
+				"_id": "userid",
+				"password": "$2a$10$wqvcYHiRvoCy5ZUurNz9wuokDH1DyXjfd8k6Hk4DSJKui76gx1yrO",
+			}
+			return
+		}
+		startSession = func(requestWrapper messages.RequestWrapper, userId string, userData map[string]interface{}) (accessToken, refreshToken string, err *utils.Error) {
+			return "accesstoken", "refreshtoken", nil
+		}
+
+		var updatedPassword string
+		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			updatedPassword, _ = data["password"].(string)
+			return
+		}
+
+		response, err := HandleLogin(makeLoginRequest("johny@bravo.com", "zuhaha", "1.1.1.1"), nil)
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusOK)
+
+		cost, _ := bcrypt.Cost([]byte(updatedPassword))
+		So(cost, ShouldEqual, 11)
+		So(bcrypt.CompareHashAndPassword([]byte(updatedPassword), []byte("zuhaha")), ShouldBeNil)
+
+		updatedPassword = ""
+		config.SystemConfig.Password.HashCost = 10
+		HandleLogin(makeLoginRequest("johny@bravo.com", "zuhaha", "1.1.1.1"), nil)
+		So(updatedPassword, ShouldBeEmpty)
+	})
+
+	accountFailures = newFailureCounter()
+	addressFailures = newFailureCounter()
+	getAccountData = originalGetAccountData
+	startSession = originalStartSession
+	config.SystemConfig = config.Config{}
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"time"
+	"strconv"
+	"net/url"
+	"net/http"
+	"encoding/json"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/mailer"
+)
+
+const defaultResetPasswordLinkLifetime = time.Hour
+
+// reset password requests that are allowed for an email and for an ip address in an hour
+var resetPasswordEmailLimiter = newRateLimiter(3, time.Hour)
+var resetPasswordAddressLimiter = newRateLimiter(20, time.Hour)
+
+// returns the reset password configuration if the required fields exist
+func getResetPasswordConfig() (resetPasswordConfig map[string]string, err *utils.Error) {
+
+	resetPasswordConfig = config.SystemConfig.ResetPassword
+	if resetPasswordConfig == nil {
+		err = &utils.Error{http.StatusInternalServerError, "Email reset configuration is not set in configuration file."}
+		return
+	}
+
+	if resetPasswordConfig["link"] == "" {
+		err = &utils.Error{http.StatusInternalServerError, "Email reset configuration must have a 'link'."}
+	}
+	return
+}
+
+// creates a single use reset password token for the user and sends it in a link. the older links of the user are
+// invalidated.
+var sendResetPasswordLink = func(userId, email string) (err *utils.Error) {
+
+	var resetPasswordConfig map[string]string
+	resetPasswordConfig, err = getResetPasswordConfig()
+	if err != nil {
+		return
+	}
+
+	lifetime := defaultResetPasswordLinkLifetime
+	if seconds, parseErr := strconv.Atoi(resetPasswordConfig["linkLifetime"]); parseErr == nil && seconds > 0 {
+		lifetime = time.Duration(seconds) * time.Second
+	}
+
+	var token string
+	token, err = generateRandomToken()
+	if err != nil {
+		return
+	}
+
+	err = adapters.DeleteAll(ClassPasswordResets, map[string]interface{}{"userId": userId})
+	if err != nil {
+		return
+	}
+
+	passwordReset := map[string]interface{}{
+		"userId": userId,
+		"token": hashToken(token),
+		"expiresAt": time.Now().Add(lifetime).Unix(),
+		// reset tokens are accessible only through the auth endpoints
+		"_acl": map[string]interface{}{},
+	}
+	_, _, err = adapters.Create(ClassPasswordResets, passwordReset)
+	if err != nil {
+		return
+	}
+
+	link := resetPasswordConfig["link"] + url.QueryEscape(token)
+	return mailer.SendTemplate(mailer.TemplateResetPassword, email, map[string]interface{}{"link": link, "email": email})
+}
+
+// finds the reset password request of the token and deletes all the reset password requests of its user
+var usePasswordResetToken = func(token string) (passwordReset map[string]interface{}, err *utils.Error) {
+
+	whereParams := map[string]interface{}{
+		"token": map[string]string{"$eq": hashToken(token)},
+	}
+	whereParamsJson, jsonErr := json.Marshal(whereParams)
+	if jsonErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Creating reset password request failed."}
+		return
+	}
+
+	parameters := map[string][]string{"where": []string{string(whereParamsJson)}}
+	results, fetchErr := adapters.Query(ClassPasswordResets, parameters, nil)
+	if fetchErr != nil {
+		err = fetchErr
+		return
+	}
+	passwordResets, _ := results["data"].([]map[string]interface{})
+	if len(passwordResets) == 0 {
+		err = &utils.Error{http.StatusBadRequest, "Token is not valid or expired."}
+		return
+	}
+	passwordReset = passwordResets[0]
+
+	// tokens are single use
+	err = adapters.DeleteAll(ClassPasswordResets, map[string]interface{}{"userId": passwordReset["userId"]})
+	if err != nil {
+		return
+	}
+
+	if toInt64(passwordReset["expiresAt"]) < time.Now().Unix() {
+		passwordReset = nil
+		err = &utils.Error{http.StatusBadRequest, "Token is not valid or expired."}
+	}
+	return
+}
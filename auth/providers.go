@@ -0,0 +1,432 @@
+package auth
+
+import (
+	"sort"
+	"sync"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+)
+
+// a platform that users can sign up and login with. clients send the credentials of the platform under the name of
+// the provider, like {"facebook": {"id": "...", "accessToken": "..."}}.
+type Provider interface {
+
+	// validates the credentials and returns the id of the user on the platform, and the data to save to the user
+	Authenticate(credentials map[string]interface{}) (providerUserId string, profile map[string]interface{}, err *utils.Error)
+}
+
+var facebookTokenVerificationEndpoint = "https://graph.facebook.com/debug_token"
+var googleTokenVerificationEndpoint = "https://www.googleapis.com/oauth2/v3/tokeninfo?id_token="
+
+var providers = map[string]Provider{
+	"facebook": facebookProvider{},
+	"google": googleProvider{},
+	ProviderAnonymous: anonymousProvider{},
+}
+var providersLock sync.RWMutex
+
+// adds the provider with the given name. the existing provider with the same name is replaced.
+func RegisterProvider(name string, provider Provider) {
+
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	providers[name] = provider
+}
+
+// returns the provider that the body contains credentials of. the OpenID Connect providers in the configuration are
+// checked first, so they replace the registered providers with the same name.
+func getProvider(body map[string]interface{}) (providerName string, provider Provider, hasProvider bool) {
+
+	for _, name := range sortedKeys(config.SystemConfig.Oidc) {
+		if _, hasData := body[name].(map[string]interface{}); hasData {
+			return name, oidcProvider{config.SystemConfig.Oidc[name]}, true
+		}
+	}
+
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, hasData := body[name].(map[string]interface{}); hasData {
+			return name, providers[name], true
+		}
+	}
+	return
+}
+
+// returns true if the field is the data of a registered provider
+func isProviderField(field string) bool {
+
+	if _, isOidcProvider := config.SystemConfig.Oidc[field]; isOidcProvider {
+		return true
+	}
+
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+	_, isProvider := providers[field]
+	return isProvider
+}
+
+// signs up the user of the provider, or logs in if the user already exists
+var handleProviderAuth = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter, providerName string, provider Provider) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+
+	err = authenticateWithProvider(requestWrapper, providerName, provider)
+	if err != nil {
+		return
+	}
+
+	existingAccount, _ := getAccountData(requestWrapper, dbAdapter)
+
+	if existingAccount == nil {
+		response, hookBody, err = createUser(requestWrapper.Message.Body)
+		if err == nil {
+			response["isNewUser"] = true
+		}
+	} else {
+		_, err = checkAccountStatus(existingAccount)
+		if err != nil {
+			return
+		}
+		refreshProviderData(existingAccount, providerName, requestWrapper.Message.Body[providerName])
+
+		// the account is returned like it is on login, without the password and the other hidden fields
+		delete(existingAccount, "password")
+		response = FilterFields(ClassUsers, existingAccount, existingAccount, nil)
+		response["isNewUser"] = false
+	}
+	return
+}
+
+// logs in the existing user of the provider
+var handleProviderLogin = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter, providerName string, provider Provider) (response messages.Message, err *utils.Error) {
+
+	err = authenticateWithProvider(requestWrapper, providerName, provider)
+	if err != nil {
+		return
+	}
+
+	accountData, getAccountErr := getAccountData(requestWrapper, dbAdapter)
+	if getAccountErr != nil {
+		err = getAccountErr
+		if getAccountErr.Code == http.StatusNotFound {
+			err = &utils.Error{http.StatusUnauthorized, "Account doesn't exist."}
+		}
+		return
+	}
+
+	response, err = checkAccountStatus(accountData)
+	if err != nil {
+		return
+	}
+
+	refreshProviderData(accountData, providerName, requestWrapper.Message.Body[providerName])
+
+	if isTwoFactorEnabled(accountData) {
+		response.Body, err = startTwoFactorChallenge(accountData["_id"].(string))
+		if err == nil {
+			response.Status = http.StatusOK
+		}
+		return
+	}
+
+	delete(accountData, "password")
+	response.Body = accountData
+
+	var accessToken, refreshToken string
+	accessToken, refreshToken, err = startSession(requestWrapper, accountData["_id"].(string), accountData)
+	if err == nil {
+		response.Body["accessToken"] = accessToken
+		response.Body["refreshToken"] = refreshToken
+		response.Status = http.StatusOK
+	}
+	return
+}
+
+// validates the credentials in the body and replaces them with the data that the provider returns
+func authenticateWithProvider(requestWrapper messages.RequestWrapper, providerName string, provider Provider) (err *utils.Error) {
+
+	credentials := requestWrapper.Message.Body[providerName].(map[string]interface{})
+
+	providerUserId, profile, err := provider.Authenticate(credentials)
+	if err != nil {
+		return
+	}
+	if providerUserId == "" {
+		err = &utils.Error{http.StatusInternalServerError, "Provider didn't return the id of the user."}
+		return
+	}
+
+	if profile == nil {
+		profile = make(map[string]interface{})
+	}
+	profile["id"] = providerUserId
+	requestWrapper.Message.Body[providerName] = profile
+	return
+}
+
+// saves the latest data of the provider, like the new access token, to the existing user
+func refreshProviderData(account map[string]interface{}, providerName string, providerData interface{}) {
+
+	account[providerName] = providerData
+	data := map[string]interface{}{providerName: providerData}
+	if _, _, updateErr := adapters.Update(ClassUsers, account["_id"].(string), data); updateErr != nil {
+		utils.Log("error", "Updating provider data of the user failed: " + updateErr.Message)
+	}
+}
+
+// returns the login methods of the user, which are the password and the linked providers
+var HandleListProviders = func(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	response.Body = map[string]interface{}{
+		"password": hasPasswordLogin(user),
+		"providers": getLinkedProviders(user),
+	}
+	response.Status = http.StatusOK
+	return
+}
+
+// links the account of a provider to the user. the account cannot be linked to another user at the same time.
+var HandleLinkProvider = func(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	providerName, provider, hasProvider := getProvider(requestWrapper.Message.Body)
+	if !hasProvider || providerName == ProviderAnonymous {
+		err = &utils.Error{http.StatusBadRequest, "Request must contain the data of a provider."}
+		return
+	}
+
+	err = authenticateWithProvider(requestWrapper, providerName, provider)
+	if err != nil {
+		return
+	}
+
+	// only the provider data is used for finding the existing account
+	var lookupRequest messages.RequestWrapper
+	lookupRequest.Message.Parameters = make(map[string][]string)
+	lookupRequest.Message.Body = map[string]interface{}{providerName: requestWrapper.Message.Body[providerName]}
+	existingAccount, _ := getAccountData(lookupRequest, nil)
+	if existingAccount != nil && existingAccount["_id"] != user["_id"] {
+		err = &utils.Error{http.StatusConflict, "Account of the provider is linked to another user."}
+		return
+	}
+
+	data := map[string]interface{}{providerName: requestWrapper.Message.Body[providerName]}
+	_, _, err = adapters.Update(ClassUsers, user["_id"].(string), data)
+	if err != nil {
+		return
+	}
+	user[providerName] = data[providerName]
+
+	response, err = HandleListProviders(requestWrapper, user)
+	return
+}
+
+// removes the provider from the user. the last login method of the user cannot be removed.
+var HandleUnlinkProvider = func(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	providerName := requestWrapper.Message.Res[strings.LastIndex(requestWrapper.Message.Res, "/") + 1:]
+
+	linkedProviders := getLinkedProviders(user)
+	if !containsAny([]string{providerName}, linkedProviders) {
+		err = &utils.Error{http.StatusNotFound, "Provider is not linked to the user."}
+		return
+	}
+
+	loginMethodCount := len(linkedProviders)
+	if hasPasswordLogin(user) {
+		loginMethodCount++
+	}
+	if loginMethodCount <= 1 {
+		err = &utils.Error{http.StatusConflict, "Last login method of the user cannot be removed."}
+		return
+	}
+
+	_, _, err = adapters.Update(ClassUsers, user["_id"].(string), map[string]interface{}{providerName: nil})
+	if err == nil {
+		response.Status = http.StatusNoContent
+	}
+	return
+}
+
+// returns the names of the known providers that the user has an account of
+func getLinkedProviders(user map[string]interface{}) (names []string) {
+
+	names = make([]string, 0)
+	for field, value := range user {
+		providerData, isMap := value.(map[string]interface{})
+		if !isMap {
+			continue
+		}
+		if id, _ := providerData["id"].(string); id == "" {
+			continue
+		}
+		if _, _, isProvider := getProvider(map[string]interface{}{field: providerData}); isProvider {
+			names = append(names, field)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func hasPasswordLogin(user map[string]interface{}) bool {
+	password, _ := user["password"].(string)
+	return password != ""
+}
+
+type facebookProvider struct{}
+
+func (facebookProvider) Authenticate(credentials map[string]interface{}) (providerUserId string, profile map[string]interface{}, err *utils.Error) {
+
+	userId, hasId := credentials["id"].(string)
+	accessToken, hasAccessToken := credentials["accessToken"].(string)
+
+	if !hasId || !hasAccessToken {
+		err = &utils.Error{http.StatusBadRequest, "Facebook data must contain id and access token."}
+		return
+	}
+
+	appFacebookAccessToken := config.SystemConfig.Facebook["appToken"]
+	if appFacebookAccessToken == "" {
+		err = &utils.Error{http.StatusInternalServerError, "Facebook information is not provided in server configuration."}
+		return
+	}
+
+	urlBuilder := []string{facebookTokenVerificationEndpoint, "?access_token=", appFacebookAccessToken, "&input_token=", accessToken}
+	verificationUrl := strings.Join(urlBuilder, "");
+
+	responseBody, err := getTokenInfo(verificationUrl)
+	if err != nil {
+		return
+	}
+
+	tokenInfoAsMap, hasTokenInfo := responseBody["data"].(map[string]interface{})
+	if !hasTokenInfo {
+		err = &utils.Error{http.StatusInternalServerError, "Unexpected token response from platform."}
+		return
+	}
+
+	tokensAppId, hasAppId := tokenInfoAsMap["app_id"].(string)
+	tokensUserId, hasUserId := tokenInfoAsMap["user_id"].(string)
+	isValid, hasIsValid := tokenInfoAsMap["is_valid"].(bool)
+	if !hasAppId || !hasUserId || !hasIsValid {
+		err = &utils.Error{http.StatusInternalServerError, "Unexpected response from Facebook while validating."}
+		return
+	}
+
+	if !strings.EqualFold(tokensAppId, config.SystemConfig.Facebook["appId"]) {
+		err = &utils.Error{http.StatusInternalServerError, "App id doesn't match to the token's app id."}
+		return
+	}
+
+	if !strings.EqualFold(tokensUserId, userId) {
+		err = &utils.Error{http.StatusBadRequest, "User id doesn't match to the token's user id."}
+		return
+	}
+
+	if !isValid {
+		err = &utils.Error{http.StatusBadRequest, "Token is not valid."}
+		return
+	}
+
+	providerUserId = userId
+	profile = credentials
+	return
+}
+
+type googleProvider struct{}
+
+func (googleProvider) Authenticate(credentials map[string]interface{}) (providerUserId string, profile map[string]interface{}, err *utils.Error) {
+
+	userId, hasId := credentials["id"].(string)
+	idToken, hasIdToken := credentials["idToken"].(string)
+
+	if !hasId || !hasIdToken {
+		err = &utils.Error{http.StatusBadRequest, "Google data must contain user id and id token."}
+		return
+	}
+
+	googleClientId := config.SystemConfig.Google["clientId"]
+	if googleClientId == "" {
+		err = &utils.Error{http.StatusInternalServerError, "Google information is not provided in server configuration."}
+		return
+	}
+
+	tokenInfoAsMap, err := getTokenInfo(googleTokenVerificationEndpoint + idToken)
+	if err != nil {
+		return
+	}
+
+	tokensClientId, hasClientId := tokenInfoAsMap["aud"].(string)
+	if !hasClientId {
+		err = &utils.Error{http.StatusInternalServerError, "Unexpected token response from platform."}
+		return
+	}
+
+	if !strings.EqualFold(tokensClientId, googleClientId) {
+		err = &utils.Error{http.StatusInternalServerError, "Client id doesn't match to the token's client id."}
+		return
+	}
+
+	// the user of the token is the verified one, the id in the request is only checked against it
+	tokensUserId, hasUserId := tokenInfoAsMap["sub"].(string)
+	if !hasUserId || tokensUserId == "" {
+		err = &utils.Error{http.StatusInternalServerError, "Unexpected token response from platform."}
+		return
+	}
+
+	if tokensUserId != userId {
+		err = &utils.Error{http.StatusBadRequest, "User id doesn't match to the token's user id."}
+		return
+	}
+
+	providerUserId = tokensUserId
+	profile = credentials
+	return
+}
+
+// fetches the information of a token from the verification endpoint of a platform
+func getTokenInfo(verificationUrl string) (tokenInfo map[string]interface{}, err *utils.Error) {
+
+	tokenResponse, verificationErr := httpClient.Get(verificationUrl)
+	if verificationErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Verifying token failed."}
+		return
+	}
+	defer tokenResponse.Body.Close()
+	if tokenResponse.StatusCode != http.StatusOK {
+		err = &utils.Error{http.StatusInternalServerError, "Verifying token failed."}
+		return
+	}
+
+	data, readErr := ioutil.ReadAll(tokenResponse.Body)
+	if readErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Reading token response failed."}
+		return
+	}
+
+	parseErr := json.Unmarshal(data, &tokenInfo)
+	if parseErr != nil || tokenInfo == nil {
+		err = &utils.Error{http.StatusInternalServerError, "Parsing token response failed."}
+	}
+	return
+}
+
+func sortedKeys(m map[string]config.OidcProviderConfig) (keys []string) {
+
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
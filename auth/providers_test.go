@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"net/http"
+)
+
+type testProvider struct{}
+
+func (testProvider) Authenticate(credentials map[string]interface{}) (providerUserId string, profile map[string]interface{}, err *utils.Error) {
+
+	if credentials["token"] != "validtoken" {
+		err = &utils.Error{http.StatusBadRequest, "Token is not valid."}
+		return
+	}
+	providerUserId = "provideruserid"
+	profile = map[string]interface{}{"name": "Johny"}
+	return
+}
+
+func makeTestProviderRequest(token string) (requestWrapper messages.RequestWrapper) {
+
+	requestWrapper.Message.Parameters = make(map[string][]string)
+	requestWrapper.Message.Body = map[string]interface{}{
+		"myprovider": map[string]interface{}{"token": token, "id": "someoneelse"},
+	}
+	return
+}
+
+func TestProviders(t *testing.T) {
+
+	originalGetAccountData := getAccountData
+	originalStartSession := startSession
+	config.SystemConfig = config.Config{}
+
+	RegisterProvider("myprovider", testProvider{})
+
+	startSession = func(requestWrapper messages.RequestWrapper, userId string, userData map[string]interface{}) (accessToken, refreshToken string, err *utils.Error) {
+		return "accesstoken", "refreshtoken", nil
+	}
+
+	Convey("Should find the provider that the body has credentials of", t, func() {
+
+		name, provider, hasProvider := getProvider(map[string]interface{}{"myprovider": map[string]interface{}{}})
+		So(hasProvider, ShouldBeTrue)
+		So(name, ShouldEqual, "myprovider")
+		So(provider, ShouldHaveSameTypeAs, testProvider{})
+
+		_, _, hasProvider = getProvider(map[string]interface{}{"myprovider": "notamap"})
+		So(hasProvider, ShouldBeFalse)
+
+		// configured OpenID Connect providers replace the registered ones
+		config.SystemConfig.Oidc = map[string]config.OidcProviderConfig{"myprovider": {}}
+		_, provider, _ = getProvider(map[string]interface{}{"myprovider": map[string]interface{}{}})
+		So(provider, ShouldHaveSameTypeAs, oidcProvider{})
+		config.SystemConfig.Oidc = nil
+	})
+
+	Convey("Should create the user with the data of the provider", t, func() {
+
+		var queriedWhere string
+		adapters.Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
+			queriedWhere = parameters["where"][0]
+			response = map[string]interface{}{"data": make([]map[string]interface{}, 0)}
+			return
+		}
+		getAccountData = realGetAccountData
+
+		var createdUser map[string]interface{}
+		adapters.Create = func(collection string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			createdUser = data
+			response = map[string]interface{}{"_id": "userid"}
+			return
+		}
+		var updatedData map[string]interface{}
+		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			updatedData = data
+			return
+		}
+
+		requestWrapper := makeTestProviderRequest("validtoken")
+		requestWrapper.Message.Body["_acl"] = map[string]interface{}{"*": map[string]interface{}{"update": true}}
+		response, _, err := HandleSignUp(requestWrapper, &adapters.MongoAdapter{})
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusCreated)
+		So(response.Body["isNewUser"], ShouldBeTrue)
+		So(queriedWhere, ShouldEqual, `{"myprovider.id":{"$eq":"provideruserid"}}`)
+		So(createdUser["myprovider"], ShouldResemble, map[string]interface{}{"id": "provideruserid", "name": "Johny"})
+
+		// the new user gets the permissions on itself only
+		So(updatedData["_acl"], ShouldResemble, map[string]interface{}{
+			"user:userid": map[string]bool{"get": true, "update": true, "delete": true},
+		})
+	})
+
+	Convey("Should return the existing user of the provider without the hidden fields", t, func() {
+
+		getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
+			accountData = map[string]interface{}{"_id": "userid", "username": "johny", "password": "hashedpassword"}
+			return
+		}
+		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			return
+		}
+
+		response, _, err := HandleSignUp(makeTestProviderRequest("validtoken"), &adapters.MongoAdapter{})
+		So(err, ShouldBeNil)
+		So(response.Body["isNewUser"], ShouldBeFalse)
+		So(response.Body["username"], ShouldEqual, "johny")
+		So(response.Body, ShouldNotContainKey, "password")
+		So(response.Body["accessToken"], ShouldEqual, "accesstoken")
+	})
+
+	Convey("Should return the error of the provider", t, func() {
+
+		_, _, err := HandleSignUp(makeTestProviderRequest("invalidtoken"), &adapters.MongoAdapter{})
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+
+		_, err = HandleLogin(makeTestProviderRequest("invalidtoken"), &adapters.MongoAdapter{})
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+	})
+
+	Convey("Should login the existing user of the provider", t, func() {
+
+		getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
+			accountData = map[string]interface{}{"_id": "userid"}
+			return
+		}
+
+		response, err := HandleLogin(makeTestProviderRequest("validtoken"), &adapters.MongoAdapter{})
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusOK)
+		So(response.Body["accessToken"], ShouldEqual, "accesstoken")
+	})
+
+	Convey("Should not create users on login", t, func() {
+
+		getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
+			err = &utils.Error{http.StatusNotFound, "Account not found."}
+			return
+		}
+
+		_, err := HandleLogin(makeTestProviderRequest("validtoken"), &adapters.MongoAdapter{})
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("Should link the provider to the user", t, func() {
+
+		getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
+			err = &utils.Error{http.StatusNotFound, "Account not found."}
+			return
+		}
+
+		var updatedData map[string]interface{}
+		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			updatedData = data
+			return
+		}
+
+		user := map[string]interface{}{"_id": "userid", "password": "hashedpassword"}
+		response, err := HandleLinkProvider(makeTestProviderRequest("validtoken"), user)
+		So(err, ShouldBeNil)
+		So(updatedData["myprovider"], ShouldResemble, map[string]interface{}{"id": "provideruserid", "name": "Johny"})
+		So(response.Body["providers"], ShouldResemble, []string{"myprovider"})
+		So(response.Body["password"], ShouldBeTrue)
+
+		_, err = HandleLinkProvider(makeTestProviderRequest("invalidtoken"), user)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"unknown": map[string]interface{}{}}
+		_, err = HandleLinkProvider(requestWrapper, user)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+	})
+
+	Convey("Should not link the provider account of another user", t, func() {
+
+		getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
+			accountData = map[string]interface{}{"_id": "otheruserid"}
+			return
+		}
+
+		_, err := HandleLinkProvider(makeTestProviderRequest("validtoken"), map[string]interface{}{"_id": "userid"})
+		So(err.Code, ShouldEqual, http.StatusConflict)
+	})
+
+	Convey("Should unlink the provider unless it is the last login method", t, func() {
+
+		var updatedData map[string]interface{}
+		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			updatedData = data
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Res = ResourceMyProviders + "/myprovider"
+
+		user := map[string]interface{}{"_id": "userid", "myprovider": map[string]interface{}{"id": "provideruserid"}}
+		_, err := HandleUnlinkProvider(requestWrapper, user)
+		So(err.Code, ShouldEqual, http.StatusConflict)
+		So(updatedData, ShouldBeNil)
+
+		user["facebook"] = map[string]interface{}{"id": "facebookuserid"}
+		response, err := HandleUnlinkProvider(requestWrapper, user)
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusNoContent)
+		So(updatedData, ShouldContainKey, "myprovider")
+		So(updatedData["myprovider"], ShouldBeNil)
+
+		requestWrapper.Message.Res = ResourceMyProviders + "/google"
+		_, err = HandleUnlinkProvider(requestWrapper, user)
+		So(err.Code, ShouldEqual, http.StatusNotFound)
+	})
+
+	Convey("Should not allow writing provider data directly", t, func() {
+
+		err := CheckWritableFields(ClassUsers, "", map[string]interface{}{"myprovider": map[string]interface{}{"id": "someid"}}, nil)
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+
+		err = CheckWritableFields("posts", "", map[string]interface{}{"myprovider": map[string]interface{}{"id": "someid"}}, nil)
+		So(err, ShouldBeNil)
+	})
+
+	providersLock.Lock()
+	delete(providers, "myprovider")
+	providersLock.Unlock()
+	getAccountData = originalGetAccountData
+	startSession = originalStartSession
+}
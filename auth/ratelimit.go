@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// keys are swept when the limiter holds more keys than this
+const rateLimiterSweepSize = 10000
+
+// counts the hits of keys, like email addresses or ip addresses, in a sliding window
+type rateLimiter struct {
+	sync.Mutex
+	limit  int
+	window time.Duration
+	hits   map[string][]time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, hits: make(map[string][]time.Time)}
+}
+
+// records a hit for the key. returns false if the key has already reached the limit in the window.
+func (l *rateLimiter) allow(key string) bool {
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if len(l.hits) > rateLimiterSweepSize {
+		for k, hits := range l.hits {
+			if len(hits) == 0 || now.Sub(hits[len(hits) - 1]) > l.window {
+				delete(l.hits, k)
+			}
+		}
+	}
+
+	hits := l.recentHits(key, now)
+	if len(hits) >= l.limit {
+		l.hits[key] = hits
+		return false
+	}
+	l.hits[key] = append(hits, now)
+	return true
+}
+
+func (l *rateLimiter) recentHits(key string, now time.Time) (hits []time.Time) {
+
+	for _, hit := range l.hits[key] {
+		if now.Sub(hit) < l.window {
+			hits = append(hits, hit)
+		}
+	}
+	return
+}
+
+// returns how long it takes until the key is allowed again
+func (l *rateLimiter) retryAfter(key string) time.Duration {
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	hits := l.recentHits(key, now)
+	if len(hits) < l.limit {
+		return 0
+	}
+	return l.window - now.Sub(hits[len(hits) - l.limit])
+}
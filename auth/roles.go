@@ -0,0 +1,335 @@
+package auth
+
+import (
+	"sort"
+	"regexp"
+	"strings"
+	"net/http"
+	"encoding/json"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+	"github.com/eluleci/dock/hooks"
+)
+
+var roleNamePattern = regexp.MustCompile(`^[0-9A-Za-z_\- ]+$`)
+
+// permissions that are used for a class when they are not given in the configuration file
+var defaultClassPermissions = map[string]map[string][]string{
+	ClassRoles: {
+		"create": {"role:admin"},
+	},
+	ClassSessions: {
+		"create": {},
+		"query": {},
+	},
+	ClassPasswordResets: {
+		"create": {},
+		"query": {},
+	},
+	ClassTwoFactor: {
+		"create": {},
+		"query": {},
+	},
+	ClassAuditLogs: {
+		"create": {},
+		"query": {},
+	},
+	hooks.ClassHookQueue: {
+		"create": {},
+		"query": {},
+	},
+	hooks.ClassHookDeadLetters: {
+		"create": {},
+		"query": {},
+	},
+}
+
+var HandleCreateRole = func(requestWrapper messages.RequestWrapper, user interface{}) (response messages.Message, hookBody map[string]interface{}, err *utils.Error) {
+
+	body := requestWrapper.Message.Body
+	if body == nil {
+		err = &utils.Error{http.StatusBadRequest, "Request body cannot be empty for create role requests."}
+		return
+	}
+
+	name, isString := body["name"].(string)
+	if !isString || !roleNamePattern.MatchString(name) {
+		err = &utils.Error{http.StatusBadRequest, "Role must have a 'name' that contains only letters, numbers, spaces, '-' and '_'."}
+		return
+	}
+
+	existingRoles, queryErr := queryRoles(map[string]interface{}{"name": map[string]string{"$eq": name}})
+	if queryErr != nil {
+		err = queryErr
+		return
+	}
+	if len(existingRoles) > 0 {
+		err = &utils.Error{http.StatusConflict, "Role with the same name already exists."}
+		return
+	}
+
+	users, isValid := toStringArray(body["users"])
+	if !isValid {
+		err = &utils.Error{http.StatusBadRequest, "Users of a role must be an array of user ids."}
+		return
+	}
+
+	childRoles, isValid := toStringArray(body["roles"])
+	if !isValid {
+		err = &utils.Error{http.StatusBadRequest, "Roles of a role must be an array of role names."}
+		return
+	}
+	err = checkChildRoles(name, childRoles)
+	if err != nil {
+		return
+	}
+
+	body["users"] = users
+	body["roles"] = childRoles
+
+	userAsMap, _ := user.(map[string]interface{})
+	ApplyDefaultAcl(ClassRoles, body, userAsMap)
+
+	response.Body, hookBody, err = adapters.Create(ClassRoles, body)
+	if err == nil {
+		response.Status = http.StatusCreated
+	}
+	return
+}
+
+var HandleUpdateRole = func(requestWrapper messages.RequestWrapper) (response messages.Message, hookBody map[string]interface{}, err *utils.Error) {
+
+	body := requestWrapper.Message.Body
+	if body == nil {
+		err = &utils.Error{http.StatusBadRequest, "Request body cannot be empty for update requests."}
+		return
+	}
+
+	if _, hasName := body["name"]; hasName {
+		err = &utils.Error{http.StatusBadRequest, "Name of a role cannot be changed."}
+		return
+	}
+	if _, hasUsers := body["users"]; hasUsers {
+		err = &utils.Error{http.StatusBadRequest, "Users of a role must be changed with 'addUsers' and 'removeUsers'."}
+		return
+	}
+	if _, hasRoles := body["roles"]; hasRoles {
+		err = &utils.Error{http.StatusBadRequest, "Roles of a role must be changed with 'addRoles' and 'removeRoles'."}
+		return
+	}
+
+	id := requestWrapper.Message.Res[strings.LastIndex(requestWrapper.Message.Res, "/") + 1:]
+
+	var role map[string]interface{}
+	role, err = adapters.Get(ClassRoles, id)
+	if err != nil {
+		return
+	}
+
+	users, _ := toStringArray(role["users"])
+	users, err = applyMembershipChange(users, body, "addUsers", "removeUsers")
+	if err != nil {
+		return
+	}
+
+	childRoles, _ := toStringArray(role["roles"])
+	addedRoles, _ := toStringArray(body["addRoles"])
+	err = checkChildRoles(role["name"].(string), addedRoles)
+	if err != nil {
+		return
+	}
+	childRoles, err = applyMembershipChange(childRoles, body, "addRoles", "removeRoles")
+	if err != nil {
+		return
+	}
+
+	data := make(map[string]interface{})
+	for k, v := range body {
+		data[k] = v
+	}
+	delete(data, "addUsers")
+	delete(data, "removeUsers")
+	delete(data, "addRoles")
+	delete(data, "removeRoles")
+	data["users"] = users
+	data["roles"] = childRoles
+
+	response.Body, hookBody, err = adapters.Update(ClassRoles, id, data)
+	return
+}
+
+// returns the names of the roles that the user is a member of, including the ones that are inherited through the
+// child roles. the roles in user's '_roles' field are taken as given.
+var getRoleMemberships = func(userId string, assignedRoles []string) (roleNames []string, err *utils.Error) {
+
+	knownRoles := make(map[string]bool)
+	var newRoles []string
+
+	for _, r := range assignedRoles {
+		if !knownRoles[r] {
+			knownRoles[r] = true
+			newRoles = append(newRoles, r)
+		}
+	}
+
+	var results []map[string]interface{}
+	results, err = queryRoles(map[string]interface{}{"users": map[string]interface{}{"$in": []string{userId}}})
+	if err != nil {
+		return
+	}
+
+	for {
+		for _, role := range results {
+			name, _ := role["name"].(string)
+			if name != "" && !knownRoles[name] {
+				knownRoles[name] = true
+				newRoles = append(newRoles, name)
+			}
+		}
+
+		if len(newRoles) == 0 {
+			break
+		}
+
+		// members of a child role get the permissions of the parent role
+		results, err = queryRoles(map[string]interface{}{"roles": map[string]interface{}{"$in": newRoles}})
+		if err != nil {
+			return
+		}
+		newRoles = nil
+	}
+
+	for name := range knownRoles {
+		roleNames = append(roleNames, name)
+	}
+	return
+}
+
+// returns the names of the roles in the list of the roles of a user, like 'admin' for 'role:admin'
+func GetRoleNames(roles []string) (names []string) {
+
+	names = make([]string, 0)
+	for _, role := range roles {
+		if strings.HasPrefix(role, "role:") {
+			names = append(names, strings.TrimPrefix(role, "role:"))
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+var queryRoles = func(where map[string]interface{}) (roles []map[string]interface{}, err *utils.Error) {
+
+	whereParamsJson, jsonErr := json.Marshal(where)
+	if jsonErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Creating roles request failed."}
+		return
+	}
+
+	parameters := map[string][]string{"where": []string{string(whereParamsJson)}}
+	results, fetchErr := adapters.Query(ClassRoles, parameters, nil)
+	if fetchErr != nil {
+		err = fetchErr
+		return
+	}
+
+	if results["data"] != nil {
+		roles = results["data"].([]map[string]interface{})
+	}
+	return
+}
+
+func checkChildRoles(roleName string, childRoles []string) (err *utils.Error) {
+
+	if len(childRoles) == 0 {
+		return
+	}
+
+	for _, r := range childRoles {
+		if r == roleName {
+			err = &utils.Error{http.StatusBadRequest, "A role cannot be a child of itself."}
+			return
+		}
+	}
+
+	existingRoles, queryErr := queryRoles(map[string]interface{}{"name": map[string]interface{}{"$in": childRoles}})
+	if queryErr != nil {
+		err = queryErr
+		return
+	}
+	if len(existingRoles) != len(uniqueStrings(childRoles)) {
+		err = &utils.Error{http.StatusBadRequest, "Child roles must be existing roles."}
+	}
+	return
+}
+
+func applyMembershipChange(members []string, body map[string]interface{}, addKey, removeKey string) (result []string, err *utils.Error) {
+
+	toAdd, isValid := toStringArray(body[addKey])
+	if !isValid {
+		err = &utils.Error{http.StatusBadRequest, "'" + addKey + "' must be an array of strings."}
+		return
+	}
+	toRemove, isValid := toStringArray(body[removeKey])
+	if !isValid {
+		err = &utils.Error{http.StatusBadRequest, "'" + removeKey + "' must be an array of strings."}
+		return
+	}
+
+	removed := make(map[string]bool)
+	for _, m := range toRemove {
+		removed[m] = true
+	}
+
+	result = make([]string, 0)
+	for _, m := range uniqueStrings(append(members, toAdd...)) {
+		if !removed[m] {
+			result = append(result, m)
+		}
+	}
+	return
+}
+
+func toStringArray(value interface{}) (result []string, isValid bool) {
+
+	result = make([]string, 0)
+	if value == nil {
+		isValid = true
+		return
+	}
+
+	var values []interface{}
+	switch v := value.(type) {
+	case []string:
+		result = append(result, v...)
+		isValid = true
+		return
+	case []interface{}:
+		values = v
+	default:
+		return
+	}
+
+	for _, v := range values {
+		s, isString := v.(string)
+		if !isString {
+			return
+		}
+		result = append(result, s)
+	}
+	isValid = true
+	return
+}
+
+func uniqueStrings(values []string) (result []string) {
+
+	seen := make(map[string]bool)
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return
+}
@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"net/http"
+	"sort"
+)
+
+func TestGetRoleMemberships(t *testing.T) {
+
+	originalQueryRoles := queryRoles
+
+	Convey("Should return direct and inherited roles", t, func() {
+
+		// 'admin' is a child role of 'moderator', 'moderator' is a child role of 'member'
+		queryRoles = func(where map[string]interface{}) (roles []map[string]interface{}, err *utils.Error) {
+			if _, isUserQuery := where["users"]; isUserQuery {
+				roles = []map[string]interface{}{{"name": "admin"}}
+				return
+			}
+			children := where["roles"].(map[string]interface{})["$in"].([]string)
+			for _, child := range children {
+				if child == "admin" {
+					roles = append(roles, map[string]interface{}{"name": "moderator"})
+				} else if child == "moderator" {
+					roles = append(roles, map[string]interface{}{"name": "member"})
+				} else if child == "legacy" {
+					// cyclic definition must not cause an infinite loop
+					roles = append(roles, map[string]interface{}{"name": "admin"})
+				}
+			}
+			return
+		}
+
+		roleNames, err := getRoleMemberships("userid", []string{"legacy"})
+		sort.Strings(roleNames)
+
+		So(err, ShouldBeNil)
+		So(roleNames, ShouldResemble, []string{"admin", "legacy", "member", "moderator"})
+	})
+
+	Convey("Should return error when querying roles fails", t, func() {
+
+		queryRoles = func(where map[string]interface{}) (roles []map[string]interface{}, err *utils.Error) {
+			err = &utils.Error{http.StatusInternalServerError, "Getting items failed."}
+			return
+		}
+
+		_, err := getRoleMemberships("userid", nil)
+		So(err.Code, ShouldEqual, http.StatusInternalServerError)
+	})
+
+	queryRoles = originalQueryRoles
+}
+
+func TestHandleCreateRole(t *testing.T) {
+
+	originalQueryRoles := queryRoles
+	user := map[string]interface{}{"_id": "564f1a28e63bce219e1cc745"}
+
+	Convey("Should return bad request for invalid name", t, func() {
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"name": "admin$"}
+
+		_, _, err := HandleCreateRole(requestWrapper, user)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+	})
+
+	Convey("Should return conflict", t, func() {
+
+		queryRoles = func(where map[string]interface{}) (roles []map[string]interface{}, err *utils.Error) {
+			roles = []map[string]interface{}{{"name": "admin"}}
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"name": "admin"}
+
+		_, _, err := HandleCreateRole(requestWrapper, user)
+		So(err.Code, ShouldEqual, http.StatusConflict)
+	})
+
+	Convey("Should create role with creator's acl", t, func() {
+
+		queryRoles = func(where map[string]interface{}) (roles []map[string]interface{}, err *utils.Error) {
+			return
+		}
+
+		var createdRole map[string]interface{}
+		adapters.Create = func(collection string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			createdRole = data
+			response = map[string]interface{}{"_id": "roleid"}
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{
+			"name": "moderator",
+			"users": []interface{}{"userid"},
+		}
+
+		response, _, err := HandleCreateRole(requestWrapper, user)
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusCreated)
+		So(createdRole["users"], ShouldResemble, []string{"userid"})
+		So(createdRole["_acl"], ShouldContainKey, "user:564f1a28e63bce219e1cc745")
+	})
+
+	queryRoles = originalQueryRoles
+}
+
+func TestHandleUpdateRole(t *testing.T) {
+
+	originalQueryRoles := queryRoles
+
+	Convey("Should not allow changing the name", t, func() {
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Res = "/roles/roleid"
+		requestWrapper.Message.Body = map[string]interface{}{"name": "superadmin"}
+
+		_, _, err := HandleUpdateRole(requestWrapper)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+	})
+
+	Convey("Should add and remove members", t, func() {
+
+		queryRoles = func(where map[string]interface{}) (roles []map[string]interface{}, err *utils.Error) {
+			roles = []map[string]interface{}{{"name": "admin"}}
+			return
+		}
+
+		adapters.Get = func(collection string, id string) (response map[string]interface{}, err *utils.Error) {
+			response = map[string]interface{}{
+				"_id": id,
+				"name": "moderator",
+				"users": []interface{}{"user1", "user2"},
+			}
+			return
+		}
+
+		var updatedData map[string]interface{}
+		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			updatedData = data
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Res = "/roles/roleid"
+		requestWrapper.Message.Body = map[string]interface{}{
+			"addUsers": []interface{}{"user3"},
+			"removeUsers": []interface{}{"user1"},
+			"addRoles": []interface{}{"admin"},
+		}
+
+		_, _, err := HandleUpdateRole(requestWrapper)
+		So(err, ShouldBeNil)
+		So(updatedData["users"], ShouldResemble, []string{"user2", "user3"})
+		So(updatedData["roles"], ShouldResemble, []string{"admin"})
+		So(updatedData, ShouldNotContainKey, "addUsers")
+	})
+
+	Convey("Should not allow a role to be a child of itself", t, func() {
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Res = "/roles/roleid"
+		requestWrapper.Message.Body = map[string]interface{}{"addRoles": []interface{}{"moderator"}}
+
+		_, _, err := HandleUpdateRole(requestWrapper)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+	})
+
+	queryRoles = originalQueryRoles
+}
+
+func TestGetPermissionsOnResources(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+
+	Convey("Should allow creating roles only to admins by default", t, func() {
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Res = ResourceTypeRoles
+
+		permissions, _ := getPermissionsOnResources([]string{"user:userid", "*"}, requestWrapper)
+		So(permissions["create"], ShouldBeFalse)
+		So(permissions["query"], ShouldBeTrue)
+
+		permissions, _ = getPermissionsOnResources([]string{"role:admin", "user:userid", "*"}, requestWrapper)
+		So(permissions["create"], ShouldBeTrue)
+	})
+
+	Convey("Should use class permissions from configuration", t, func() {
+
+		config.SystemConfig.Permissions = map[string]map[string][]string{
+			"posts": {"create": {"role:editor"}},
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Res = "/posts"
+
+		permissions, _ := getPermissionsOnResources([]string{"user:userid", "*"}, requestWrapper)
+		So(permissions["create"], ShouldBeFalse)
+
+		permissions, _ = getPermissionsOnResources([]string{"role:editor", "*"}, requestWrapper)
+		So(permissions["create"], ShouldBeTrue)
+
+		config.SystemConfig.Permissions = nil
+	})
+}
@@ -0,0 +1,354 @@
+package auth
+
+import (
+	"time"
+	"strings"
+	"net/http"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+)
+
+const defaultRefreshTokenLifetime = time.Hour * 24 * 30
+
+// last used time of a session is written at most once in this interval
+const sessionTouchInterval = 60
+
+var refreshTokenLifetime = defaultRefreshTokenLifetime
+
+// user agent tokens and names of the browsers. the order matters since most browsers mention the others too
+var userAgentBrowsers = [][2]string{
+	{"Edge/", "Edge"},
+	{"OPR/", "Opera"},
+	{"Chrome/", "Chrome"},
+	{"CriOS/", "Chrome"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"Safari/", "Safari"},
+	{"MSIE", "Internet Explorer"},
+	{"Trident/", "Internet Explorer"},
+	{"okhttp", "Android app"},
+	{"CFNetwork", "iOS app"},
+}
+
+// user agent tokens and names of the operating systems
+var userAgentSystems = [][2]string{
+	{"Windows Phone", "Windows Phone"},
+	{"Windows", "Windows"},
+	{"iPhone", "iPhone"},
+	{"iPad", "iPad"},
+	{"Android", "Android"},
+	{"Mac OS X", "Mac OS"},
+	{"Darwin", "iOS"},
+	{"Linux", "Linux"},
+}
+
+// creates a session for the user and returns the access and refresh tokens of it
+var startSession = func(requestWrapper messages.RequestWrapper, userId string, userData map[string]interface{}) (accessToken, refreshToken string, err *utils.Error) {
+
+	refreshToken, err = generateRandomToken()
+	if err != nil {
+		return
+	}
+
+	session := map[string]interface{}{
+		"userId": userId,
+		"refreshToken": hashToken(refreshToken),
+		"expiresAt": time.Now().Add(refreshTokenLifetime).Unix(),
+		"lastUsedAt": time.Now().Unix(),
+		"ip": requestWrapper.Message.RemoteAddr,
+		"userAgent": getUserAgent(requestWrapper),
+		// sessions are accessible only through the auth endpoints
+		"_acl": map[string]interface{}{},
+	}
+
+	var createdSession map[string]interface{}
+	createdSession, _, err = adapters.Create(ClassSessions, session)
+	if err != nil {
+		return
+	}
+
+	accessToken, err = generateToken(userId, createdSession["_id"].(string), userData)
+	return
+}
+
+var HandleRefresh = func(requestWrapper messages.RequestWrapper) (response messages.Message, err *utils.Error) {
+
+	refreshToken, isString := requestWrapper.Message.Body["refreshToken"].(string)
+	if !isString || refreshToken == "" {
+		err = &utils.Error{http.StatusBadRequest, "Refresh token must be provided in the body with field 'refreshToken'."}
+		return
+	}
+
+	whereParams := map[string]interface{}{
+		"refreshToken": map[string]string{"$eq": hashToken(refreshToken)},
+	}
+	whereParamsJson, jsonErr := json.Marshal(whereParams)
+	if jsonErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Creating session request failed."}
+		return
+	}
+
+	parameters := map[string][]string{"where": []string{string(whereParamsJson)}}
+	results, fetchErr := adapters.Query(ClassSessions, parameters, nil)
+	if fetchErr != nil {
+		err = fetchErr
+		return
+	}
+	sessions, _ := results["data"].([]map[string]interface{})
+	if len(sessions) == 0 {
+		err = &utils.Error{http.StatusUnauthorized, "Refresh token is not valid."}
+		return
+	}
+	session := sessions[0]
+	sessionId := session["_id"].(string)
+
+	if toInt64(session["expiresAt"]) < time.Now().Unix() {
+		adapters.Delete(ClassSessions, sessionId)
+		err = &utils.Error{http.StatusUnauthorized, "Refresh token is expired."}
+		return
+	}
+
+	userId, _ := session["userId"].(string)
+	user, getUserErr := adapters.Get(ClassUsers, userId)
+	if getUserErr != nil {
+		err = &utils.Error{http.StatusUnauthorized, "Refresh token is not valid."}
+		return
+	}
+
+	// refresh tokens are single use. every refresh returns a new one
+	var newRefreshToken string
+	newRefreshToken, err = generateRandomToken()
+	if err != nil {
+		return
+	}
+
+	sessionUpdate := map[string]interface{}{
+		"refreshToken": hashToken(newRefreshToken),
+		"expiresAt": time.Now().Add(refreshTokenLifetime).Unix(),
+		"lastUsedAt": time.Now().Unix(),
+		"ip": requestWrapper.Message.RemoteAddr,
+	}
+	_, _, err = adapters.Update(ClassSessions, sessionId, sessionUpdate)
+	if err != nil {
+		return
+	}
+
+	var accessToken string
+	accessToken, err = generateToken(userId, sessionId, user)
+	if err != nil {
+		return
+	}
+
+	response.Body = map[string]interface{}{
+		"accessToken": accessToken,
+		"refreshToken": newRefreshToken,
+	}
+	response.Status = http.StatusOK
+	return
+}
+
+var HandleLogout = func(requestWrapper messages.RequestWrapper, user interface{}) (response messages.Message, err *utils.Error) {
+
+	userAsMap, _ := user.(map[string]interface{})
+	if len(userAsMap) == 0 {
+		err = &utils.Error{http.StatusUnauthorized, "Access token must be provided for logout request."}
+		return
+	}
+
+	var sessionId string
+	sessionId, err = getSessionIdFromRequest(requestWrapper)
+	if err != nil {
+		return
+	}
+
+	_, err = adapters.Delete(ClassSessions, sessionId)
+	if err == nil {
+		response.Status = http.StatusNoContent
+	}
+	return
+}
+
+// lists the active sessions of the user. the session of the request is marked as current
+var HandleListSessions = func(requestWrapper messages.RequestWrapper, user interface{}) (response messages.Message, err *utils.Error) {
+
+	userAsMap, _ := user.(map[string]interface{})
+	if len(userAsMap) == 0 {
+		err = &utils.Error{http.StatusUnauthorized, "Access token must be provided for listing sessions."}
+		return
+	}
+
+	currentSessionId, _ := getSessionIdFromRequest(requestWrapper)
+
+	whereParams := map[string]interface{}{
+		"userId": map[string]string{"$eq": userAsMap["_id"].(string)},
+		"expiresAt": map[string]int64{"$gt": time.Now().Unix()},
+	}
+	whereParamsJson, jsonErr := json.Marshal(whereParams)
+	if jsonErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Creating session request failed."}
+		return
+	}
+
+	parameters := map[string][]string{
+		"where": []string{string(whereParamsJson)},
+		"sort": []string{`"-lastUsedAt"`},
+	}
+	results, fetchErr := adapters.Query(ClassSessions, parameters, nil)
+	if fetchErr != nil {
+		err = fetchErr
+		return
+	}
+
+	sessions, _ := results["data"].([]map[string]interface{})
+	data := make([]map[string]interface{}, 0, len(sessions))
+	for _, session := range sessions {
+		userAgent, _ := session["userAgent"].(string)
+		data = append(data, map[string]interface{}{
+			"_id": session["_id"],
+			"device": parseUserAgent(userAgent),
+			"userAgent": userAgent,
+			"ip": session["ip"],
+			"createdAt": session["createdAt"],
+			"lastUsedAt": session["lastUsedAt"],
+			"current": session["_id"] == currentSessionId,
+		})
+	}
+
+	response.Body = map[string]interface{}{"data": data}
+	response.Status = http.StatusOK
+	return
+}
+
+// signs out one of the sessions of the user
+var HandleDeleteSession = func(requestWrapper messages.RequestWrapper, user interface{}) (response messages.Message, err *utils.Error) {
+
+	userAsMap, _ := user.(map[string]interface{})
+	if len(userAsMap) == 0 {
+		err = &utils.Error{http.StatusUnauthorized, "Access token must be provided for deleting sessions."}
+		return
+	}
+
+	sessionId := requestWrapper.Message.Res[strings.LastIndex(requestWrapper.Message.Res, "/") + 1:]
+
+	// sessions of the other users are not revealed
+	session, getErr := getSession(sessionId)
+	if getErr != nil || session["userId"] != userAsMap["_id"] {
+		err = &utils.Error{http.StatusNotFound, "Session not found."}
+		return
+	}
+
+	_, err = adapters.Delete(ClassSessions, sessionId)
+	if err == nil {
+		response.Status = http.StatusNoContent
+	}
+	return
+}
+
+// revokes all the access and refresh tokens of the user
+var revokeSessions = func(userId string) (err *utils.Error) {
+	return adapters.DeleteAll(ClassSessions, map[string]interface{}{"userId": userId})
+}
+
+var getSession = func(sessionId string) (session map[string]interface{}, err *utils.Error) {
+	return adapters.Get(ClassSessions, sessionId)
+}
+
+// updates the last used time of the session, at most once in the touch interval
+func touchSession(session map[string]interface{}) {
+
+	now := time.Now().Unix()
+	if now - toInt64(session["lastUsedAt"]) < sessionTouchInterval {
+		return
+	}
+	if sessionId, isString := session["_id"].(string); isString {
+		adapters.Update(ClassSessions, sessionId, map[string]interface{}{"lastUsedAt": now})
+	}
+}
+
+func getUserAgent(requestWrapper messages.RequestWrapper) (userAgent string) {
+
+	if userAgents := requestWrapper.Message.Headers["User-Agent"]; len(userAgents) > 0 {
+		userAgent = userAgents[0]
+	}
+	return
+}
+
+// returns a readable description of the device, like 'Chrome on Mac OS'
+func parseUserAgent(userAgent string) string {
+
+	browser := "Unknown browser"
+	for _, b := range userAgentBrowsers {
+		if strings.Contains(userAgent, b[0]) {
+			browser = b[1]
+			break
+		}
+	}
+
+	system := "unknown device"
+	for _, o := range userAgentSystems {
+		if strings.Contains(userAgent, o[0]) {
+			system = o[1]
+			break
+		}
+	}
+
+	return browser + " on " + system
+}
+
+func getSessionIdFromRequest(requestWrapper messages.RequestWrapper) (sessionId string, err *utils.Error) {
+
+	authHeaders := requestWrapper.Message.Headers["Authorization"]
+	if len(authHeaders) == 0 {
+		err = &utils.Error{http.StatusUnauthorized, "Access token must be provided."}
+		return
+	}
+
+	token, tokenErr := jwt.Parse(authHeaders[0], getVerificationKey)
+	if tokenErr != nil || !token.Valid {
+		err = &utils.Error{http.StatusUnauthorized, "Token is not valid."}
+		return
+	}
+
+	sessionId, _ = token.Claims["sid"].(string)
+	return
+}
+
+// returns a random token for refresh tokens and links. it is not signed, so it must be stored to be verified
+func generateRandomToken() (token string, err *utils.Error) {
+
+	bytes := make([]byte, 32)
+	_, readErr := rand.Read(bytes)
+	if readErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Generating token failed."}
+		return
+	}
+	token = hex.EncodeToString(bytes)
+	return
+}
+
+// only the hashes of the tokens are stored in the database
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func toInt64(value interface{}) int64 {
+
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
@@ -0,0 +1,341 @@
+package auth
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"net/http"
+	"time"
+)
+
+func TestHandleRefresh(t *testing.T) {
+
+	LoadSigningKeys(config.TokenConfig{
+		SigningKey: "key1",
+		Keys: []config.SigningKey{{Kid: "key1", Algorithm: "HS256", Secret: "secret1"}},
+	})
+	generateToken = realGenerateToken
+
+	Convey("Should return bad request", t, func() {
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{}
+
+		_, err := HandleRefresh(requestWrapper)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+	})
+
+	Convey("Should return unauthorized for unknown refresh token", t, func() {
+
+		adapters.Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
+			response = map[string]interface{}{"data": make([]map[string]interface{}, 0)}
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"refreshToken": "unknowntoken"}
+
+		_, err := HandleRefresh(requestWrapper)
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("Should return unauthorized and delete the session for expired refresh token", t, func() {
+
+		adapters.Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
+			session := map[string]interface{}{
+				"_id": "sessionid",
+				"userId": "userid",
+				"expiresAt": time.Now().Add(-time.Hour).Unix(),
+			}
+			response = map[string]interface{}{"data": []map[string]interface{}{session}}
+			return
+		}
+
+		var deleted bool
+		adapters.Delete = func(collection string, id string) (response map[string]interface{}, err *utils.Error) {
+			deleted = collection == ClassSessions && id == "sessionid"
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"refreshToken": "expiredtoken"}
+
+		_, err := HandleRefresh(requestWrapper)
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+		So(deleted, ShouldBeTrue)
+	})
+
+	Convey("Should return new tokens and rotate the refresh token", t, func() {
+
+		var queriedHash string
+		adapters.Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
+			queriedHash = parameters["where"][0]
+			session := map[string]interface{}{
+				"_id": "sessionid",
+				"userId": "userid",
+				"expiresAt": time.Now().Add(time.Hour).Unix(),
+			}
+			response = map[string]interface{}{"data": []map[string]interface{}{session}}
+			return
+		}
+
+		adapters.Get = func(collection string, id string) (response map[string]interface{}, err *utils.Error) {
+			response = map[string]interface{}{"_id": id, "email": "email@domain.com"}
+			return
+		}
+
+		var updatedSession map[string]interface{}
+		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			updatedSession = data
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"refreshToken": "validtoken"}
+
+		response, err := HandleRefresh(requestWrapper)
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusOK)
+		So(queriedHash, ShouldContainSubstring, hashToken("validtoken"))
+		So(response.Body["accessToken"], ShouldNotBeEmpty)
+		So(response.Body["refreshToken"], ShouldNotEqual, "validtoken")
+		So(updatedSession["refreshToken"], ShouldEqual, hashToken(response.Body["refreshToken"].(string)))
+	})
+}
+
+func TestHandleLogout(t *testing.T) {
+
+	Convey("Should return unauthorized without access token", t, func() {
+
+		_, err := HandleLogout(messages.RequestWrapper{}, map[string]interface{}{})
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("Should delete the session of the access token", t, func() {
+
+		LoadSigningKeys(config.TokenConfig{
+			SigningKey: "key1",
+			Keys: []config.SigningKey{{Kid: "key1", Algorithm: "HS256", Secret: "secret1"}},
+		})
+		accessToken, _ := realGenerateToken("userid", "sessionid", map[string]interface{}{})
+
+		var deletedSession string
+		adapters.Delete = func(collection string, id string) (response map[string]interface{}, err *utils.Error) {
+			deletedSession = id
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Headers = map[string][]string{"Authorization": {accessToken}}
+
+		response, err := HandleLogout(requestWrapper, map[string]interface{}{"_id": "userid"})
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusNoContent)
+		So(deletedSession, ShouldEqual, "sessionid")
+	})
+}
+
+func TestVerifyTokenWithRevokedSession(t *testing.T) {
+
+	originalGetSession := getSession
+
+	Convey("Should reject the tokens of deleted sessions", t, func() {
+
+		LoadSigningKeys(config.TokenConfig{
+			SigningKey: "key1",
+			Keys: []config.SigningKey{{Kid: "key1", Algorithm: "HS256", Secret: "secret1"}},
+		})
+		accessToken, _ := realGenerateToken("userid", "sessionid", map[string]interface{}{})
+
+		getSession = func(sessionId string) (session map[string]interface{}, err *utils.Error) {
+			err = &utils.Error{http.StatusNotFound, "Item not found."}
+			return
+		}
+
+		_, err := verifyToken(accessToken)
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+	})
+
+	getSession = originalGetSession
+}
+
+func TestChangePasswordRevokesSessions(t *testing.T) {
+
+	originalRevokeSessions := revokeSessions
+	originalStartSession := startSession
+
+	Convey("Should revoke all sessions and start a new one", t, func() {
+
+		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			response = map[string]interface{}{"updatedAt": 1449140922}
+			return
+		}
+
+		var revokedUser string
+		revokeSessions = func(userId string) (err *utils.Error) {
+			revokedUser = userId
+			return
+		}
+
+		startSession = func(requestWrapper messages.RequestWrapper, userId string, userData map[string]interface{}) (accessToken, refreshToken string, err *utils.Error) {
+			accessToken = "newaccesstoken"
+			refreshToken = "newrefreshtoken"
+			return
+		}
+
+		user := map[string]interface{}{
+			"_id": "userid",
+			// hased of 'zuhaha'
+			"password": "$2a$10$wqvcYHiRvoCy5ZUurNz9wuokDH1DyXjfd8k6Hk4DSJKui76gx1yrO",
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"password": "zuhaha", "newPassword": "newpassword"}
+
+		response, err := HandleChangePassword(requestWrapper, &adapters.MongoAdapter{}, user)
+		So(err, ShouldBeNil)
+		So(revokedUser, ShouldEqual, "userid")
+		So(response.Body["accessToken"], ShouldEqual, "newaccesstoken")
+		So(response.Body["refreshToken"], ShouldEqual, "newrefreshtoken")
+	})
+
+	revokeSessions = originalRevokeSessions
+	startSession = originalStartSession
+}
+
+func TestHandleListSessions(t *testing.T) {
+
+	Convey("Should return unauthorized without user", t, func() {
+
+		_, err := HandleListSessions(messages.RequestWrapper{}, map[string]interface{}{})
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("Should list the sessions of the user with device info", t, func() {
+
+		LoadSigningKeys(config.TokenConfig{
+			SigningKey: "key1",
+			Keys: []config.SigningKey{{Kid: "key1", Algorithm: "HS256", Secret: "secret1"}},
+		})
+		accessToken, _ := realGenerateToken("userid", "sessionid1", map[string]interface{}{})
+
+		var queriedWhere string
+		var queryParameters adapters.QueryParameters
+		var parseErr *utils.Error
+		adapters.Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
+			queriedWhere = parameters["where"][0]
+			queryParameters, parseErr = adapters.ParseQueryParameters(parameters)
+			sessions := []map[string]interface{}{
+				{
+					"_id": "sessionid1",
+					"userId": "userid",
+					"refreshToken": "hash1",
+					"ip": "10.0.0.1",
+					"userAgent": "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_11_2) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/47.0.2526.106 Safari/537.36",
+					"createdAt": 1449140922,
+					"lastUsedAt": 1449150922,
+				},
+				{
+					"_id": "sessionid2",
+					"userId": "userid",
+					"refreshToken": "hash2",
+					"ip": "10.0.0.2",
+					"userAgent": "Mozilla/5.0 (iPhone; CPU iPhone OS 9_2 like Mac OS X) AppleWebKit/601.1.46 (KHTML, like Gecko) Version/9.0 Mobile/13C75 Safari/601.1",
+					"createdAt": 1449140922,
+					"lastUsedAt": 1449140922,
+				},
+			}
+			response = map[string]interface{}{"data": sessions}
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Headers = map[string][]string{"Authorization": {accessToken}}
+
+		response, err := HandleListSessions(requestWrapper, map[string]interface{}{"_id": "userid"})
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusOK)
+		So(queriedWhere, ShouldContainSubstring, `"userId":{"$eq":"userid"}`)
+		So(parseErr, ShouldBeNil)
+		So(queryParameters.Sort, ShouldEqual, "-lastUsedAt")
+
+		data := response.Body["data"].([]map[string]interface{})
+		So(len(data), ShouldEqual, 2)
+		So(data[0], ShouldNotContainKey, "refreshToken")
+		So(data[0]["device"], ShouldEqual, "Chrome on Mac OS")
+		So(data[0]["current"], ShouldBeTrue)
+		So(data[1]["device"], ShouldEqual, "Safari on iPhone")
+		So(data[1]["ip"], ShouldEqual, "10.0.0.2")
+		So(data[1]["current"], ShouldBeFalse)
+	})
+}
+
+func TestHandleDeleteSession(t *testing.T) {
+
+	originalGetSession := getSession
+
+	Convey("Should not delete the sessions of other users", t, func() {
+
+		getSession = func(sessionId string) (session map[string]interface{}, err *utils.Error) {
+			session = map[string]interface{}{"_id": sessionId, "userId": "otheruserid"}
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Res = "/users/me/sessions/sessionid"
+
+		_, err := HandleDeleteSession(requestWrapper, map[string]interface{}{"_id": "userid"})
+		So(err.Code, ShouldEqual, http.StatusNotFound)
+	})
+
+	Convey("Should delete the session of the user", t, func() {
+
+		getSession = func(sessionId string) (session map[string]interface{}, err *utils.Error) {
+			session = map[string]interface{}{"_id": sessionId, "userId": "userid"}
+			return
+		}
+
+		var deletedSession string
+		adapters.Delete = func(collection string, id string) (response map[string]interface{}, err *utils.Error) {
+			deletedSession = id
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Res = "/users/me/sessions/sessionid"
+
+		response, err := HandleDeleteSession(requestWrapper, map[string]interface{}{"_id": "userid"})
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusNoContent)
+		So(deletedSession, ShouldEqual, "sessionid")
+	})
+
+	getSession = originalGetSession
+}
+
+func TestStartSession(t *testing.T) {
+
+	Convey("Should store the device info of the session", t, func() {
+
+		var createdSession map[string]interface{}
+		adapters.Create = func(collection string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			createdSession = data
+			response = map[string]interface{}{"_id": "sessionid"}
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.RemoteAddr = "10.0.0.1"
+		requestWrapper.Message.Headers = map[string][]string{"User-Agent": {"okhttp/3.0.1"}}
+
+		_, refreshToken, err := startSession(requestWrapper, "userid", map[string]interface{}{})
+		So(err, ShouldBeNil)
+		So(createdSession["ip"], ShouldEqual, "10.0.0.1")
+		So(createdSession["userAgent"], ShouldEqual, "okhttp/3.0.1")
+		So(createdSession["lastUsedAt"], ShouldNotBeNil)
+		So(createdSession["refreshToken"], ShouldEqual, hashToken(refreshToken))
+	})
+}
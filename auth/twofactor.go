@@ -0,0 +1,459 @@
+package auth
+
+import (
+	"time"
+	"strings"
+	"strconv"
+	"net/url"
+	"net/http"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/base32"
+	"encoding/binary"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+)
+
+const (
+	tokenPurposeTwoFactor = "2fa"
+	defaultTwoFactorChallengeLifetime = 5 * time.Minute
+	defaultTwoFactorIssuer = "Dock"
+	totpPeriod = 30
+	totpDigits = 6
+	totpSecretSize = 20
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// returns whether the user has two-factor authentication and how many recovery codes are left
+var HandleGetTwoFactor = func(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	if len(user) == 0 {
+		err = &utils.Error{http.StatusUnauthorized, "Access token must be provided."}
+		return
+	}
+
+	response.Body = map[string]interface{}{"enabled": isTwoFactorEnabled(user)}
+	if isTwoFactorEnabled(user) {
+		twoFactor, getErr := getTwoFactor(user["_id"].(string))
+		if getErr == nil {
+			recoveryCodes, _ := toStringArray(twoFactor["recoveryCodes"])
+			response.Body["recoveryCodesLeft"] = len(recoveryCodes)
+		}
+	}
+	response.Status = http.StatusOK
+	return
+}
+
+// creates a new secret for the user. it is used after the user confirms it with a code.
+var HandleEnrolTwoFactor = func(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	if len(user) == 0 {
+		err = &utils.Error{http.StatusUnauthorized, "Access token must be provided."}
+		return
+	}
+	if isTwoFactorEnabled(user) {
+		err = &utils.Error{http.StatusConflict, "Two-factor authentication is already enabled."}
+		return
+	}
+
+	secretBytes := make([]byte, totpSecretSize)
+	if _, readErr := rand.Read(secretBytes); readErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Generating secret failed."}
+		return
+	}
+	secret := totpEncoding.EncodeToString(secretBytes)
+
+	userId := user["_id"].(string)
+	err = adapters.DeleteAll(ClassTwoFactor, map[string]interface{}{"userId": userId})
+	if err != nil {
+		return
+	}
+
+	twoFactor := map[string]interface{}{
+		"userId": userId,
+		"secret": secret,
+		"enabled": false,
+		// secrets are accessible only through the auth endpoints
+		"_acl": map[string]interface{}{},
+	}
+	_, _, err = adapters.Create(ClassTwoFactor, twoFactor)
+	if err != nil {
+		return
+	}
+
+	response.Body = map[string]interface{}{"secret": secret, "uri": getOtpAuthUri(secret, user)}
+	response.Status = http.StatusOK
+	return
+}
+
+// enables two-factor authentication with a code of the enrolled secret and returns the recovery codes
+var HandleConfirmTwoFactor = func(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	if len(user) == 0 {
+		err = &utils.Error{http.StatusUnauthorized, "Access token must be provided."}
+		return
+	}
+
+	code, _ := requestWrapper.Message.Body["code"].(string)
+	if code == "" {
+		err = &utils.Error{http.StatusBadRequest, "Code must be provided in the body with field 'code'."}
+		return
+	}
+
+	userId := user["_id"].(string)
+	twoFactor, getErr := getTwoFactor(userId)
+	if getErr != nil {
+		err = &utils.Error{http.StatusBadRequest, "Two-factor authentication is not enrolled."}
+		return
+	}
+	if enabled, _ := twoFactor["enabled"].(bool); enabled {
+		err = &utils.Error{http.StatusConflict, "Two-factor authentication is already enabled."}
+		return
+	}
+
+	response, err = useTwoFactorCode(requestWrapper, user, twoFactor, code, "")
+	if err != nil {
+		return
+	}
+
+	var recoveryCodes []string
+	recoveryCodes, err = resetRecoveryCodes(twoFactor, map[string]interface{}{"enabled": true})
+	if err != nil {
+		return
+	}
+
+	_, _, err = adapters.Update(ClassUsers, userId, map[string]interface{}{"twoFactorEnabled": true})
+	if err != nil {
+		return
+	}
+
+	response.Body = map[string]interface{}{"recoveryCodes": recoveryCodes}
+	response.Status = http.StatusOK
+	return
+}
+
+// creates new recovery codes in place of the old ones. requires a code from the authenticator.
+var HandleRegenerateRecoveryCodes = func(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	var twoFactor map[string]interface{}
+	response, twoFactor, err = verifyEnabledTwoFactor(requestWrapper, user, false)
+	if err != nil {
+		return
+	}
+
+	var recoveryCodes []string
+	recoveryCodes, err = resetRecoveryCodes(twoFactor, nil)
+	if err != nil {
+		return
+	}
+
+	response.Body = map[string]interface{}{"recoveryCodes": recoveryCodes}
+	response.Status = http.StatusOK
+	return
+}
+
+// disables two-factor authentication. requires a code from the authenticator or a recovery code.
+var HandleDisableTwoFactor = func(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	response, _, err = verifyEnabledTwoFactor(requestWrapper, user, true)
+	if err != nil {
+		return
+	}
+
+	userId := user["_id"].(string)
+	err = adapters.DeleteAll(ClassTwoFactor, map[string]interface{}{"userId": userId})
+	if err != nil {
+		return
+	}
+
+	_, _, err = adapters.Update(ClassUsers, userId, map[string]interface{}{"twoFactorEnabled": false})
+	if err == nil {
+		response.Status = http.StatusNoContent
+	}
+	return
+}
+
+// second step of the login. exchanges the challenge token and a code for the session tokens.
+var HandleLoginTwoFactor = func(requestWrapper messages.RequestWrapper) (response messages.Message, err *utils.Error) {
+
+	challengeToken, _ := requestWrapper.Message.Body["challengeToken"].(string)
+	code, _ := requestWrapper.Message.Body["code"].(string)
+	recoveryCode, _ := requestWrapper.Message.Body["recoveryCode"].(string)
+	if challengeToken == "" || (code == "" && recoveryCode == "") {
+		err = &utils.Error{http.StatusBadRequest, "Challenge token, and code or recovery code must be provided."}
+		return
+	}
+
+	var claims map[string]interface{}
+	claims, err = parsePurposeToken(challengeToken, tokenPurposeTwoFactor)
+	if err != nil {
+		return
+	}
+
+	userId, _ := claims["userId"].(string)
+	user, getErr := adapters.Get(ClassUsers, userId)
+	if getErr != nil {
+		err = &utils.Error{http.StatusBadRequest, "Token is not valid or expired."}
+		return
+	}
+
+	twoFactor, getErr := getTwoFactor(userId)
+	if getErr != nil || !isTwoFactorEnabled(user) {
+		err = &utils.Error{http.StatusBadRequest, "Token is not valid or expired."}
+		return
+	}
+
+	response, err = useTwoFactorCode(requestWrapper, user, twoFactor, code, recoveryCode)
+	if err != nil {
+		return
+	}
+
+	// the user may be disabled after the first step
+	if statusResponse, statusErr := checkAccountStatus(user); statusErr != nil {
+		response, err = statusResponse, statusErr
+		return
+	}
+
+	delete(user, "password")
+	response.Body = user
+
+	var accessToken, refreshToken string
+	accessToken, refreshToken, err = startSession(requestWrapper, userId, user)
+	if err == nil {
+		response.Body["accessToken"] = accessToken
+		response.Body["refreshToken"] = refreshToken
+		response.Status = http.StatusOK
+	}
+	return
+}
+
+// returns the response of the first step of the login for the users with two-factor authentication
+func startTwoFactorChallenge(userId string) (body map[string]interface{}, err *utils.Error) {
+
+	lifetime := defaultTwoFactorChallengeLifetime
+	if seconds := config.SystemConfig.TwoFactor.ChallengeLifetime; seconds > 0 {
+		lifetime = time.Duration(seconds) * time.Second
+	}
+
+	var challengeToken string
+	challengeToken, err = signPurposeToken(tokenPurposeTwoFactor, map[string]interface{}{"userId": userId}, lifetime)
+	if err == nil {
+		body = map[string]interface{}{"twoFactorRequired": true, "challengeToken": challengeToken}
+	}
+	return
+}
+
+func isTwoFactorEnabled(user map[string]interface{}) bool {
+
+	isEnabled, _ := user["twoFactorEnabled"].(bool)
+	return isEnabled
+}
+
+// checks the code in the body or in the parameters against the enabled two-factor authentication of the user
+func verifyEnabledTwoFactor(requestWrapper messages.RequestWrapper, user map[string]interface{}, allowRecoveryCode bool) (response messages.Message, twoFactor map[string]interface{}, err *utils.Error) {
+
+	if len(user) == 0 {
+		err = &utils.Error{http.StatusUnauthorized, "Access token must be provided."}
+		return
+	}
+
+	code := getFieldOfRequest(requestWrapper, "code")
+	var recoveryCode string
+	if allowRecoveryCode {
+		recoveryCode = getFieldOfRequest(requestWrapper, "recoveryCode")
+	}
+	if code == "" && recoveryCode == "" {
+		err = &utils.Error{http.StatusBadRequest, "Code must be provided with field 'code'."}
+		return
+	}
+
+	var getErr *utils.Error
+	twoFactor, getErr = getTwoFactor(user["_id"].(string))
+	if getErr != nil || !isTwoFactorEnabled(user) {
+		err = &utils.Error{http.StatusBadRequest, "Two-factor authentication is not enabled."}
+		return
+	}
+
+	response, err = useTwoFactorCode(requestWrapper, user, twoFactor, code, recoveryCode)
+	return
+}
+
+// verifies the totp code or the recovery code and saves that it is used. failures are counted for brute-force
+// protection.
+func useTwoFactorCode(requestWrapper messages.RequestWrapper, user, twoFactor map[string]interface{}, code, recoveryCode string) (response messages.Message, err *utils.Error) {
+
+	accountKeys := getAccountKeys(user)
+	response, err = checkLockout(requestWrapper, accountKeys)
+	if err != nil {
+		return
+	}
+
+	update := make(map[string]interface{})
+	if code != "" {
+		secret, decodeErr := totpEncoding.DecodeString(twoFactor["secret"].(string))
+		step, isValid := verifyTotpCode(secret, code, toInt64(twoFactor["lastUsedStep"]), time.Now())
+		if decodeErr == nil && isValid {
+			// codes cannot be used twice
+			update["lastUsedStep"] = step
+		}
+	} else {
+		recoveryCodes, _ := toStringArray(twoFactor["recoveryCodes"])
+		hash := hashRecoveryCode(recoveryCode)
+		for i, existingHash := range recoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(existingHash), []byte(hash)) == 1 {
+				update["recoveryCodes"] = append(recoveryCodes[:i:i], recoveryCodes[i + 1:]...)
+				break
+			}
+		}
+	}
+
+	if len(update) == 0 {
+		recordFailedAttempt(requestWrapper, accountKeys)
+		err = &utils.Error{http.StatusUnauthorized, "Code is not valid."}
+		return
+	}
+	clearFailedAttempts(accountKeys)
+
+	_, _, err = adapters.Update(ClassTwoFactor, twoFactor["_id"].(string), update)
+	return
+}
+
+// creates new recovery codes and saves their hashes with the other fields
+func resetRecoveryCodes(twoFactor map[string]interface{}, update map[string]interface{}) (recoveryCodes []string, err *utils.Error) {
+
+	if update == nil {
+		update = make(map[string]interface{})
+	}
+
+	hashes := make([]string, recoveryCodeCount)
+	recoveryCodes = make([]string, recoveryCodeCount)
+	for i := range recoveryCodes {
+		bytes := make([]byte, 5)
+		if _, readErr := rand.Read(bytes); readErr != nil {
+			err = &utils.Error{http.StatusInternalServerError, "Generating recovery codes failed."}
+			return
+		}
+		code := hex.EncodeToString(bytes)
+		recoveryCodes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(recoveryCodes[i])
+	}
+	update["recoveryCodes"] = hashes
+
+	_, _, err = adapters.Update(ClassTwoFactor, twoFactor["_id"].(string), update)
+	if err != nil {
+		recoveryCodes = nil
+	}
+	return
+}
+
+// recovery codes are compared without the dashes and the case
+func hashRecoveryCode(recoveryCode string) string {
+	return hashToken(strings.ToLower(strings.Replace(strings.TrimSpace(recoveryCode), "-", "", -1)))
+}
+
+var getTwoFactor = func(userId string) (twoFactor map[string]interface{}, err *utils.Error) {
+
+	whereParams := map[string]interface{}{
+		"userId": map[string]string{"$eq": userId},
+	}
+	whereParamsJson, jsonErr := json.Marshal(whereParams)
+	if jsonErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Creating two-factor request failed."}
+		return
+	}
+
+	parameters := map[string][]string{"where": []string{string(whereParamsJson)}}
+	results, fetchErr := adapters.Query(ClassTwoFactor, parameters, nil)
+	if fetchErr != nil {
+		err = fetchErr
+		return
+	}
+	items, _ := results["data"].([]map[string]interface{})
+	if len(items) == 0 {
+		err = &utils.Error{http.StatusNotFound, "Two-factor authentication is not enrolled."}
+		return
+	}
+	twoFactor = items[0]
+	return
+}
+
+// returns the uri that authenticator apps read from qr codes
+func getOtpAuthUri(secret string, user map[string]interface{}) string {
+
+	issuer := config.SystemConfig.TwoFactor.Issuer
+	if issuer == "" {
+		issuer = defaultTwoFactorIssuer
+	}
+
+	account, _ := user["email"].(string)
+	if account == "" {
+		account, _ = user["username"].(string)
+	}
+	if account == "" {
+		account, _ = user["_id"].(string)
+	}
+
+	parameters := url.Values{}
+	parameters.Set("secret", secret)
+	parameters.Set("issuer", issuer)
+	parameters.Set("algorithm", "SHA1")
+	parameters.Set("digits", strconv.Itoa(totpDigits))
+	parameters.Set("period", strconv.Itoa(totpPeriod))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + parameters.Encode()
+}
+
+// generates the code of the time step as described in RFC 6238
+func generateTotpCode(secret []byte, step int64) string {
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum) - 1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset + 4]) & 0x7fffffff
+
+	code := strconv.Itoa(int(value % 1000000))
+	return strings.Repeat("0", totpDigits - len(code)) + code
+}
+
+// accepts the codes of the previous and the next steps for clock drift. steps that are used before are not accepted.
+func verifyTotpCode(secret []byte, code string, lastUsedStep int64, now time.Time) (step int64, isValid bool) {
+
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != totpDigits {
+		return
+	}
+
+	currentStep := now.Unix() / totpPeriod
+	for _, candidate := range []int64{currentStep - 1, currentStep, currentStep + 1} {
+		if candidate <= lastUsedStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(generateTotpCode(secret, candidate)), []byte(code)) == 1 {
+			return candidate, true
+		}
+	}
+	return
+}
+
+func getFieldOfRequest(requestWrapper messages.RequestWrapper, field string) (value string) {
+
+	if values := requestWrapper.Message.Parameters[field]; len(values) > 0 {
+		return values[0]
+	}
+	value, _ = requestWrapper.Message.Body[field].(string)
+	return
+}
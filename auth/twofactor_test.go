@@ -0,0 +1,290 @@
+package auth
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// keeps the two-factor document and the user in memory
+func mockTwoFactorStorage(user map[string]interface{}) (twoFactor map[string]interface{}) {
+
+	twoFactor = make(map[string]interface{})
+
+	adapters.Create = func(collection string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+		for k := range twoFactor {
+			delete(twoFactor, k)
+		}
+		for k, v := range data {
+			twoFactor[k] = v
+		}
+		twoFactor["_id"] = "twofactorid"
+		return
+	}
+	adapters.DeleteAll = func(collection string, where map[string]interface{}) (err *utils.Error) {
+		for k := range twoFactor {
+			delete(twoFactor, k)
+		}
+		return
+	}
+	adapters.Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
+		items := []map[string]interface{}{}
+		if len(twoFactor) > 0 {
+			items = append(items, twoFactor)
+		}
+		response = map[string]interface{}{"data": items}
+		return
+	}
+	adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+		target := twoFactor
+		if collection == ClassUsers {
+			target = user
+		}
+		for k, v := range data {
+			target[k] = v
+		}
+		return
+	}
+	adapters.Get = func(collection string, id string) (response map[string]interface{}, err *utils.Error) {
+		response = make(map[string]interface{})
+		for k, v := range user {
+			response[k] = v
+		}
+		return
+	}
+	return
+}
+
+func currentTotpCode(twoFactor map[string]interface{}, offset int64) string {
+
+	secret, _ := totpEncoding.DecodeString(twoFactor["secret"].(string))
+	return generateTotpCode(secret, time.Now().Unix() / totpPeriod + offset)
+}
+
+func TestTotp(t *testing.T) {
+
+	Convey("Should generate the codes of RFC 6238", t, func() {
+
+		secret := []byte("12345678901234567890")
+		So(generateTotpCode(secret, 59 / totpPeriod), ShouldEqual, "287082")
+		So(generateTotpCode(secret, 1111111109 / totpPeriod), ShouldEqual, "081804")
+		So(generateTotpCode(secret, 2000000000 / totpPeriod), ShouldEqual, "279037")
+	})
+
+	Convey("Should accept the codes of the adjacent steps only once", t, func() {
+
+		secret := []byte("12345678901234567890")
+		now := time.Unix(1111111109, 0)
+		currentStep := now.Unix() / totpPeriod
+
+		step, isValid := verifyTotpCode(secret, generateTotpCode(secret, currentStep - 1), 0, now)
+		So(isValid, ShouldBeTrue)
+		So(step, ShouldEqual, currentStep - 1)
+
+		_, isValid = verifyTotpCode(secret, generateTotpCode(secret, currentStep - 1), step, now)
+		So(isValid, ShouldBeFalse)
+
+		_, isValid = verifyTotpCode(secret, generateTotpCode(secret, currentStep - 2), 0, now)
+		So(isValid, ShouldBeFalse)
+
+		_, isValid = verifyTotpCode(secret, "12345", 0, now)
+		So(isValid, ShouldBeFalse)
+	})
+}
+
+func TestTwoFactorEnrolment(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+	config.SystemConfig.TwoFactor.Issuer = "My App"
+
+	Convey("Should enrol, confirm, regenerate recovery codes and disable", t, func() {
+
+		accountFailures = newFailureCounter()
+		addressFailures = newFailureCounter()
+
+		user := map[string]interface{}{"_id": "userid", "email": "johny@bravo.com"}
+		twoFactor := mockTwoFactorStorage(user)
+
+		response, err := HandleEnrolTwoFactor(messages.RequestWrapper{}, user)
+		So(err, ShouldBeNil)
+		So(response.Body["secret"], ShouldHaveLength, 32)
+		So(response.Body["uri"], ShouldStartWith, "otpauth://totp/My%20App:johny@bravo.com?")
+		So(response.Body["uri"], ShouldContainSubstring, "secret=" + response.Body["secret"].(string))
+		So(twoFactor["enabled"], ShouldEqual, false)
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"code": "000000"}
+		if currentTotpCode(twoFactor, 0) == "000000" {
+			requestWrapper.Message.Body["code"] = "111111"
+		}
+		_, err = HandleConfirmTwoFactor(requestWrapper, user)
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+		So(user["twoFactorEnabled"], ShouldBeNil)
+
+		requestWrapper.Message.Body = map[string]interface{}{"code": currentTotpCode(twoFactor, 0)}
+		response, err = HandleConfirmTwoFactor(requestWrapper, user)
+		So(err, ShouldBeNil)
+		So(response.Body["recoveryCodes"], ShouldHaveLength, recoveryCodeCount)
+		So(user["twoFactorEnabled"], ShouldBeTrue)
+		So(twoFactor["enabled"], ShouldBeTrue)
+		So(twoFactor["recoveryCodes"], ShouldNotContain, response.Body["recoveryCodes"].([]string)[0])
+
+		_, err = HandleEnrolTwoFactor(messages.RequestWrapper{}, user)
+		So(err.Code, ShouldEqual, http.StatusConflict)
+
+		// the code that is used for confirming cannot be used again
+		response, err = HandleRegenerateRecoveryCodes(requestWrapper, user)
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+
+		requestWrapper.Message.Body = map[string]interface{}{"code": currentTotpCode(twoFactor, 1)}
+		response, err = HandleRegenerateRecoveryCodes(requestWrapper, user)
+		So(err, ShouldBeNil)
+		recoveryCodes := response.Body["recoveryCodes"].([]string)
+
+		response, err = HandleGetTwoFactor(messages.RequestWrapper{}, user)
+		So(response.Body["enabled"], ShouldBeTrue)
+		So(response.Body["recoveryCodesLeft"], ShouldEqual, recoveryCodeCount)
+
+		var deleteRequest messages.RequestWrapper
+		deleteRequest.Message.Parameters = map[string][]string{"recoveryCode": []string{strings.ToUpper(recoveryCodes[3])}}
+		response, err = HandleDisableTwoFactor(deleteRequest, user)
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusNoContent)
+		So(user["twoFactorEnabled"], ShouldBeFalse)
+		So(twoFactor, ShouldBeEmpty)
+	})
+
+	Convey("Should not allow the requests without user", t, func() {
+
+		_, err := HandleEnrolTwoFactor(messages.RequestWrapper{}, nil)
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+		_, err = HandleDisableTwoFactor(messages.RequestWrapper{}, map[string]interface{}{})
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+	})
+
+	accountFailures = newFailureCounter()
+	addressFailures = newFailureCounter()
+	config.SystemConfig = config.Config{}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+	LoadSigningKeys(config.TokenConfig{
+		SigningKey: "key1",
+		Keys: []config.SigningKey{{Kid: "key1", Algorithm: "HS256", Secret: "secret1"}},
+	})
+
+	originalGetAccountData := getAccountData
+	originalStartSession := startSession
+
+	user := map[string]interface{}{
+		"_id": "userid",
+		"email": "johny@bravo.com",
+		// hash of 'zuhaha'
+		"password": "$2a$10$wqvcYHiRvoCy5ZUurNz9wuokDH1DyXjfd8k6Hk4DSJKui76gx1yrO",
+		"twoFactorEnabled": true,
+	}
+	getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
+		accountData = make(map[string]interface{})
+		for k, v := range user {
+			accountData[k] = v
+		}
+		return
+	}
+	startSession = func(requestWrapper messages.RequestWrapper, userId string, userData map[string]interface{}) (accessToken, refreshToken string, err *utils.Error) {
+		return "accesstoken", "refreshtoken", nil
+	}
+
+	Convey("Should return a challenge token instead of the session tokens", t, func() {
+
+		accountFailures = newFailureCounter()
+		addressFailures = newFailureCounter()
+		mockTwoFactorStorage(user)
+
+		response, err := HandleLogin(makeLoginRequest("johny@bravo.com", "zuhaha", "1.1.1.1"), nil)
+		So(err, ShouldBeNil)
+		So(response.Body["twoFactorRequired"], ShouldBeTrue)
+		So(response.Body["challengeToken"], ShouldNotBeEmpty)
+		So(response.Body["accessToken"], ShouldBeNil)
+
+		// challenge tokens are not access tokens
+		_, err = verifyToken(response.Body["challengeToken"].(string))
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should exchange the challenge token and a code for the session tokens", t, func() {
+
+		accountFailures = newFailureCounter()
+		addressFailures = newFailureCounter()
+		twoFactor := mockTwoFactorStorage(user)
+		twoFactor["_id"] = "twofactorid"
+		twoFactor["secret"] = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+		twoFactor["enabled"] = true
+		twoFactor["recoveryCodes"] = []interface{}{hashRecoveryCode("abcde-12345")}
+
+		challenge, _ := HandleLogin(makeLoginRequest("johny@bravo.com", "zuhaha", "1.1.1.1"), nil)
+		challengeToken := challenge.Body["challengeToken"]
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"challengeToken": challengeToken, "code": currentTotpCode(twoFactor, 0)}
+		response, err := HandleLoginTwoFactor(requestWrapper)
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusOK)
+		So(response.Body["accessToken"], ShouldEqual, "accesstoken")
+		So(response.Body["refreshToken"], ShouldEqual, "refreshtoken")
+		So(response.Body["password"], ShouldBeNil)
+
+		requestWrapper.Message.Body = map[string]interface{}{"challengeToken": challengeToken, "recoveryCode": "ABCDE12345"}
+		response, err = HandleLoginTwoFactor(requestWrapper)
+		So(err, ShouldBeNil)
+		So(twoFactor["recoveryCodes"], ShouldBeEmpty)
+
+		_, err = HandleLoginTwoFactor(requestWrapper)
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("Should not accept other tokens as the challenge token", t, func() {
+
+		mockTwoFactorStorage(user)
+		accessToken, _ := realGenerateToken("userid", "sessionid", map[string]interface{}{})
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"challengeToken": accessToken, "code": "123456"}
+		_, err := HandleLoginTwoFactor(requestWrapper)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+	})
+
+	Convey("Should lock the account after wrong codes", t, func() {
+
+		accountFailures = newFailureCounter()
+		addressFailures = newFailureCounter()
+		config.SystemConfig.Lockout.MaxAttempts = 2
+		twoFactor := mockTwoFactorStorage(user)
+		twoFactor["_id"] = "twofactorid"
+		twoFactor["secret"] = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+		challengeToken, _ := startTwoFactorChallenge("userid")
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"challengeToken": challengeToken["challengeToken"], "recoveryCode": "wrong"}
+
+		HandleLoginTwoFactor(requestWrapper)
+		HandleLoginTwoFactor(requestWrapper)
+
+		requestWrapper.Message.Body["code"] = currentTotpCode(twoFactor, 0)
+		_, err := HandleLoginTwoFactor(requestWrapper)
+		So(err.Code, ShouldEqual, http.StatusTooManyRequests)
+	})
+
+	accountFailures = newFailureCounter()
+	addressFailures = newFailureCounter()
+	getAccountData = originalGetAccountData
+	startSession = originalStartSession
+	config.SystemConfig = config.Config{}
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"time"
+	"strings"
+	"net/http"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+)
+
+const (
+	UserActionDisable = "disable"
+	UserActionEnable = "enable"
+	UserActionBan = "ban"
+	UserActionForcePasswordChange = "forcepasswordchange"
+	UserActionRevokeSessions = "revokesessions"
+	UserActionImpersonate = "impersonate"
+)
+
+// disabled and banned users get this status on login and with their access tokens, so that the clients can tell them
+// apart from the users with invalid credentials
+const StatusAccountDisabled = http.StatusLocked
+
+var userActions = []string{UserActionDisable, UserActionEnable, UserActionBan, UserActionForcePasswordChange,
+	UserActionRevokeSessions, UserActionImpersonate}
+
+// roles that can manage the other users when 'manage' action of the users is not in the class permissions
+var defaultUserManagerRoles = []string{"role:admin"}
+
+// admin operations on the accounts of the users, like '/users/:id/disable'
+var HandleManageUser = func(requestWrapper messages.RequestWrapper, user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	resParts := strings.Split(strings.Trim(requestWrapper.Message.Res, "/"), "/")
+	userId, action := resParts[1], strings.ToLower(resParts[2])
+
+	account, getErr := adapters.Get(ClassUsers, userId)
+	if getErr != nil {
+		err = &utils.Error{http.StatusNotFound, "User not found."}
+		return
+	}
+
+	// requests with the master key don't have a user
+	var managerId string
+	if user != nil {
+		managerId, _ = user["_id"].(string)
+	}
+
+	if action == UserActionImpersonate {
+		response, err = startImpersonation(requestWrapper, account, managerId)
+		return
+	}
+	if managerId == userId && action != UserActionRevokeSessions {
+		err = &utils.Error{http.StatusBadRequest, "Admins cannot change the status of their own accounts."}
+		return
+	}
+
+	var data map[string]interface{}
+	var reason string
+	switch action {
+	case UserActionDisable:
+		data = map[string]interface{}{"disabled": true}
+	case UserActionEnable:
+		data = map[string]interface{}{"disabled": false, "banned": false, "banReason": nil, "bannedAt": nil}
+	case UserActionBan:
+		reason, _ = requestWrapper.Message.Body["reason"].(string)
+		if strings.TrimSpace(reason) == "" {
+			err = &utils.Error{http.StatusBadRequest, "Reason of the ban must be provided in the body with field 'reason'."}
+			return
+		}
+		data = map[string]interface{}{"banned": true, "banReason": reason, "bannedAt": time.Now().Unix()}
+	case UserActionForcePasswordChange:
+		if !hasPasswordLogin(account) {
+			err = &utils.Error{http.StatusBadRequest, "User doesn't have a password."}
+			return
+		}
+		data = map[string]interface{}{"mustChangePassword": true}
+	}
+
+	if data != nil {
+		_, _, err = adapters.Update(ClassUsers, userId, data)
+		if err != nil {
+			return
+		}
+		for k, v := range data {
+			account[k] = v
+		}
+	}
+
+	// the user logs in again after all the operations except enabling
+	if action != UserActionEnable {
+		err = revokeSessions(userId)
+		if err != nil {
+			return
+		}
+	}
+
+	entry := map[string]interface{}{
+		"action": "manageUser",
+		"operation": action,
+		"userId": userId,
+		"ip": requestWrapper.Message.RemoteAddr,
+	}
+	if managerId != "" {
+		entry["adminId"] = managerId
+	}
+	if reason != "" {
+		entry["reason"] = reason
+	}
+	WriteAuditLog(entry)
+
+	if action == UserActionRevokeSessions {
+		response.Status = http.StatusNoContent
+		return
+	}
+
+	response.Body = map[string]interface{}{
+		"_id": userId,
+		"disabled": account["disabled"] == true,
+		"banned": account["banned"] == true,
+		"mustChangePassword": account["mustChangePassword"] == true,
+	}
+	if account["banned"] == true {
+		response.Body["banReason"] = account["banReason"]
+	}
+	response.Status = http.StatusOK
+	return
+}
+
+// returns true for the admin operations on the users, like '/users/:id/ban'
+func IsUserActionResource(res string) bool {
+
+	resParts := strings.Split(strings.Trim(res, "/"), "/")
+	if len(resParts) != 3 || resParts[0] != ClassUsers || resParts[1] == "me" {
+		return false
+	}
+	for _, action := range userActions {
+		if strings.EqualFold(resParts[2], action) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns error for disabled and banned users. the response contains the reason of the ban.
+func checkAccountStatus(user map[string]interface{}) (response messages.Message, err *utils.Error) {
+
+	if user["banned"] == true {
+		err = &utils.Error{StatusAccountDisabled, "Account is banned."}
+		response.Body = map[string]interface{}{"message": err.Message, "reason": user["banReason"]}
+	} else if user["disabled"] == true {
+		err = &utils.Error{StatusAccountDisabled, "Account is disabled."}
+	}
+	return
+}
+
+func canManageUsers(roles []string) bool {
+
+	managerRoles, isConfigured := config.SystemConfig.Permissions[ClassUsers]["manage"]
+	if !isConfigured {
+		managerRoles = defaultUserManagerRoles
+	}
+	return hasAnyRole(roles, managerRoles, false)
+}
+
+// users who are forced to change their passwords can only change the password or logout
+func isAllowedBeforePasswordChange(res string) bool {
+	return strings.EqualFold(res, ResourceChangePassword) || strings.EqualFold(res, ResourceLogout)
+}
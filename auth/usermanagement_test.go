@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"net/http"
+)
+
+func makeUserActionRequest(userId, action string) (requestWrapper messages.RequestWrapper) {
+
+	requestWrapper.Res = "/users/" + userId + "/" + action
+	requestWrapper.Message.Res = requestWrapper.Res
+	requestWrapper.Message.Command = "post"
+	requestWrapper.Message.Body = make(map[string]interface{})
+	return
+}
+
+func TestManageUser(t *testing.T) {
+
+	originalRevokeSessions := revokeSessions
+	originalGetAccountData := getAccountData
+	config.SystemConfig = config.Config{}
+	admin := map[string]interface{}{"_id": "adminid"}
+
+	var account map[string]interface{}
+	adapters.Get = func(collection string, id string) (response map[string]interface{}, err *utils.Error) {
+		if account == nil {
+			err = &utils.Error{http.StatusNotFound, "Item not found."}
+			return
+		}
+		response = account
+		return
+	}
+	var updatedData map[string]interface{}
+	adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+		updatedData = data
+		return
+	}
+	var revokedUserId string
+	revokeSessions = func(userId string) (err *utils.Error) {
+		revokedUserId = userId
+		return
+	}
+	var auditLog map[string]interface{}
+	adapters.Create = func(collection string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+		auditLog = data
+		return
+	}
+
+	Convey("Should find the user action resources", t, func() {
+
+		So(IsUserActionResource("/users/userid/disable"), ShouldBeTrue)
+		So(IsUserActionResource("/users/userid/revokesessions"), ShouldBeTrue)
+		So(IsUserActionResource("/users/userid"), ShouldBeFalse)
+		So(IsUserActionResource("/users/userid/unknown"), ShouldBeFalse)
+		So(IsUserActionResource("/users/me/disable"), ShouldBeFalse)
+		So(IsUserActionResource("/posts/postid/disable"), ShouldBeFalse)
+	})
+
+	Convey("Should allow user actions only to the admins", t, func() {
+
+		So(canManageUsers([]string{"role:admin", "user:adminid", "*"}), ShouldBeTrue)
+		So(canManageUsers([]string{"role:editor", "user:userid", "*"}), ShouldBeFalse)
+
+		config.SystemConfig.Permissions = map[string]map[string][]string{ClassUsers: {"manage": {"role:support"}}}
+		So(canManageUsers([]string{"role:admin", "user:adminid", "*"}), ShouldBeFalse)
+		So(canManageUsers([]string{"role:support", "user:adminid", "*"}), ShouldBeTrue)
+		config.SystemConfig.Permissions = nil
+	})
+
+	Convey("Should disable and enable the user", t, func() {
+
+		account = map[string]interface{}{"_id": "userid"}
+		revokedUserId = ""
+
+		response, err := HandleManageUser(makeUserActionRequest("userid", UserActionDisable), admin)
+		So(err, ShouldBeNil)
+		So(updatedData, ShouldResemble, map[string]interface{}{"disabled": true})
+		So(response.Body["disabled"], ShouldBeTrue)
+		So(revokedUserId, ShouldEqual, "userid")
+		So(auditLog["operation"], ShouldEqual, UserActionDisable)
+		So(auditLog["adminId"], ShouldEqual, "adminid")
+
+		revokedUserId = ""
+		response, err = HandleManageUser(makeUserActionRequest("userid", UserActionEnable), admin)
+		So(err, ShouldBeNil)
+		So(response.Body["disabled"], ShouldBeFalse)
+		So(revokedUserId, ShouldBeEmpty)
+	})
+
+	Convey("Should ban the user with a reason", t, func() {
+
+		account = map[string]interface{}{"_id": "userid"}
+
+		requestWrapper := makeUserActionRequest("userid", UserActionBan)
+		_, err := HandleManageUser(requestWrapper, admin)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+
+		requestWrapper.Message.Body["reason"] = "Spam."
+		response, err := HandleManageUser(requestWrapper, admin)
+		So(err, ShouldBeNil)
+		So(response.Body["banned"], ShouldBeTrue)
+		So(response.Body["banReason"], ShouldEqual, "Spam.")
+		So(auditLog["reason"], ShouldEqual, "Spam.")
+	})
+
+	Convey("Should force password change only for the users with password", t, func() {
+
+		account = map[string]interface{}{"_id": "userid"}
+		_, err := HandleManageUser(makeUserActionRequest("userid", UserActionForcePasswordChange), admin)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+
+		account = map[string]interface{}{"_id": "userid", "password": "hashedpassword"}
+		response, err := HandleManageUser(makeUserActionRequest("userid", UserActionForcePasswordChange), admin)
+		So(err, ShouldBeNil)
+		So(response.Body["mustChangePassword"], ShouldBeTrue)
+	})
+
+	Convey("Should revoke the sessions of the user", t, func() {
+
+		account = map[string]interface{}{"_id": "userid"}
+		updatedData = nil
+
+		response, err := HandleManageUser(makeUserActionRequest("userid", UserActionRevokeSessions), nil)
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusNoContent)
+		So(updatedData, ShouldBeNil)
+		So(revokedUserId, ShouldEqual, "userid")
+		So(auditLog, ShouldNotContainKey, "adminId")
+	})
+
+	Convey("Should not change the own account of the admin", t, func() {
+
+		account = map[string]interface{}{"_id": "adminid"}
+		_, err := HandleManageUser(makeUserActionRequest("adminid", UserActionDisable), admin)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+
+		account = nil
+		_, err = HandleManageUser(makeUserActionRequest("userid", UserActionDisable), admin)
+		So(err.Code, ShouldEqual, http.StatusNotFound)
+	})
+
+	Convey("Should reject disabled and banned users on login", t, func() {
+
+		getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
+			accountData = map[string]interface{}{
+				// hash of 'zuhaha'
+				"password": "$2a$10$wqvcYHiRvoCy5ZUurNz9wuokDH1DyXjfd8k6Hk4DSJKui76gx1yrO",
+				"_id": "userid",
+				"banned": true,
+				"banReason": "Spam.",
+			}
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"email": "email@domain.com", "password": "zuhaha"}
+
+		response, err := HandleLogin(requestWrapper, &adapters.MongoAdapter{})
+		So(err.Code, ShouldEqual, StatusAccountDisabled)
+		So(response.Body["reason"], ShouldEqual, "Spam.")
+
+		_, err = checkAccountStatus(map[string]interface{}{"disabled": true})
+		So(err.Code, ShouldEqual, StatusAccountDisabled)
+		_, err = checkAccountStatus(map[string]interface{}{"disabled": false})
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Should reject the tokens of disabled users", t, func() {
+
+		LoadSigningKeys(config.TokenConfig{
+			SigningKey: "key1",
+			Keys: []config.SigningKey{{Kid: "key1", Algorithm: "HS256", Secret: "secret1"}},
+		})
+		accessToken, _ := realGenerateToken("userid", "sessionid", map[string]interface{}{})
+
+		account = map[string]interface{}{"_id": "userid", "disabled": true}
+		_, err := verifyToken(accessToken)
+		So(err.Code, ShouldEqual, StatusAccountDisabled)
+	})
+
+	Convey("Should allow only changing the password until it is changed", t, func() {
+
+		So(isAllowedBeforePasswordChange(ResourceChangePassword), ShouldBeTrue)
+		So(isAllowedBeforePasswordChange(ResourceLogout), ShouldBeTrue)
+		So(isAllowedBeforePasswordChange("/posts"), ShouldBeFalse)
+	})
+
+	revokeSessions = originalRevokeSessions
+	getAccountData = originalGetAccountData
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"time"
+	"strings"
+	"net/url"
+	"net/http"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+	"github.com/eluleci/dock/mailer"
+)
+
+const tokenPurposeVerifyEmail = "verifyemail"
+
+const defaultVerificationLifetime = time.Hour * 24
+
+// resend requests that are allowed for an email and for an ip address in an hour
+var resendVerificationEmailLimiter = newRateLimiter(3, time.Hour)
+var resendVerificationAddressLimiter = newRateLimiter(20, time.Hour)
+
+// verifies the email of the user with the token in the link, or sends a new link to the logged in user
+var HandleVerifyEmail = func(requestWrapper messages.RequestWrapper, user interface{}) (response messages.Message, err *utils.Error) {
+
+	var token string
+	if tokens := requestWrapper.Message.Parameters["token"]; len(tokens) > 0 {
+		token = tokens[0]
+	} else if tokenInBody, isString := requestWrapper.Message.Body["token"].(string); isString {
+		token = tokenInBody
+	}
+
+	if token != "" {
+		return verifyEmailWithToken(token)
+	}
+
+	userAsMap, _ := user.(map[string]interface{})
+	if len(userAsMap) == 0 {
+		err = &utils.Error{http.StatusBadRequest, "Verification token must be provided with field 'token'."}
+		return
+	}
+
+	email, _ := userAsMap["email"].(string)
+	if email == "" {
+		err = &utils.Error{http.StatusBadRequest, "User doesn't have an email address."}
+		return
+	}
+	if !isEmailUnverified(userAsMap) {
+		err = &utils.Error{http.StatusConflict, "Email address is already verified."}
+		return
+	}
+
+	// the same user can get a new access token for every request, so the limits are applied to the email and the address
+	emailKey := strings.ToLower(email)
+	isEmailAllowed := resendVerificationEmailLimiter.allow(emailKey)
+	isAddressAllowed := resendVerificationAddressLimiter.allow(requestWrapper.Message.RemoteAddr)
+	if !isEmailAllowed || !isAddressAllowed {
+		retryAfter := resendVerificationEmailLimiter.retryAfter(emailKey)
+		if addressRetryAfter := resendVerificationAddressLimiter.retryAfter(requestWrapper.Message.RemoteAddr); addressRetryAfter > retryAfter {
+			retryAfter = addressRetryAfter
+		}
+		response, err = tooManyRequests(retryAfter, "Too many verification email requests. Try again later.")
+		return
+	}
+
+	err = SendVerificationEmail(userAsMap["_id"].(string), email)
+	if err == nil {
+		response.Status = http.StatusOK
+	}
+	return
+}
+
+func verifyEmailWithToken(token string) (response messages.Message, err *utils.Error) {
+
+	var claims map[string]interface{}
+	claims, err = parsePurposeToken(token, tokenPurposeVerifyEmail)
+	if err != nil {
+		return
+	}
+
+	userId, _ := claims["userId"].(string)
+	user, getErr := adapters.Get(ClassUsers, userId)
+
+	// the link of the old address doesn't verify the new one
+	if getErr != nil || user["email"] != claims["email"] {
+		err = &utils.Error{http.StatusBadRequest, "Token is not valid or expired."}
+		return
+	}
+
+	_, _, err = adapters.Update(ClassUsers, userId, map[string]interface{}{"emailVerified": true})
+	if err != nil {
+		return
+	}
+
+	response.Body = map[string]interface{}{"emailVerified": true}
+	response.Status = http.StatusOK
+	return
+}
+
+// sends an email that contains a signed, expiring verification link
+var SendVerificationEmail = func(userId, email string) (err *utils.Error) {
+
+	verificationConfig := config.SystemConfig.EmailVerification
+	if verificationConfig.Link == "" {
+		err = &utils.Error{http.StatusInternalServerError, "Email verification link is not set in configuration file."}
+		return
+	}
+
+	lifetime := defaultVerificationLifetime
+	if verificationConfig.Lifetime > 0 {
+		lifetime = time.Duration(verificationConfig.Lifetime) * time.Second
+	}
+
+	var token string
+	token, err = signPurposeToken(tokenPurposeVerifyEmail, map[string]interface{}{"userId": userId, "email": email}, lifetime)
+	if err != nil {
+		return
+	}
+
+	link := verificationConfig.Link + url.QueryEscape(token)
+	return mailer.SendTemplate(mailer.TemplateVerifyEmail, email, map[string]interface{}{"link": link, "email": email})
+}
+
+// marks the email as not verified if the update changes it. returns true if the email is changed.
+var PrepareEmailChange = func(userId string, body map[string]interface{}) (isChanged bool) {
+
+	newEmail, hasEmail := body["email"]
+	if !hasEmail {
+		return
+	}
+
+	user, getErr := adapters.Get(ClassUsers, userId)
+	if getErr != nil || user["email"] == newEmail {
+		return
+	}
+
+	body["emailVerified"] = false
+	isChanged = true
+	return
+}
+
+// returns error if the class doesn't accept writes from the users whose emails are not verified yet
+var CheckEmailVerified = func(className string, user map[string]interface{}) (err *utils.Error) {
+
+	if !isEmailUnverified(user) {
+		return
+	}
+
+	for _, blockedClass := range config.SystemConfig.EmailVerification.BlockWrites {
+		if blockedClass == "*" || blockedClass == className {
+			err = &utils.Error{http.StatusForbidden, "Email address must be verified first."}
+			return
+		}
+	}
+	return
+}
+
+// returns true for the users who have an email address that is not verified
+func isEmailUnverified(user map[string]interface{}) bool {
+
+	email, _ := user["email"].(string)
+	isVerified, _ := user["emailVerified"].(bool)
+	return email != "" && !isVerified
+}
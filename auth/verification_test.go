@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/messages"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"github.com/eluleci/dock/mailer"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func TestHandleVerifyEmail(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+	config.SystemConfig.EmailVerification = config.EmailVerificationConfig{
+		Enabled: true,
+		Link: "https://api.domain.com/verifyemail?token=",
+	}
+	LoadSigningKeys(config.TokenConfig{
+		SigningKey: "key1",
+		Keys: []config.SigningKey{{Kid: "key1", Algorithm: "HS256", Secret: "secret1"}},
+	})
+
+	originalSendTemplate := mailer.SendTemplate
+
+	var sentTemplate, sentLink string
+	mailer.SendTemplate = func(templateName, to string, data map[string]interface{}) (err *utils.Error) {
+		sentTemplate = templateName
+		sentLink = data["link"].(string)
+		return
+	}
+
+	Convey("Should send verification email with a link", t, func() {
+
+		err := SendVerificationEmail("userid", "user@domain.com")
+		So(err, ShouldBeNil)
+		So(sentTemplate, ShouldEqual, mailer.TemplateVerifyEmail)
+		So(sentLink, ShouldStartWith, "https://api.domain.com/verifyemail?token=")
+	})
+
+	Convey("Should verify the email with the token in the link", t, func() {
+
+		SendVerificationEmail("userid", "user@domain.com")
+		token, _ := url.QueryUnescape(strings.TrimPrefix(sentLink, "https://api.domain.com/verifyemail?token="))
+
+		adapters.Get = func(collection string, id string) (response map[string]interface{}, err *utils.Error) {
+			response = map[string]interface{}{"_id": id, "email": "user@domain.com"}
+			return
+		}
+
+		var updatedUser map[string]interface{}
+		adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+			updatedUser = data
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Parameters = map[string][]string{"token": {token}}
+
+		response, err := HandleVerifyEmail(requestWrapper, nil)
+		So(err, ShouldBeNil)
+		So(response.Status, ShouldEqual, http.StatusOK)
+		So(updatedUser["emailVerified"], ShouldBeTrue)
+	})
+
+	Convey("Should not verify the email if the email is changed after sending the link", t, func() {
+
+		token, _ := signPurposeToken(tokenPurposeVerifyEmail, map[string]interface{}{"userId": "userid", "email": "old@domain.com"}, time.Hour)
+
+		adapters.Get = func(collection string, id string) (response map[string]interface{}, err *utils.Error) {
+			response = map[string]interface{}{"_id": id, "email": "new@domain.com"}
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"token": token}
+
+		_, err := HandleVerifyEmail(requestWrapper, nil)
+		So(err.Code, ShouldEqual, http.StatusBadRequest)
+	})
+
+	Convey("Should not accept expired tokens and access tokens", t, func() {
+
+		expiredToken, _ := signPurposeToken(tokenPurposeVerifyEmail, map[string]interface{}{"userId": "userid", "email": "user@domain.com"}, -time.Hour)
+		accessToken, _ := realGenerateToken("userid", "sessionid", map[string]interface{}{"email": "user@domain.com"})
+
+		for _, token := range []string{expiredToken, accessToken} {
+			var requestWrapper messages.RequestWrapper
+			requestWrapper.Message.Body = map[string]interface{}{"token": token}
+
+			_, err := HandleVerifyEmail(requestWrapper, nil)
+			So(err.Code, ShouldEqual, http.StatusBadRequest)
+		}
+	})
+
+	Convey("Should not accept verification tokens as access tokens", t, func() {
+
+		token, _ := signPurposeToken(tokenPurposeVerifyEmail, map[string]interface{}{"userId": "userid", "email": "user@domain.com"}, time.Hour)
+
+		_, err := verifyToken(token)
+		So(err.Code, ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("Should limit the requests for new links", t, func() {
+
+		resendVerificationEmailLimiter = newRateLimiter(2, time.Hour)
+		resendVerificationAddressLimiter = newRateLimiter(4, time.Hour)
+
+		user := map[string]interface{}{"_id": "userid", "email": "user@domain.com"}
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.RemoteAddr = "1.1.1.1"
+
+		for i := 0; i < 2; i++ {
+			response, err := HandleVerifyEmail(requestWrapper, user)
+			So(err, ShouldBeNil)
+			So(response.Status, ShouldEqual, http.StatusOK)
+		}
+
+		sentLink = ""
+		response, err := HandleVerifyEmail(requestWrapper, user)
+		So(err.Code, ShouldEqual, http.StatusTooManyRequests)
+		So(response.Headers["Retry-After"], ShouldNotBeEmpty)
+		So(sentLink, ShouldBeEmpty)
+
+		// the address is limited for the other emails too
+		otherUser := map[string]interface{}{"_id": "otheruserid", "email": "other@domain.com"}
+		_, err = HandleVerifyEmail(requestWrapper, otherUser)
+		So(err, ShouldBeNil)
+		_, err = HandleVerifyEmail(requestWrapper, otherUser)
+		So(err.Code, ShouldEqual, http.StatusTooManyRequests)
+
+		resendVerificationEmailLimiter = newRateLimiter(3, time.Hour)
+		resendVerificationAddressLimiter = newRateLimiter(20, time.Hour)
+	})
+
+	Convey("Should not send a new link for verified emails", t, func() {
+
+		user := map[string]interface{}{"_id": "userid", "email": "user@domain.com", "emailVerified": true}
+
+		_, err := HandleVerifyEmail(messages.RequestWrapper{}, user)
+		So(err.Code, ShouldEqual, http.StatusConflict)
+	})
+
+	mailer.SendTemplate = originalSendTemplate
+	config.SystemConfig = config.Config{}
+}
+
+func TestCheckEmailVerified(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+	config.SystemConfig.EmailVerification.BlockWrites = []string{"posts"}
+
+	Convey("Should block writes to the listed classes until email is verified", t, func() {
+
+		unverifiedUser := map[string]interface{}{"_id": "userid", "email": "user@domain.com"}
+		verifiedUser := map[string]interface{}{"_id": "userid", "email": "user@domain.com", "emailVerified": true}
+
+		So(CheckEmailVerified("posts", unverifiedUser).Code, ShouldEqual, http.StatusForbidden)
+		So(CheckEmailVerified("comments", unverifiedUser), ShouldBeNil)
+		So(CheckEmailVerified("posts", verifiedUser), ShouldBeNil)
+		So(CheckEmailVerified("posts", nil), ShouldBeNil)
+	})
+
+	Convey("Should block writes to all classes", t, func() {
+
+		config.SystemConfig.EmailVerification.BlockWrites = []string{"*"}
+
+		unverifiedUser := map[string]interface{}{"_id": "userid", "email": "user@domain.com"}
+		So(CheckEmailVerified("comments", unverifiedUser).Code, ShouldEqual, http.StatusForbidden)
+	})
+
+	config.SystemConfig = config.Config{}
+}
+
+func TestLoginWithUnverifiedEmail(t *testing.T) {
+
+	config.SystemConfig = config.Config{}
+	config.SystemConfig.EmailVerification.BlockLogin = true
+	originalGetAccountData := getAccountData
+
+	Convey("Should not allow login until email is verified", t, func() {
+
+		getAccountData = func(requestWrapper messages.RequestWrapper, dbAdapter *adapters.MongoAdapter) (accountData map[string]interface{}, err *utils.Error) {
+			accountData = map[string]interface{}{
+				"_id": "userid",
+				"email": "user@domain.com",
+				// hased of 'zuhaha'
+				"password": "$2a$10$wqvcYHiRvoCy5ZUurNz9wuokDH1DyXjfd8k6Hk4DSJKui76gx1yrO",
+			}
+			return
+		}
+
+		var requestWrapper messages.RequestWrapper
+		requestWrapper.Message.Body = map[string]interface{}{"email": "user@domain.com", "password": "zuhaha"}
+
+		_, err := HandleLogin(requestWrapper, &adapters.MongoAdapter{})
+		So(err.Code, ShouldEqual, http.StatusForbidden)
+	})
+
+	getAccountData = originalGetAccountData
+	config.SystemConfig = config.Config{}
+}
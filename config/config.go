@@ -19,17 +19,305 @@ type Config struct {
 	 */
 	Google      	map[string]string `json:"google,omitempty"`
 
-	/* Reset password configuration. Used for sending email to users when they reset their passwords.
-	 *
-	 *
+	/*
+	 * OpenID Connect providers. Maps provider names to their configurations. Users sign up and login with the id
+	 * tokens of the providers under the provider name, like {"apple": {"idToken": "..."}}.
+	 */
+	Oidc            map[string]OidcProviderConfig `json:"oidc,omitempty"`
+
+	/* Reset password configuration. Used for sending reset password links to users. Fields:
+	 * link:			Address that the reset password token is appended to (required)
+	 * linkLifetime:	Lifetime of the links in seconds. Default is 1 hour
+	 * smtpServer, smtpPort, senderEmail, senderEmailPassword: Smtp settings that are used when 'mail' is not set
 	 */
 	ResetPassword 	map[string]string `json:"resetPassword,omitempty"`
 
+	/*
+	 * Mail configuration. Used for sending all the system emails.
+	 */
+	Mail            MailConfig `json:"mail,omitempty"`
+
 	/*
 	 * Custom functions configuration.
 	 */
 	Functions       map[string]interface{} `json:"functions,omitempty"`
 
+	/* Class level permissions. Maps class names to actions and the roles that are allowed to perform them, like:
+	 * "roles": {"create": ["role:admin"], "query": ["*"]}
+	 * Actions that are not listed are allowed to everyone. 'manage' action of 'users' gives the roles that can disable,
+	 * ban and enable the users. Default is 'role:admin'.
+	 */
+	Permissions     map[string]map[string][]string `json:"permissions,omitempty"`
+
+	/*
+	 * Field level permissions. Maps class names to the rules of their fields.
+	 */
+	Fields          map[string]FieldRules `json:"fields,omitempty"`
+
+	/* Default acl templates. Maps class names to the acl that is given to the objects which are created without
+	 * '_acl'. '*' is used for the classes that don't have a template. Besides '*', 'role:<name>' and 'user:<id>',
+	 * the template can contain these keys:
+	 * creator:		The user who creates the object
+	 * owner:		The user in the '_owner' field of the object
+	 */
+	DefaultAcl      map[string]map[string]map[string]bool `json:"defaultAcl,omitempty"`
+
+	/*
+	 * Access token configuration. Used for signing and verifying access tokens.
+	 */
+	Token           TokenConfig `json:"token,omitempty"`
+
+	/*
+	 * Email verification configuration.
+	 */
+	EmailVerification EmailVerificationConfig `json:"emailVerification,omitempty"`
+
+	/*
+	 * Brute-force protection of login, reset password and change password.
+	 */
+	Lockout         LockoutConfig `json:"lockout,omitempty"`
+
+	/*
+	 * Password policy and hashing configuration.
+	 */
+	Password        PasswordConfig `json:"password,omitempty"`
+
+	/*
+	 * Two-factor authentication configuration.
+	 */
+	TwoFactor       TwoFactorConfig `json:"twoFactor,omitempty"`
+
+	/*
+	 * Server keys that are sent in 'X-Api-Key' header instead of access tokens, like by backend jobs.
+	 */
+	ApiKeys         []ApiKeyConfig `json:"apiKeys,omitempty"`
+
+	/*
+	 * What happens to the objects of the users when they delete their accounts. Maps class names to the rules of
+	 * their objects. '*' is used for the classes that don't have rules.
+	 */
+	AccountData     map[string]AccountDataRules `json:"accountData,omitempty"`
+
+	/*
+	 * Requests to the hook servers. After triggers are sent in background and retried when they fail.
+	 */
+	Hooks           HooksConfig `json:"hooks,omitempty"`
+
+}
+
+/* Rules of the fields of a class. Available fields:
+ * hidden:		Fields that are never returned to clients
+ * visibleTo:	Fields that are returned only to the listed roles. 'owner' stands for the owner of the object
+ * readOnly:	Fields that clients cannot write
+ * ownerOnly:	Fields that can be written only by the owner of the object
+ */
+type FieldRules struct {
+	Hidden    []string `json:"hidden,omitempty"`
+	VisibleTo map[string][]string `json:"visibleTo,omitempty"`
+	ReadOnly  []string `json:"readOnly,omitempty"`
+	OwnerOnly []string `json:"ownerOnly,omitempty"`
+}
+
+/* Access token configuration. Available fields:
+ * lifetime:			Lifetime of the access tokens in seconds. Default is 1 hour
+ * refreshLifetime:	Lifetime of the refresh tokens in seconds. Refreshing extends it. Default is 30 days
+ * signingKey:		Id of the key that is used for signing new tokens (required)
+ * keys:			Keys that are used for verifying tokens. The tokens that are signed with a key stay valid until
+ *					the key is removed from this list (required)
+ * impersonationLifetime:	Lifetime of the tokens that admins get for impersonating users in seconds. The tokens
+ *					cannot be refreshed. Default is 15 minutes
+ */
+type TokenConfig struct {
+	Lifetime        int `json:"lifetime,omitempty"`
+	RefreshLifetime int `json:"refreshLifetime,omitempty"`
+	ImpersonationLifetime int `json:"impersonationLifetime,omitempty"`
+	SigningKey      string `json:"signingKey,omitempty"`
+	Keys            []SigningKey `json:"keys,omitempty"`
+}
+
+/* A key for signing access tokens. Available fields:
+ * kid:				Id of the key which is written to the header of the tokens (required)
+ * algorithm:		One of HS256, HS384, HS512, RS256, RS384, RS512, ES256, ES384, ES512 (required)
+ * secret:			Secret of HMAC algorithms
+ * privateKey:		PEM encoded private key of RSA and ECDSA algorithms. 'privateKeyFile' can be used instead
+ * publicKey:		PEM encoded public key of RSA and ECDSA algorithms. 'publicKeyFile' can be used instead. Keys
+ *					with only public key can verify tokens but cannot sign them
+ */
+type SigningKey struct {
+	Kid            string `json:"kid,omitempty"`
+	Algorithm      string `json:"algorithm,omitempty"`
+	Secret         string `json:"secret,omitempty"`
+	PrivateKey     string `json:"privateKey,omitempty"`
+	PrivateKeyFile string `json:"privateKeyFile,omitempty"`
+	PublicKey      string `json:"publicKey,omitempty"`
+	PublicKeyFile  string `json:"publicKeyFile,omitempty"`
+}
+
+/* Email verification configuration. Available fields:
+ * enabled:		Sends verification emails on sign up and on email changes
+ * lifetime:	Lifetime of the verification links in seconds. Default is 24 hours
+ * link:		Address that the token is appended to, like 'https://api.myapp.com/verifyemail?token=' (required)
+ * blockLogin:	Doesn't allow login until the email is verified
+ * blockWrites:	Classes that the users cannot write to until their emails are verified. '*' blocks all classes
+ */
+type EmailVerificationConfig struct {
+	Enabled     bool `json:"enabled,omitempty"`
+	Lifetime    int `json:"lifetime,omitempty"`
+	Link        string `json:"link,omitempty"`
+	BlockLogin  bool `json:"blockLogin,omitempty"`
+	BlockWrites []string `json:"blockWrites,omitempty"`
+}
+
+/* Brute-force protection configuration. Failed password attempts are counted per account and per ip address.
+ * Available fields:
+ * maxAttempts:			Failed attempts after which the account is locked. Default is 5
+ * maxAddressAttempts:	Failed attempts after which the ip address is locked. Default is 50
+ * window:				Seconds that the failed attempts are counted in. Default is 15 minutes
+ * duration:			Seconds of the first lockout. Each failed attempt after the limit doubles it. Default is 1 minute
+ * maxDuration:			Longest lockout in seconds. Default is 1 hour
+ */
+type LockoutConfig struct {
+	MaxAttempts        int `json:"maxAttempts,omitempty"`
+	MaxAddressAttempts int `json:"maxAddressAttempts,omitempty"`
+	Window             int `json:"window,omitempty"`
+	Duration           int `json:"duration,omitempty"`
+	MaxDuration        int `json:"maxDuration,omitempty"`
+}
+
+/* Password configuration. Passwords that don't meet the rules are rejected. Passwords that are the same as the
+ * username or the email, and the most common passwords are always rejected. Available fields:
+ * minLength:			Minimum number of characters. Default is 8
+ * requireLowercase:	Passwords must contain a lowercase letter
+ * requireUppercase:	Passwords must contain an uppercase letter
+ * requireDigit:		Passwords must contain a digit
+ * requireSymbol:		Passwords must contain a character that is not a letter or a digit
+ * denylist:			Passwords that are rejected in addition to the most common ones
+ * hashCost:			Bcrypt cost of the password hashes, between 4 and 31. Passwords with lower costs are rehashed on
+ *					login. Default is 10
+ */
+type PasswordConfig struct {
+	MinLength        int `json:"minLength,omitempty"`
+	RequireLowercase bool `json:"requireLowercase,omitempty"`
+	RequireUppercase bool `json:"requireUppercase,omitempty"`
+	RequireDigit     bool `json:"requireDigit,omitempty"`
+	RequireSymbol    bool `json:"requireSymbol,omitempty"`
+	Denylist         []string `json:"denylist,omitempty"`
+	HashCost         int `json:"hashCost,omitempty"`
+}
+
+/* Two-factor authentication configuration. Available fields:
+ * issuer:				Name that authenticator apps show for the accounts. Default is 'Dock'
+ * challengeLifetime:	Seconds that the second step of the login can be done in. Default is 5 minutes
+ */
+type TwoFactorConfig struct {
+	Issuer            string `json:"issuer,omitempty"`
+	ChallengeLifetime int `json:"challengeLifetime,omitempty"`
+}
+
+/* OpenID Connect provider configuration. Id tokens are verified with the keys of the provider. Available fields:
+ * issuer:			Issuer of the id tokens, like 'https://accounts.google.com' (required)
+ * clientIds:		Client ids of the app. Id tokens must be issued for one of them (required)
+ * jwksUrl:			Address of the keys of the provider, like 'https://www.googleapis.com/oauth2/v3/certs' (required)
+ * requireNonce:	Requests must contain the nonce that the id token is requested with
+ */
+type OidcProviderConfig struct {
+	Issuer       string `json:"issuer,omitempty"`
+	ClientIds    []string `json:"clientIds,omitempty"`
+	JwksUrl      string `json:"jwksUrl,omitempty"`
+	RequireNonce bool `json:"requireNonce,omitempty"`
+}
+
+/* Mail configuration. Available fields:
+ * transport:	One of 'smtp', 'file' and 'log'. Default is 'smtp'
+ * from:		Address that the emails are sent from (required for smtp)
+ * smtp:		Smtp server settings
+ * file:		File that the emails are appended to with 'file' transport
+ * templates:	Named templates that override the default templates, like 'resetPassword' and 'verifyEmail'
+ */
+type MailConfig struct {
+	Transport string `json:"transport,omitempty"`
+	From      string `json:"from,omitempty"`
+	Smtp      SmtpConfig `json:"smtp,omitempty"`
+	File      string `json:"file,omitempty"`
+	Templates map[string]MailTemplate `json:"templates,omitempty"`
+}
+
+/* Smtp server settings. Available fields:
+ * host:		Address of the smtp server (required)
+ * port:		Port of the smtp server. Default is 465 for 'tls' and 587 for the others
+ * username:	Username for authentication. No authentication is done if it is empty
+ * password:	Password for authentication
+ * security:	'starttls' requires STARTTLS, 'tls' connects with implicit TLS, 'none' never encrypts. By default
+ *				STARTTLS is used if the server supports it
+ */
+type SmtpConfig struct {
+	Host     string `json:"host,omitempty"`
+	Port     int `json:"port,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Security string `json:"security,omitempty"`
+}
+
+/* An email template. Templates are parsed with html/template for html and text/template for subject and text.
+ * Available fields:
+ * subject:		Subject of the email
+ * html:		Html content of the email. 'htmlFile' can be used instead
+ * text:		Plain text alternative of the html content. 'textFile' can be used instead
+ */
+type MailTemplate struct {
+	Subject  string `json:"subject,omitempty"`
+	Html     string `json:"html,omitempty"`
+	HtmlFile string `json:"htmlFile,omitempty"`
+	Text     string `json:"text,omitempty"`
+	TextFile string `json:"textFile,omitempty"`
 }
 
 var SystemConfig Config
+
+/* A server key. Requests with the key are not restricted by the acl of the objects. Available fields:
+ * name:		Name of the key that is written to the audit logs (required)
+ * key:			Secret that is sent in 'X-Api-Key' header (required)
+ * scope:		One of 'master', 'readonly' and 'classes'. Master key can do everything, bypasses the field rules and can
+ *				set the protected fields like '_acl' and '_roles'. Read-only key can only read. Class keys can only
+ *				access the classes in 'classes' (required)
+ * classes:		Classes that the key can access when the scope is 'classes'
+ */
+type ApiKeyConfig struct {
+	Name    string `json:"name,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Scope   string `json:"scope,omitempty"`
+	Classes []string `json:"classes,omitempty"`
+}
+
+/* Rules of the objects of a user in a class. Available fields:
+ * userFields:		Fields that reference the user, like 'author'. The objects of the user are the ones that have the
+ *					user in one of these fields. Default is '_owner'
+ * onDelete:		One of 'delete', 'anonymize' and 'keep'. Anonymizing removes the user and 'personalFields' from the
+ *					objects. Default is 'keep'
+ * personalFields:	Fields that are removed from the objects when they are anonymized
+ */
+type AccountDataRules struct {
+	UserFields     []string `json:"userFields,omitempty"`
+	OnDelete       string `json:"onDelete,omitempty"`
+	PersonalFields []string `json:"personalFields,omitempty"`
+}
+
+/* Delivery configuration of the after triggers. Available fields:
+ * workers:			Number of the workers that send the triggers to the hook servers. Default is 2
+ * maxAttempts:		Number of the attempts before a trigger is moved to the dead letters. Default is 8
+ * retryDelay:		Delay before the first retry in seconds. It is doubled on every retry. Default is 10 seconds
+ * maxRetryDelay:	Maximum delay between the retries in seconds. Default is 1 hour
+ * timeout:			Timeout of the requests to the hook servers in seconds. Default is 10 seconds
+ * secret:			Secret that the trigger and function requests are signed with
+ * secrets:			Maps the urls of the hook servers to their own secrets. The secret of the longest url that the
+ *					request url starts with is used instead of 'secret'
+ */
+type HooksConfig struct {
+	Workers       int `json:"workers,omitempty"`
+	MaxAttempts   int `json:"maxAttempts,omitempty"`
+	RetryDelay    int `json:"retryDelay,omitempty"`
+	MaxRetryDelay int `json:"maxRetryDelay,omitempty"`
+	Timeout       int `json:"timeout,omitempty"`
+	Secret        string `json:"secret,omitempty"`
+	Secrets       map[string]string `json:"secrets,omitempty"`
+}
@@ -0,0 +1,258 @@
+package hooks
+
+import (
+	"time"
+	"bytes"
+	"strconv"
+	"net/http"
+	"encoding/json"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+	"github.com/eluleci/dock/adapters"
+)
+
+const (
+	ClassHookQueue = "hookqueue"
+	ClassHookDeadLetters = "hookdeadletters"
+)
+
+const (
+	defaultQueueWorkers = 2
+	defaultMaxAttempts = 8
+	defaultRetryDelay = 10 * time.Second
+	defaultMaxRetryDelay = time.Hour
+	defaultHookTimeout = 10 * time.Second
+	// how often the workers look for jobs when the queue is empty
+	queuePollInterval = time.Second
+)
+
+var queueWorkers = defaultQueueWorkers
+var maxAttempts = defaultMaxAttempts
+var retryDelay = defaultRetryDelay
+var maxRetryDelay = defaultMaxRetryDelay
+var hookClient = &http.Client{Timeout: defaultHookTimeout}
+
+// wakes up a waiting worker when a job is enqueued
+var queueSignal = make(chan bool, 1)
+
+// loads the delivery settings of the after triggers and the secrets of the hook servers
+var Load = func(hooksConfig config.HooksConfig) (err *utils.Error) {
+
+	if hooksConfig.Workers < 0 || hooksConfig.MaxAttempts < 0 || hooksConfig.RetryDelay < 0 ||
+	hooksConfig.MaxRetryDelay < 0 || hooksConfig.Timeout < 0 {
+		err = &utils.Error{http.StatusInternalServerError, "Hooks configuration values cannot be negative."}
+		return
+	}
+
+	queueWorkers = defaultQueueWorkers
+	if hooksConfig.Workers > 0 {
+		queueWorkers = hooksConfig.Workers
+	}
+	maxAttempts = defaultMaxAttempts
+	if hooksConfig.MaxAttempts > 0 {
+		maxAttempts = hooksConfig.MaxAttempts
+	}
+	retryDelay = defaultRetryDelay
+	if hooksConfig.RetryDelay > 0 {
+		retryDelay = time.Duration(hooksConfig.RetryDelay) * time.Second
+	}
+	maxRetryDelay = defaultMaxRetryDelay
+	if hooksConfig.MaxRetryDelay > 0 {
+		maxRetryDelay = time.Duration(hooksConfig.MaxRetryDelay) * time.Second
+	}
+	hookTimeout := defaultHookTimeout
+	if hooksConfig.Timeout > 0 {
+		hookTimeout = time.Duration(hooksConfig.Timeout) * time.Second
+	}
+	hookClient = &http.Client{Timeout: hookTimeout}
+
+	signingSecret = hooksConfig.Secret
+	signingSecrets = hooksConfig.Secrets
+	return
+}
+
+// starts the workers that deliver the jobs in the queue. the jobs that are left from the previous run are delivered too.
+func StartQueueWorkers() {
+	for i := 0; i < queueWorkers; i++ {
+		go runQueueWorker()
+	}
+}
+
+// saves the trigger to the queue to be sent in background. nothing is saved if there is no trigger for the request.
+var EnqueueTrigger = func(className, when, method string, parameters map[string][]string, body map[string]interface{}, user interface{}) (err *utils.Error) {
+
+	triggerData, err := getTriggerData(className, when, method)
+	if err != nil {
+		if err.Code == http.StatusNotFound {
+			err = nil
+		}
+		return
+	}
+
+	// the payload is saved as it is sent, since the keys of the body may not be valid field names in the database
+	payload, encodeErr := json.Marshal(map[string]interface{}{
+		"user": user,
+		"parameters": parameters,
+		"body": body,
+	})
+	if encodeErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Encoding trigger request data failed."}
+		return
+	}
+
+	job := map[string]interface{}{
+		"url": triggerData["url"],
+		"className": className,
+		"when": when,
+		"method": method,
+		"payload": string(payload),
+		"attempts": 0,
+		"nextAttemptAt": time.Now().Unix(),
+		"lockedUntil": int64(0),
+		"_acl": map[string]interface{}{},
+	}
+	_, _, err = adapters.Create(ClassHookQueue, job)
+	if err != nil {
+		return
+	}
+
+	select {
+	case queueSignal <- true:
+	default:
+	}
+	return
+}
+
+func runQueueWorker() {
+	for {
+		processed, err := processNextJob()
+		if err != nil && err.Code != http.StatusNotFound {
+			utils.Log("error", "Processing hook queue failed: " + err.Message)
+		}
+		if !processed {
+			select {
+			case <-queueSignal:
+			case <-time.After(queuePollInterval):
+			}
+		}
+	}
+}
+
+// takes the next job that is due and sends it. the job is locked while it is sent, so the other workers don't take it.
+// the lock expires if the server stops before the job is finished, and the job is sent again.
+var processNextJob = func() (processed bool, err *utils.Error) {
+
+	now := time.Now()
+	where := map[string]interface{}{
+		"nextAttemptAt": map[string]interface{}{"$lte": now.Unix()},
+		"lockedUntil": map[string]interface{}{"$lte": now.Unix()},
+	}
+	lock := map[string]interface{}{
+		"lockedUntil": now.Add(2 * hookClient.Timeout).Unix(),
+	}
+	job, err := adapters.FindAndUpdate(ClassHookQueue, where, "nextAttemptAt", lock)
+	if err != nil {
+		return
+	}
+	processed = true
+
+	jobId, _ := job["_id"].(string)
+	url, _ := job["url"].(string)
+	payload, _ := job["payload"].(string)
+
+	deliveryErr := deliverTrigger(url, []byte(payload))
+	if deliveryErr == nil {
+		_, err = adapters.Delete(ClassHookQueue, jobId)
+		return
+	}
+
+	attempts := toInt(job["attempts"]) + 1
+	if attempts >= maxAttempts {
+		err = moveToDeadLetters(job, attempts, deliveryErr.Message)
+		return
+	}
+
+	_, _, err = adapters.Update(ClassHookQueue, jobId, map[string]interface{}{
+		"attempts": attempts,
+		"nextAttemptAt": time.Now().Add(getRetryDelay(attempts)).Unix(),
+		"lockedUntil": int64(0),
+		"lastError": deliveryErr.Message,
+	})
+	return
+}
+
+// sends the payload to the hook server. the responses other than 2xx are failures.
+var deliverTrigger = func(url string, payload []byte) (err *utils.Error) {
+
+	req, createRequestErr := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	if createRequestErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Creating request to hook server failed."}
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// signed when it is sent, so the timestamp of a retry is not older than the tolerance of the hook server
+	signRequest(req, url, payload)
+
+	resp, requestErr := hookClient.Do(req)
+	if requestErr != nil {
+		err = &utils.Error{http.StatusBadGateway, "Sending request to hook server failed."}
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = &utils.Error{resp.StatusCode, "Hook server responded with status " + strconv.Itoa(resp.StatusCode) + "."}
+	}
+	return
+}
+
+func moveToDeadLetters(job map[string]interface{}, attempts int, lastError string) (err *utils.Error) {
+
+	deadLetter := map[string]interface{}{
+		"jobId": job["_id"],
+		"url": job["url"],
+		"className": job["className"],
+		"when": job["when"],
+		"method": job["method"],
+		"payload": job["payload"],
+		"attempts": attempts,
+		"lastError": lastError,
+		"failedAt": time.Now().Unix(),
+		"_acl": map[string]interface{}{},
+	}
+	_, _, err = adapters.Create(ClassHookDeadLetters, deadLetter)
+	if err != nil {
+		return
+	}
+
+	jobId, _ := job["_id"].(string)
+	_, err = adapters.Delete(ClassHookQueue, jobId)
+	return
+}
+
+// the delay is doubled after every failed attempt until it reaches the maximum
+func getRetryDelay(attempts int) time.Duration {
+
+	delay := retryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+func toInt(value interface{}) int {
+	switch number := value.(type) {
+	case int:
+		return number
+	case int32:
+		return int(number)
+	case int64:
+		return int(number)
+	case float64:
+		return int(number)
+	}
+	return 0
+}
@@ -0,0 +1,148 @@
+package hooks
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/config"
+	"github.com/eluleci/dock/utils"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+
+	originalGetTriggerData := getTriggerData
+	Load(config.HooksConfig{RetryDelay: 10, MaxRetryDelay: 60, MaxAttempts: 3})
+
+	getTriggerData = func(className, when, method string) (trigger map[string]interface{}, err *utils.Error) {
+		if className != "posts" {
+			err = &utils.Error{http.StatusNotFound, "Trigger not found."}
+			return
+		}
+		trigger = map[string]interface{}{"url": "http://hooks/posts"}
+		return
+	}
+
+	var createdClass string
+	var createdData map[string]interface{}
+	adapters.Create = func(collection string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+		createdClass = collection
+		createdData = data
+		return
+	}
+	var job map[string]interface{}
+	adapters.FindAndUpdate = func(collection string, where map[string]interface{}, sort string, data map[string]interface{}) (response map[string]interface{}, err *utils.Error) {
+		if job == nil {
+			err = &utils.Error{http.StatusNotFound, "Item not found."}
+			return
+		}
+		response = job
+		return
+	}
+	var deletedId string
+	adapters.Delete = func(collection string, id string) (response map[string]interface{}, err *utils.Error) {
+		deletedId = id
+		return
+	}
+	var updatedData map[string]interface{}
+	adapters.Update = func(collection string, id string, data map[string]interface{}) (response map[string]interface{}, hookBody map[string]interface{}, err *utils.Error) {
+		updatedData = data
+		return
+	}
+
+	Convey("Should save the after trigger to the queue", t, func() {
+
+		createdData = nil
+		err := EnqueueTrigger("comments", "after", "post", nil, map[string]interface{}{}, nil)
+		So(err, ShouldBeNil)
+		So(createdData, ShouldBeNil)
+
+		body := map[string]interface{}{"_id": "postid", "title": "Hello"}
+		err = EnqueueTrigger("posts", "after", "post", nil, body, map[string]interface{}{"_id": "userid"})
+		So(err, ShouldBeNil)
+		So(createdClass, ShouldEqual, ClassHookQueue)
+		So(createdData["url"], ShouldEqual, "http://hooks/posts")
+		So(createdData["attempts"], ShouldEqual, 0)
+
+		var payload map[string]interface{}
+		json.Unmarshal([]byte(createdData["payload"].(string)), &payload)
+		So(payload["body"], ShouldResemble, body)
+		So(payload["user"], ShouldResemble, map[string]interface{}{"_id": "userid"})
+	})
+
+	Convey("Should delete the job after it is delivered", t, func() {
+
+		var receivedBody map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&receivedBody)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		job = map[string]interface{}{"_id": "jobid", "url": server.URL, "payload": `{"body":{"_id":"postid"}}`, "attempts": 0}
+		processed, err := processNextJob()
+		So(err, ShouldBeNil)
+		So(processed, ShouldBeTrue)
+		So(deletedId, ShouldEqual, "jobid")
+		So(receivedBody["body"], ShouldResemble, map[string]interface{}{"_id": "postid"})
+	})
+
+	Convey("Should retry the failed job with back-off", t, func() {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		deletedId = ""
+		job = map[string]interface{}{"_id": "jobid", "url": server.URL, "payload": "{}", "attempts": int64(1)}
+		_, err := processNextJob()
+		So(err, ShouldBeNil)
+		So(deletedId, ShouldBeEmpty)
+		So(updatedData["attempts"], ShouldEqual, 2)
+		So(updatedData["lockedUntil"], ShouldEqual, 0)
+		So(updatedData["lastError"], ShouldEqual, "Hook server responded with status 503.")
+		So(updatedData["nextAttemptAt"], ShouldBeGreaterThanOrEqualTo, time.Now().Add(20 * time.Second).Unix())
+	})
+
+	Convey("Should move the job to the dead letters after the last attempt", t, func() {
+
+		job = map[string]interface{}{"_id": "jobid", "url": "http://127.0.0.1:0", "payload": "{}", "attempts": 2}
+		_, err := processNextJob()
+		So(err, ShouldBeNil)
+		So(createdClass, ShouldEqual, ClassHookDeadLetters)
+		So(createdData["jobId"], ShouldEqual, "jobid")
+		So(createdData["attempts"], ShouldEqual, 3)
+		So(createdData["lastError"], ShouldEqual, "Sending request to hook server failed.")
+		So(deletedId, ShouldEqual, "jobid")
+	})
+
+	Convey("Should return not found when there is no job", t, func() {
+
+		job = nil
+		processed, err := processNextJob()
+		So(processed, ShouldBeFalse)
+		So(err.Code, ShouldEqual, http.StatusNotFound)
+	})
+
+	Convey("Should double the retry delay until the maximum", t, func() {
+
+		So(getRetryDelay(1), ShouldEqual, 10 * time.Second)
+		So(getRetryDelay(2), ShouldEqual, 20 * time.Second)
+		So(getRetryDelay(3), ShouldEqual, 40 * time.Second)
+		So(getRetryDelay(4), ShouldEqual, 60 * time.Second)
+		So(getRetryDelay(100), ShouldEqual, 60 * time.Second)
+	})
+
+	Convey("Should reject negative configuration values", t, func() {
+
+		err := Load(config.HooksConfig{Workers: -1})
+		So(err.Code, ShouldEqual, http.StatusInternalServerError)
+	})
+
+	getTriggerData = originalGetTriggerData
+	Load(config.HooksConfig{})
+}
@@ -0,0 +1,132 @@
+package hooks
+
+import (
+	"sync"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/adapters"
+)
+
+const (
+	ClassTriggers = "triggers"
+	ClassFunctions = "functions"
+)
+
+// triggers and functions are kept in memory so that the requests don't query them. they are loaded on start and loaded
+// again after they are written through dock.
+type registry struct {
+	sync.RWMutex
+	isLoaded   bool
+	generation int
+	triggers   map[string]map[string]interface{}
+	functions  map[string]map[string]interface{}
+}
+
+var hookRegistry = &registry{}
+
+// loads all the triggers and the functions from the database
+var LoadRegistry = func() (err *utils.Error) {
+
+	hookRegistry.RLock()
+	generation := hookRegistry.generation
+	hookRegistry.RUnlock()
+
+	triggerList, err := queryAll(ClassTriggers)
+	if err != nil {
+		return
+	}
+	functionList, err := queryAll(ClassFunctions)
+	if err != nil {
+		return
+	}
+
+	// the first one is used when there are more than one, like the query did before
+	triggers := make(map[string]map[string]interface{})
+	for _, trigger := range triggerList {
+		className, _ := trigger["where"].(string)
+		when, _ := trigger["when"].(string)
+		method, _ := trigger["method"].(string)
+		key := triggerKey(className, when, method)
+		if _, exists := triggers[key]; !exists {
+			triggers[key] = trigger
+		}
+	}
+
+	functions := make(map[string]map[string]interface{})
+	for _, function := range functionList {
+		name, _ := function["name"].(string)
+		if _, exists := functions[name]; !exists {
+			functions[name] = function
+		}
+	}
+
+	hookRegistry.Lock()
+	defer hookRegistry.Unlock()
+
+	hookRegistry.triggers = triggers
+	hookRegistry.functions = functions
+	// the registry is loaded again on the next request if it was invalidated while loading
+	hookRegistry.isLoaded = generation == hookRegistry.generation
+	return
+}
+
+// makes the next request load the triggers and the functions again
+func InvalidateRegistry() {
+
+	hookRegistry.Lock()
+	defer hookRegistry.Unlock()
+
+	hookRegistry.isLoaded = false
+	hookRegistry.generation++
+}
+
+func findTrigger(className, when, method string) (trigger map[string]interface{}, found bool, err *utils.Error) {
+
+	err = ensureRegistryLoaded()
+	if err != nil {
+		return
+	}
+
+	hookRegistry.RLock()
+	defer hookRegistry.RUnlock()
+	trigger, found = hookRegistry.triggers[triggerKey(className, when, method)]
+	return
+}
+
+func findFunction(name string) (function map[string]interface{}, found bool, err *utils.Error) {
+
+	err = ensureRegistryLoaded()
+	if err != nil {
+		return
+	}
+
+	hookRegistry.RLock()
+	defer hookRegistry.RUnlock()
+	function, found = hookRegistry.functions[name]
+	return
+}
+
+func ensureRegistryLoaded() (err *utils.Error) {
+
+	hookRegistry.RLock()
+	isLoaded := hookRegistry.isLoaded
+	hookRegistry.RUnlock()
+
+	if !isLoaded {
+		err = LoadRegistry()
+	}
+	return
+}
+
+func triggerKey(className, when, method string) string {
+	return className + "/" + when + "/" + method
+}
+
+func queryAll(className string) (objects []map[string]interface{}, err *utils.Error) {
+
+	results, err := adapters.Query(className, map[string][]string{}, nil)
+	if err != nil {
+		return
+	}
+	objects, _ = results["data"].([]map[string]interface{})
+	return
+}
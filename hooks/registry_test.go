@@ -0,0 +1,73 @@
+package hooks
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/utils"
+	"net/http"
+)
+
+func TestRegistry(t *testing.T) {
+
+	queries := make(map[string]int)
+	adapters.Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
+		queries[collection]++
+		data := make([]map[string]interface{}, 0)
+		if collection == ClassTriggers {
+			data = append(data,
+				map[string]interface{}{"where": "posts", "when": "before", "method": "post", "url": "http://hooks/first"},
+				map[string]interface{}{"where": "posts", "when": "before", "method": "post", "url": "http://hooks/second"})
+		} else if collection == ClassFunctions {
+			data = append(data, map[string]interface{}{"name": "publish", "url": "http://hooks/publish"})
+		}
+		response = map[string]interface{}{"data": data}
+		return
+	}
+
+	Convey("Should query the triggers and the functions only once", t, func() {
+
+		InvalidateRegistry()
+
+		trigger, err := getTriggerData("posts", "before", "POST")
+		So(err, ShouldBeNil)
+		So(trigger["url"], ShouldEqual, "http://hooks/first")
+
+		_, err = getTriggerData("posts", "after", "post")
+		So(err.Code, ShouldEqual, http.StatusNotFound)
+
+		function, err := getFunctionData("publish")
+		So(err, ShouldBeNil)
+		So(function["url"], ShouldEqual, "http://hooks/publish")
+
+		_, err = getFunctionData("unpublish")
+		So(err.Code, ShouldEqual, http.StatusNotFound)
+
+		So(queries[ClassTriggers], ShouldEqual, 1)
+		So(queries[ClassFunctions], ShouldEqual, 1)
+	})
+
+	Convey("Should load the registry again after it is invalidated", t, func() {
+
+		queries = make(map[string]int)
+		InvalidateRegistry()
+
+		getTriggerData("posts", "before", "post")
+		getTriggerData("posts", "before", "post")
+		So(queries[ClassTriggers], ShouldEqual, 1)
+	})
+
+	Convey("Should return the error of loading", t, func() {
+
+		adapters.Query = func(collection string, parameters map[string][]string, roles []string) (response map[string]interface{}, err *utils.Error) {
+			err = &utils.Error{http.StatusInternalServerError, "Getting items failed."}
+			return
+		}
+		InvalidateRegistry()
+
+		_, err := getTriggerData("posts", "before", "post")
+		So(err.Code, ShouldEqual, http.StatusInternalServerError)
+	})
+
+	InvalidateRegistry()
+}
@@ -0,0 +1,112 @@
+// Package signature signs the requests that Dock sends to the hook servers, and verifies them on the hook servers.
+//
+// Every trigger and function request has the time it is sent in 'X-Dock-Timestamp' header as unix seconds, and the
+// HMAC-SHA256 of '<timestamp>.<body>' with the secret in 'X-Dock-Signature' header, like 'sha256=<hex>'. The package
+// uses only the standard library, so hook servers can import it without the dependencies of Dock:
+//
+//	http.Handle("/posts", signature.Middleware(secret, signature.DefaultTolerance, postsHandler))
+package signature
+
+import (
+	"io"
+	"time"
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+const (
+	HeaderTimestamp = "X-Dock-Timestamp"
+	HeaderSignature = "X-Dock-Signature"
+	signaturePrefix = "sha256="
+	// requests older or newer than this are rejected, so the captured requests cannot be sent again later
+	DefaultTolerance = 5 * time.Minute
+)
+
+var (
+	ErrMissingHeaders = errors.New("signature: timestamp or signature header is missing")
+	ErrInvalidTimestamp = errors.New("signature: timestamp is not valid or not within the tolerance")
+	ErrInvalidSignature = errors.New("signature: signature does not match")
+)
+
+// returns the signature of the body that is sent at the given time
+func Sign(secret string, timestamp int64, body []byte) string {
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sets the timestamp and the signature headers of a request that is sent now
+func SetHeaders(header http.Header, secret string, body []byte) {
+
+	timestamp := time.Now().Unix()
+	header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	header.Set(HeaderSignature, Sign(secret, timestamp, body))
+}
+
+// checks the headers of a request against its body. tolerance is the maximum difference between the timestamp and
+// the current time, zero means DefaultTolerance.
+func Verify(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+
+	timestampHeader := header.Get(HeaderTimestamp)
+	signatureHeader := header.Get(HeaderSignature)
+	if timestampHeader == "" || signatureHeader == "" {
+		return ErrMissingHeaders
+	}
+
+	timestamp, parseErr := strconv.ParseInt(timestampHeader, 10, 64)
+	if parseErr != nil {
+		return ErrInvalidTimestamp
+	}
+	if tolerance <= 0 {
+		tolerance = DefaultTolerance
+	}
+	difference := time.Since(time.Unix(timestamp, 0))
+	if difference > tolerance || difference < -tolerance {
+		return ErrInvalidTimestamp
+	}
+
+	if !strings.HasPrefix(signatureHeader, signaturePrefix) ||
+	!hmac.Equal([]byte(signatureHeader), []byte(Sign(secret, timestamp, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// reads the body of the request and verifies it. the body of the request can be read again after it.
+func VerifyRequest(r *http.Request, secret string, tolerance time.Duration) (body []byte, err error) {
+
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return
+		}
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	err = Verify(secret, r.Header, body, tolerance)
+	return
+}
+
+// rejects the requests that are not signed with the secret with 401
+func Middleware(secret string, tolerance time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := VerifyRequest(r, secret, tolerance); err != nil {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, err.Error())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,71 @@
+package signature
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func TestSignature(t *testing.T) {
+
+	body := []byte(`{"body":{"_id":"postid"}}`)
+
+	Convey("Should verify the signed headers", t, func() {
+
+		header := http.Header{}
+		SetHeaders(header, "secret", body)
+		So(header.Get(HeaderSignature), ShouldStartWith, "sha256=")
+		So(Verify("secret", header, body, 0), ShouldBeNil)
+	})
+
+	Convey("Should reject the wrong secret and the changed body", t, func() {
+
+		header := http.Header{}
+		SetHeaders(header, "secret", body)
+		So(Verify("othersecret", header, body, 0), ShouldEqual, ErrInvalidSignature)
+		So(Verify("secret", header, []byte(`{"body":{"_id":"otherid"}}`), 0), ShouldEqual, ErrInvalidSignature)
+	})
+
+	Convey("Should reject the missing headers and the old timestamps", t, func() {
+
+		So(Verify("secret", http.Header{}, body, 0), ShouldEqual, ErrMissingHeaders)
+
+		timestamp := time.Now().Add(-10 * time.Minute).Unix()
+		header := http.Header{}
+		header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+		header.Set(HeaderSignature, Sign("secret", timestamp, body))
+		So(Verify("secret", header, body, 0), ShouldEqual, ErrInvalidTimestamp)
+		So(Verify("secret", header, body, time.Hour), ShouldBeNil)
+
+		header.Set(HeaderTimestamp, "yesterday")
+		So(Verify("secret", header, body, 0), ShouldEqual, ErrInvalidTimestamp)
+	})
+
+	Convey("Should pass only the signed requests to the handler", t, func() {
+
+		var receivedBody string
+		handler := Middleware("secret", 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bodyAsBytes, _ := ioutil.ReadAll(r.Body)
+			receivedBody = string(bodyAsBytes)
+		}))
+
+		request := httptest.NewRequest("POST", "/posts", strings.NewReader(string(body)))
+		SetHeaders(request.Header, "secret", body)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		So(recorder.Code, ShouldEqual, http.StatusOK)
+		So(receivedBody, ShouldEqual, string(body))
+
+		receivedBody = ""
+		request = httptest.NewRequest("POST", "/posts", strings.NewReader(string(body)))
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+		So(receivedBody, ShouldBeEmpty)
+	})
+}
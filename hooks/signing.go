@@ -0,0 +1,33 @@
+package hooks
+
+import (
+	"strings"
+	"net/http"
+	"github.com/eluleci/dock/hooks/signature"
+)
+
+var signingSecret string
+var signingSecrets map[string]string
+
+// signs the request with the secret of its url. the requests are sent without signature if there is no secret.
+func signRequest(req *http.Request, url string, body []byte) {
+
+	secret := getSigningSecret(url)
+	if secret != "" {
+		signature.SetHeaders(req.Header, secret, body)
+	}
+}
+
+// returns the secret of the longest url in the secrets that the url starts with, or the global secret
+func getSigningSecret(url string) string {
+
+	secret := signingSecret
+	matchLength := 0
+	for prefix, prefixSecret := range signingSecrets {
+		if strings.HasPrefix(url, prefix) && len(prefix) > matchLength {
+			secret = prefixSecret
+			matchLength = len(prefix)
+		}
+	}
+	return secret
+}
@@ -0,0 +1,56 @@
+package hooks
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/config"
+	"github.com/eluleci/dock/hooks/signature"
+	"net/http"
+	"net/http/httptest"
+)
+
+func TestSigning(t *testing.T) {
+
+	Convey("Should use the secret of the longest matching url", t, func() {
+
+		Load(config.HooksConfig{
+			Secret: "globalsecret",
+			Secrets: map[string]string{
+				"https://hooks.myapp.com": "appsecret",
+				"https://hooks.myapp.com/payments": "paymentsecret",
+			},
+		})
+		So(getSigningSecret("https://hooks.myapp.com/posts"), ShouldEqual, "appsecret")
+		So(getSigningSecret("https://hooks.myapp.com/payments/charge"), ShouldEqual, "paymentsecret")
+		So(getSigningSecret("https://other.com/posts"), ShouldEqual, "globalsecret")
+	})
+
+	Convey("Should sign the trigger and function requests", t, func() {
+
+		var verifyErr error
+		var header http.Header
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header = r.Header
+			_, verifyErr = signature.VerifyRequest(r, "globalsecret", 0)
+			w.Write([]byte("{}"))
+		}))
+		defer server.Close()
+
+		Load(config.HooksConfig{Secret: "globalsecret"})
+
+		_, _, err := sendRequest(server.URL, map[string]interface{}{"body": map[string]interface{}{"_id": "postid"}})
+		So(err, ShouldBeNil)
+		So(verifyErr, ShouldBeNil)
+
+		verifyErr = nil
+		err = deliverTrigger(server.URL, []byte(`{"body":{}}`))
+		So(err, ShouldBeNil)
+		So(verifyErr, ShouldBeNil)
+
+		Load(config.HooksConfig{})
+		deliverTrigger(server.URL, []byte(`{"body":{}}`))
+		So(header.Get(signature.HeaderSignature), ShouldBeEmpty)
+	})
+
+	Load(config.HooksConfig{})
+}
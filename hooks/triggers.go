@@ -4,7 +4,6 @@ import (
 	"github.com/eluleci/dock/utils"
 	"net/http"
 	"encoding/json"
-	"github.com/eluleci/dock/adapters"
 	"strings"
 	"bytes"
 	"mime/multipart"
@@ -39,33 +38,9 @@ var ExecuteFunction = func(res string, parameters map[string][]string, body map[
 
 var getFunctionData = func(name string) (function map[string]interface{}, err *utils.Error) {
 
-	whereParams := map[string]interface{}{
-		"name": map[string]string{
-			"$eq": name,
-		},
-	}
-
-	whereParamsJson, jsonErr := json.Marshal(whereParams)
-	if jsonErr != nil {
-		err = &utils.Error{http.StatusInternalServerError, "Creating 'get function info' request failed."}
-		return
-	}
-
-	parameters := map[string][]string {"where": []string{string(whereParamsJson)}}
-	results, fetchErr := adapters.Query("functions", parameters)
-
-	if fetchErr != nil {
-		err = fetchErr
-		return
-	}
-	if results["data"] != nil {
-		resultsAsMap := results["data"].([]map[string]interface{})
-
-		if len(resultsAsMap) == 0 {
-			err = &utils.Error{http.StatusNotFound, "Function with name '" + name + "' not found."}
-			return
-		}
-		function = resultsAsMap[0]
+	function, found, err := findFunction(name)
+	if err == nil && !found {
+		err = &utils.Error{http.StatusNotFound, "Function with name '" + name + "' not found."}
 	}
 	return
 }
@@ -99,39 +74,10 @@ var ExecuteTrigger = func(className, when, method string, parameters map[string]
 }
 
 var getTriggerData = func(className, when, method string) (trigger map[string]interface{}, err *utils.Error) {
-	whereParams := map[string]interface{}{
-		"where": map[string]string{
-			"$eq": className,
-		},
-		"when": map[string]string{
-			"$eq": when,
-		},
-		"method": map[string]string{
-			"$eq": strings.ToLower(method),
-		},
-	}
-
-	whereParamsJson, jsonErr := json.Marshal(whereParams)
-	if jsonErr != nil {
-		err = &utils.Error{http.StatusInternalServerError, "Creating 'get trigger info' request failed."}
-		return
-	}
-
-	parameters := map[string][]string {"where": []string{string(whereParamsJson)}}
-	results, fetchErr := adapters.Query("triggers", parameters)
 
-	if fetchErr != nil {
-		err = fetchErr
-		return
-	}
-	if results["data"] != nil {
-		resultsAsMap := results["data"].([]map[string]interface{})
-
-		if len(resultsAsMap) == 0 {
-			err = &utils.Error{http.StatusNotFound, "Trigger not found."}
-			return
-		}
-		trigger = resultsAsMap[0]
+	trigger, found, err := findTrigger(className, when, strings.ToLower(method))
+	if err == nil && !found {
+		err = &utils.Error{http.StatusNotFound, "Trigger not found."}
 	}
 	return
 }
@@ -151,6 +97,7 @@ var sendRequest = func(url string, body interface{}) (status int, responseBody m
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	signRequest(req, url, bodyAsBytes)
 	client := &http.Client{}
 	resp, requestErr := client.Do(req)
 	if requestErr != nil {
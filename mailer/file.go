@@ -0,0 +1,38 @@
+package mailer
+
+import (
+	"os"
+	"net/http"
+	"github.com/eluleci/dock/utils"
+)
+
+// writes the emails to a file, or to the log if no path is given. used for development.
+type FileMailer struct {
+	Path string
+}
+
+func (m *FileMailer) Send(message Message) (err *utils.Error) {
+
+	var raw []byte
+	raw, err = buildMessage(message)
+	if err != nil {
+		return
+	}
+
+	if m.Path == "" {
+		utils.Log("info", "Email to " + message.To + ":\n" + string(raw))
+		return
+	}
+
+	file, openErr := os.OpenFile(m.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if openErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Opening mail file failed."}
+		return
+	}
+	defer file.Close()
+
+	if _, writeErr := file.Write(append(raw, []byte("\r\n\r\n")...)); writeErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Writing to mail file failed."}
+	}
+	return
+}
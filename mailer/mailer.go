@@ -0,0 +1,212 @@
+package mailer
+
+import (
+	"io"
+	"time"
+	"bytes"
+	"strings"
+	"strconv"
+	"net/http"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+)
+
+const (
+	TransportSmtp = "smtp"
+	TransportFile = "file"
+	TransportLog = "log"
+	TemplateResetPassword = "resetPassword"
+	TemplateVerifyEmail = "verifyEmail"
+)
+
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+	Html    string
+}
+
+type Mailer interface {
+	Send(message Message) *utils.Error
+}
+
+// mailer that is used for the system emails
+var DefaultMailer Mailer
+
+// address that the system emails are sent from
+var defaultFrom string
+
+// creates the mailer and parses the templates in the configuration
+var Load = func(c config.Config) (err *utils.Error) {
+
+	mailConfig := c.Mail
+
+	// smtp settings of reset password configuration are used if mail is not configured
+	if mailConfig.Transport == "" && mailConfig.Smtp.Host == "" && c.ResetPassword["smtpServer"] != "" {
+		port, _ := strconv.Atoi(c.ResetPassword["smtpPort"])
+		mailConfig.From = c.ResetPassword["senderEmail"]
+		mailConfig.Smtp = config.SmtpConfig{
+			Host: c.ResetPassword["smtpServer"],
+			Port: port,
+			Username: c.ResetPassword["senderEmail"],
+			Password: c.ResetPassword["senderEmailPassword"],
+		}
+	}
+
+	var mailer Mailer
+	switch mailConfig.Transport {
+	case "", TransportSmtp:
+		if mailConfig.Smtp.Host == "" {
+			// emails cannot be sent but the server can run without them
+			mailer = nil
+		} else if mailConfig.From == "" {
+			err = &utils.Error{http.StatusInternalServerError, "Mail 'from' address must be set for smtp transport."}
+			return
+		} else {
+			mailer, err = NewSmtpMailer(mailConfig.Smtp)
+		}
+	case TransportFile:
+		if mailConfig.File == "" {
+			err = &utils.Error{http.StatusInternalServerError, "Mail 'file' must be set for file transport."}
+			return
+		}
+		mailer = &FileMailer{Path: mailConfig.File}
+	case TransportLog:
+		mailer = &FileMailer{}
+	default:
+		err = &utils.Error{http.StatusInternalServerError, "Mail transport '" + mailConfig.Transport + "' is not supported."}
+	}
+	if err != nil {
+		return
+	}
+
+	var parsedTemplates map[string]*mailTemplate
+	parsedTemplates, err = loadTemplates(mailConfig.Templates)
+	if err != nil {
+		return
+	}
+
+	DefaultMailer = mailer
+	defaultFrom = mailConfig.From
+	templates = parsedTemplates
+	return
+}
+
+// renders the named template with the data and sends it with the default mailer
+var SendTemplate = func(templateName, to string, data map[string]interface{}) (err *utils.Error) {
+
+	if DefaultMailer == nil {
+		err = &utils.Error{http.StatusInternalServerError, "Mail configuration is not set in configuration file."}
+		return
+	}
+
+	template, hasTemplate := templates[templateName]
+	if !hasTemplate {
+		err = &utils.Error{http.StatusInternalServerError, "Mail template '" + templateName + "' is not defined."}
+		return
+	}
+
+	message := Message{From: defaultFrom, To: to}
+	message.Subject, message.Text, message.Html, err = template.render(data)
+	if err != nil {
+		return
+	}
+
+	return DefaultMailer.Send(message)
+}
+
+// builds the MIME message with the plain text and html parts
+func buildMessage(message Message) (raw []byte, err *utils.Error) {
+
+	// addresses cannot add headers to the email
+	if strings.ContainsAny(message.From + message.To, "\r\n") {
+		err = &utils.Error{http.StatusBadRequest, "Email address is not valid."}
+		return
+	}
+
+	var buffer bytes.Buffer
+	header := textproto.MIMEHeader{}
+	header.Set("From", message.From)
+	header.Set("To", message.To)
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", message.Subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("MIME-Version", "1.0")
+
+	parts := make(map[string]string)
+	if message.Text != "" {
+		parts["text/plain"] = message.Text
+	}
+	if message.Html != "" {
+		parts["text/html"] = message.Html
+	}
+
+	if len(parts) < 2 {
+		contentType := "text/plain"
+		if message.Html != "" {
+			contentType = "text/html"
+		}
+		header.Set("Content-Type", contentType + "; charset=utf-8")
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		writeHeader(&buffer, header)
+		err = writeQuotedPrintable(&buffer, parts[contentType])
+		raw = buffer.Bytes()
+		return
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	header.Set("Content-Type", "multipart/alternative; boundary=" + writer.Boundary())
+	writeHeader(&buffer, header)
+
+	// clients show the last part they support, so html comes after plain text
+	for _, contentType := range []string{"text/plain", "text/html"} {
+		partHeader := textproto.MIMEHeader{}
+		partHeader.Set("Content-Type", contentType + "; charset=utf-8")
+		partHeader.Set("Content-Transfer-Encoding", "quoted-printable")
+		part, partErr := writer.CreatePart(partHeader)
+		if partErr != nil {
+			err = &utils.Error{http.StatusInternalServerError, "Building email failed."}
+			return
+		}
+		err = writeQuotedPrintable(part, parts[contentType])
+		if err != nil {
+			return
+		}
+	}
+	writer.Close()
+
+	buffer.Write(body.Bytes())
+	raw = buffer.Bytes()
+	return
+}
+
+func writeHeader(buffer *bytes.Buffer, header textproto.MIMEHeader) {
+
+	for _, key := range []string{"From", "To", "Subject", "Date", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"} {
+		if value := header.Get(key); value != "" {
+			buffer.WriteString(key + ": " + value + "\r\n")
+		}
+	}
+	buffer.WriteString("\r\n")
+}
+
+func writeQuotedPrintable(w io.Writer, content string) (err *utils.Error) {
+
+	// lines of emails end with CRLF
+	content = strings.Replace(strings.Replace(content, "\r\n", "\n", -1), "\n", "\r\n", -1)
+
+	writer := quotedprintable.NewWriter(w)
+	_, writeErr := writer.Write([]byte(content))
+	if writeErr == nil {
+		writeErr = writer.Close()
+	}
+	if writeErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Building email failed."}
+	}
+	return
+}
@@ -0,0 +1,83 @@
+package mailer
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func TestLoad(t *testing.T) {
+
+	Convey("Should use the smtp settings of reset password configuration", t, func() {
+
+		err := Load(config.Config{ResetPassword: map[string]string{
+			"smtpServer": "smtp.myapp.com",
+			"smtpPort": "25",
+			"senderEmail": "info@myapp.com",
+			"senderEmailPassword": "password",
+		}})
+		So(err, ShouldBeNil)
+
+		smtpMailer := DefaultMailer.(*SmtpMailer)
+		So(smtpMailer.Host, ShouldEqual, "smtp.myapp.com")
+		So(smtpMailer.Port, ShouldEqual, 25)
+		So(defaultFrom, ShouldEqual, "info@myapp.com")
+	})
+
+	Convey("Should fail for invalid configurations", t, func() {
+
+		So(Load(config.Config{Mail: config.MailConfig{Transport: "pigeon"}}), ShouldNotBeNil)
+		So(Load(config.Config{Mail: config.MailConfig{Transport: TransportFile}}), ShouldNotBeNil)
+		So(Load(config.Config{Mail: config.MailConfig{Smtp: config.SmtpConfig{Host: "smtp.myapp.com"}}}), ShouldNotBeNil)
+
+		invalidTemplate := map[string]config.MailTemplate{"broken": {Subject: "Hi", Html: "{{.link"}}
+		So(Load(config.Config{Mail: config.MailConfig{Transport: TransportLog, Templates: invalidTemplate}}), ShouldNotBeNil)
+	})
+
+	Convey("Should override the default templates", t, func() {
+
+		err := Load(config.Config{Mail: config.MailConfig{
+			Transport: TransportLog,
+			Templates: map[string]config.MailTemplate{TemplateResetPassword: {Subject: "New password for {{.email}}"}},
+		}})
+		So(err, ShouldBeNil)
+
+		subject, text, html, err := templates[TemplateResetPassword].render(map[string]interface{}{"email": "johny@bravo.com", "link": "https://myapp.com"})
+		So(err, ShouldBeNil)
+		So(subject, ShouldEqual, "New password for johny@bravo.com")
+		So(text, ShouldContainSubstring, "https://myapp.com")
+		So(html, ShouldContainSubstring, "href=\"https://myapp.com\"")
+		So(templates, ShouldContainKey, TemplateVerifyEmail)
+	})
+
+	DefaultMailer = nil
+}
+
+func TestFileMailer(t *testing.T) {
+
+	Convey("Should append the emails to the file", t, func() {
+
+		directory, _ := ioutil.TempDir("", "mailer")
+		defer os.RemoveAll(directory)
+		path := filepath.Join(directory, "emails.txt")
+
+		mailer := &FileMailer{Path: path}
+		So(mailer.Send(testMessage()), ShouldBeNil)
+		So(mailer.Send(testMessage()), ShouldBeNil)
+
+		content, _ := ioutil.ReadFile(path)
+		So(string(content), ShouldContainSubstring, "To: johny@bravo.com")
+		So(string(content), ShouldContainSubstring, "Plain text content")
+	})
+
+	Convey("Should not allow headers in addresses", t, func() {
+
+		message := testMessage()
+		message.To = "johny@bravo.com\r\nBcc: everyone@bravo.com"
+
+		So((&FileMailer{}).Send(message), ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,170 @@
+package mailer
+
+import (
+	"net"
+	"time"
+	"strconv"
+	"net/http"
+	"net/smtp"
+	"net/mail"
+	"crypto/tls"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+)
+
+const (
+	SecurityNone = "none"
+	SecurityStartTLS = "starttls"
+	SecurityTLS = "tls"
+)
+
+const smtpTimeout = 30 * time.Second
+
+// sends emails through an smtp server
+type SmtpMailer struct {
+	Host      string
+	Port      int
+	Username  string
+	Password  string
+	Security  string
+	// used for the tls connections. server name is set to the host if it is nil
+	TLSConfig *tls.Config
+}
+
+func NewSmtpMailer(smtpConfig config.SmtpConfig) (mailer *SmtpMailer, err *utils.Error) {
+
+	switch smtpConfig.Security {
+	case "", SecurityNone, SecurityStartTLS, SecurityTLS:
+	default:
+		err = &utils.Error{http.StatusInternalServerError, "Smtp security '" + smtpConfig.Security + "' is not supported."}
+		return
+	}
+
+	mailer = &SmtpMailer{
+		Host: smtpConfig.Host,
+		Port: smtpConfig.Port,
+		Username: smtpConfig.Username,
+		Password: smtpConfig.Password,
+		Security: smtpConfig.Security,
+	}
+	if mailer.Port == 0 {
+		mailer.Port = 587
+		if mailer.Security == SecurityTLS {
+			mailer.Port = 465
+		}
+	}
+	return
+}
+
+func (m *SmtpMailer) Send(message Message) (err *utils.Error) {
+
+	var raw []byte
+	raw, err = buildMessage(message)
+	if err != nil {
+		return
+	}
+
+	var client *smtp.Client
+	client, err = m.connect()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	if m.Username != "" {
+		if authErr := client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); authErr != nil {
+			err = &utils.Error{http.StatusInternalServerError, "Smtp authentication failed."}
+			return
+		}
+	}
+
+	// envelope addresses don't have the display names
+	from, parseErr := mail.ParseAddress(message.From)
+	to, parseToErr := mail.ParseAddress(message.To)
+	if parseErr != nil || parseToErr != nil {
+		err = &utils.Error{http.StatusBadRequest, "Email address is not valid."}
+		return
+	}
+
+	if mailErr := client.Mail(from.Address); mailErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Sending email failed."}
+		return
+	}
+	if rcptErr := client.Rcpt(to.Address); rcptErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Sending email failed."}
+		return
+	}
+
+	writer, dataErr := client.Data()
+	if dataErr == nil {
+		_, dataErr = writer.Write(raw)
+		if dataErr == nil {
+			dataErr = writer.Close()
+		}
+	}
+	if dataErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Sending email failed."}
+		return
+	}
+
+	client.Quit()
+	return
+}
+
+// connects to the server and starts tls according to the security setting
+func (m *SmtpMailer) connect() (client *smtp.Client, err *utils.Error) {
+
+	address := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	var conn net.Conn
+	var dialErr error
+	if m.Security == SecurityTLS {
+		conn, dialErr = tls.DialWithDialer(dialer, "tcp", address, m.tlsConfig())
+	} else {
+		conn, dialErr = dialer.Dial("tcp", address)
+	}
+	if dialErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Connecting to smtp server failed."}
+		return
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	var clientErr error
+	client, clientErr = smtp.NewClient(conn, m.Host)
+	if clientErr != nil {
+		conn.Close()
+		err = &utils.Error{http.StatusInternalServerError, "Connecting to smtp server failed."}
+		return
+	}
+
+	if m.Security == SecurityTLS || m.Security == SecurityNone {
+		return
+	}
+
+	hasStartTLS, _ := client.Extension("STARTTLS")
+	if !hasStartTLS {
+		// without a security setting, servers that don't support STARTTLS are used without encryption
+		if m.Security == SecurityStartTLS {
+			client.Close()
+			client = nil
+			err = &utils.Error{http.StatusInternalServerError, "Smtp server doesn't support STARTTLS."}
+		}
+		return
+	}
+
+	if tlsErr := client.StartTLS(m.tlsConfig()); tlsErr != nil {
+		client.Close()
+		client = nil
+		err = &utils.Error{http.StatusInternalServerError, "Starting TLS with smtp server failed."}
+	}
+	return
+}
+
+func (m *SmtpMailer) tlsConfig() *tls.Config {
+
+	if m.TLSConfig != nil {
+		return m.TLSConfig
+	}
+	return &tls.Config{ServerName: m.Host}
+}
@@ -0,0 +1,279 @@
+package mailer
+
+import (
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/eluleci/dock/config"
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// smtp server that accepts one email per connection and records it
+type testSmtpServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	startTLS  bool
+	received  chan testEmail
+}
+
+type testEmail struct {
+	from     string
+	to       string
+	data     string
+	auth     string
+	isSecure bool
+}
+
+func newTestSmtpServer(implicitTLS, startTLS bool) (server *testSmtpServer, certPool *x509.CertPool) {
+
+	certificate, certPool := generateTestCertificate()
+	server = &testSmtpServer{
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{certificate}},
+		startTLS: startTLS,
+		received: make(chan testEmail, 1),
+	}
+
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	if implicitTLS {
+		listener = tls.NewListener(listener, server.tlsConfig)
+	}
+	server.listener = listener
+	go server.serve()
+	return
+}
+
+func (s *testSmtpServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *testSmtpServer) serve() {
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testSmtpServer) handle(conn net.Conn) {
+
+	defer conn.Close()
+	_, isSecure := conn.(*tls.Conn)
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost test server")
+
+	var email testEmail
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO", "HELO":
+			extensions := []string{"250-localhost", "250-AUTH PLAIN"}
+			if s.startTLS && !isSecure {
+				extensions = append(extensions, "250-STARTTLS")
+			}
+			for _, extension := range extensions {
+				text.PrintfLine("%s", extension)
+			}
+			text.PrintfLine("250 SIZE 10240000")
+		case "STARTTLS":
+			text.PrintfLine("220 ready to start tls")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn = tlsConn
+			isSecure = true
+			text = textproto.NewConn(conn)
+		case "AUTH":
+			credentials, _ := base64.StdEncoding.DecodeString(strings.Fields(line)[2])
+			email.auth = string(credentials)
+			text.PrintfLine("235 authenticated")
+		case "MAIL":
+			email.from = line[strings.Index(line, "<") + 1:strings.Index(line, ">")]
+			text.PrintfLine("250 ok")
+		case "RCPT":
+			email.to = line[strings.Index(line, "<") + 1:strings.Index(line, ">")]
+			text.PrintfLine("250 ok")
+		case "DATA":
+			text.PrintfLine("354 send data")
+			data, _ := text.ReadDotBytes()
+			email.data = string(data)
+			email.isSecure = isSecure
+			text.PrintfLine("250 queued")
+			s.received <- email
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("250 ok")
+		}
+	}
+}
+
+func generateTestCertificate() (certificate tls.Certificate, certPool *x509.CertPool) {
+
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA: true,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	parsed, _ := x509.ParseCertificate(der)
+
+	certificate = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: privateKey}
+	certPool = x509.NewCertPool()
+	certPool.AddCert(parsed)
+	return
+}
+
+func testMessage() Message {
+	return Message{
+		From: "My App <info@myapp.com>",
+		To: "johny@bravo.com",
+		Subject: "Hello",
+		Text: "Plain text content",
+		Html: "<p>Html content</p>",
+	}
+}
+
+func TestSmtpMailer(t *testing.T) {
+
+	Convey("Should send email with STARTTLS and authentication", t, func() {
+
+		server, certPool := newTestSmtpServer(false, true)
+		defer server.listener.Close()
+
+		mailer, _ := NewSmtpMailer(config.SmtpConfig{
+			Host: "127.0.0.1",
+			Port: server.port(),
+			Username: "info@myapp.com",
+			Password: "password",
+			Security: SecurityStartTLS,
+		})
+		mailer.TLSConfig = &tls.Config{ServerName: "127.0.0.1", RootCAs: certPool}
+
+		err := mailer.Send(testMessage())
+		So(err, ShouldBeNil)
+
+		email := <-server.received
+		So(email.isSecure, ShouldBeTrue)
+		So(email.from, ShouldEqual, "info@myapp.com")
+		So(email.to, ShouldEqual, "johny@bravo.com")
+		So(email.auth, ShouldEqual, "\x00info@myapp.com\x00password")
+		So(email.data, ShouldContainSubstring, "Subject: Hello")
+		So(email.data, ShouldContainSubstring, "Content-Type: multipart/alternative")
+		So(email.data, ShouldContainSubstring, "Plain text content")
+		So(email.data, ShouldContainSubstring, "<p>Html content</p>")
+	})
+
+	Convey("Should send email with implicit TLS", t, func() {
+
+		server, certPool := newTestSmtpServer(true, false)
+		defer server.listener.Close()
+
+		mailer, _ := NewSmtpMailer(config.SmtpConfig{Host: "127.0.0.1", Port: server.port(), Security: SecurityTLS})
+		mailer.TLSConfig = &tls.Config{ServerName: "127.0.0.1", RootCAs: certPool}
+
+		err := mailer.Send(testMessage())
+		So(err, ShouldBeNil)
+
+		email := <-server.received
+		So(email.isSecure, ShouldBeTrue)
+	})
+
+	Convey("Should fail if STARTTLS is required but not supported", t, func() {
+
+		server, _ := newTestSmtpServer(false, false)
+		defer server.listener.Close()
+
+		mailer, _ := NewSmtpMailer(config.SmtpConfig{Host: "127.0.0.1", Port: server.port(), Security: SecurityStartTLS})
+
+		err := mailer.Send(testMessage())
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should not trust unknown certificates", t, func() {
+
+		server, _ := newTestSmtpServer(true, false)
+		defer server.listener.Close()
+
+		mailer, _ := NewSmtpMailer(config.SmtpConfig{Host: "127.0.0.1", Port: server.port(), Security: SecurityTLS})
+
+		err := mailer.Send(testMessage())
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should reject unknown security settings", t, func() {
+
+		_, err := NewSmtpMailer(config.SmtpConfig{Host: "127.0.0.1", Security: "ssl3"})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestSendTemplate(t *testing.T) {
+
+	Convey("Should render the template and send it through the smtp server", t, func() {
+
+		server, _ := newTestSmtpServer(false, false)
+		defer server.listener.Close()
+
+		err := Load(config.Config{Mail: config.MailConfig{
+			From: "info@myapp.com",
+			Smtp: config.SmtpConfig{Host: "127.0.0.1", Port: server.port()},
+			Templates: map[string]config.MailTemplate{
+				"invitation": {
+					Subject: "{{.inviter}} invited you",
+					Text: "Join from {{.link}}",
+					Html: "<a href=\"{{.link}}\">Join {{.inviter}}</a>",
+				},
+			},
+		}})
+		So(err, ShouldBeNil)
+
+		data := map[string]interface{}{"inviter": "<Johny>", "link": "https://myapp.com/join?code=1"}
+		err = SendTemplate("invitation", "friend@bravo.com", data)
+		So(err, ShouldBeNil)
+
+		email := <-server.received
+		body := decodeQuotedPrintable(email.data)
+		So(email.to, ShouldEqual, "friend@bravo.com")
+		So(body, ShouldContainSubstring, "Subject: <Johny> invited you")
+		So(body, ShouldContainSubstring, "Join from https://myapp.com/join?code=1")
+		So(body, ShouldContainSubstring, "Join &lt;Johny&gt;</a>")
+	})
+
+	DefaultMailer = nil
+}
+
+func decodeQuotedPrintable(data string) string {
+
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(strings.Replace(data, "=\r\n", "", -1)))
+	for scanner.Scan() {
+		lines = append(lines, strings.Replace(scanner.Text(), "=3D", "=", -1))
+	}
+	return strings.Join(lines, "\n")
+}
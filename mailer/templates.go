@@ -0,0 +1,145 @@
+package mailer
+
+import (
+	"bytes"
+	"net/http"
+	"io/ioutil"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+	"github.com/eluleci/dock/utils"
+	"github.com/eluleci/dock/config"
+)
+
+type mailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// parsed templates by their names
+var templates = make(map[string]*mailTemplate)
+
+// templates of the system emails. the ones in configuration file override these
+var defaultTemplates = map[string]config.MailTemplate{
+	TemplateResetPassword: {
+		Subject: "Reset your password",
+		Text: "Someone asked to reset the password of your account. You can set a new password from the link below.\n\n" +
+		"{{.link}}\n\nIf it wasn't you, you can ignore this email.",
+		Html: "<p>Someone asked to reset the password of your account. You can set a new password from the link below.</p>" +
+		"<p><a href=\"{{.link}}\">Reset password</a></p><p>If it wasn't you, you can ignore this email.</p>",
+	},
+	TemplateVerifyEmail: {
+		Subject: "Verify your email address",
+		Text: "Please verify your email address with the link below.\n\n{{.link}}",
+		Html: "<p>Please verify your email address with the link below.</p><p><a href=\"{{.link}}\">Verify email address</a></p>",
+	},
+}
+
+// parses the default templates and the templates in the configuration
+func loadTemplates(configuredTemplates map[string]config.MailTemplate) (parsedTemplates map[string]*mailTemplate, err *utils.Error) {
+
+	merged := make(map[string]config.MailTemplate)
+	for name, t := range defaultTemplates {
+		merged[name] = t
+	}
+	for name, t := range configuredTemplates {
+		merged[name] = mergeTemplate(merged[name], t)
+	}
+
+	parsedTemplates = make(map[string]*mailTemplate)
+	for name, t := range merged {
+		parsedTemplates[name], err = parseTemplate(name, t)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// fields of the configured template override the fields of the default template
+func mergeTemplate(base, override config.MailTemplate) config.MailTemplate {
+
+	if override.Subject != "" {
+		base.Subject = override.Subject
+	}
+	if override.Html != "" || override.HtmlFile != "" {
+		base.Html = override.Html
+		base.HtmlFile = override.HtmlFile
+	}
+	if override.Text != "" || override.TextFile != "" {
+		base.Text = override.Text
+		base.TextFile = override.TextFile
+	}
+	return base
+}
+
+func parseTemplate(name string, t config.MailTemplate) (parsed *mailTemplate, err *utils.Error) {
+
+	html, readErr := readTemplate(t.Html, t.HtmlFile)
+	if readErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Reading html of mail template '" + name + "' failed."}
+		return
+	}
+	text, readErr := readTemplate(t.Text, t.TextFile)
+	if readErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Reading text of mail template '" + name + "' failed."}
+		return
+	}
+	if html == "" && text == "" {
+		err = &utils.Error{http.StatusInternalServerError, "Mail template '" + name + "' must have html or text."}
+		return
+	}
+
+	parsed = &mailTemplate{}
+	var parseErr error
+	parsed.subject, parseErr = texttemplate.New(name).Parse(t.Subject)
+	if parseErr == nil && text != "" {
+		parsed.text, parseErr = texttemplate.New(name).Parse(text)
+	}
+	if parseErr == nil && html != "" {
+		parsed.html, parseErr = htmltemplate.New(name).Parse(html)
+	}
+	if parseErr != nil {
+		parsed = nil
+		err = &utils.Error{http.StatusInternalServerError, "Parsing mail template '" + name + "' failed: " + parseErr.Error()}
+	}
+	return
+}
+
+func readTemplate(template, templateFile string) (content string, err error) {
+
+	content = template
+	if content == "" && templateFile != "" {
+		var bytes []byte
+		bytes, err = ioutil.ReadFile(templateFile)
+		content = string(bytes)
+	}
+	return
+}
+
+func (t *mailTemplate) render(data map[string]interface{}) (subject, text, html string, err *utils.Error) {
+
+	var buffer bytes.Buffer
+	var renderErr error
+
+	if renderErr = t.subject.Execute(&buffer, data); renderErr == nil {
+		subject = buffer.String()
+	}
+	if renderErr == nil && t.text != nil {
+		buffer.Reset()
+		if renderErr = t.text.Execute(&buffer, data); renderErr == nil {
+			text = buffer.String()
+		}
+	}
+	if renderErr == nil && t.html != nil {
+		buffer.Reset()
+		if renderErr = t.html.Execute(&buffer, data); renderErr == nil {
+			html = buffer.String()
+		}
+	}
+
+	if renderErr != nil {
+		err = &utils.Error{http.StatusInternalServerError, "Rendering mail template failed."}
+	}
+	return
+}
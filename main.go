@@ -1,10 +1,14 @@
 package main
 
 import (
+	"net"
 	"net/http"
 	"github.com/eluleci/dock/config"
 	"github.com/eluleci/dock/actors"
 	"github.com/eluleci/dock/adapters"
+	"github.com/eluleci/dock/auth"
+	"github.com/eluleci/dock/mailer"
+	"github.com/eluleci/dock/hooks"
 	"github.com/eluleci/dock/utils"
 	"github.com/eluleci/dock/messages"
 	"encoding/json"
@@ -16,7 +20,6 @@ import (
 
 func handler(w http.ResponseWriter, r *http.Request) {
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	if origin := r.Header.Get("Origin"); origin != "" {
 		w.Header().Set("Access-Control-Allow-Origin", origin)
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
@@ -41,6 +44,7 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		w.WriteHeader(parseReqErr.Code)
 		io.WriteString(w, string(bytes))
 		return
@@ -52,12 +56,26 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	actors.RootActor.Inbox <- requestWrapper
 
 	response := <-responseChannel
+	// headers of the response replace the default ones, so there is only one content type
+	for key, values := range response.Headers {
+		w.Header().Del(key)
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	// raw bodies are plain text unless the response has its own content type, like the zip of the account export
+	if w.Header().Get("Content-Type") == "" {
+		if response.RawBody != nil {
+			w.Header().Set("Content-Type", "text/plain")
+		} else if response.Body != nil {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		}
+	}
 	if response.Status != 0 {
 		w.WriteHeader(response.Status)
 	}
 
 	if response.RawBody != nil {
-		w.Header().Set("Content-Type", "text/plain")
 		w.Write(response.RawBody)
 	}
 
@@ -83,6 +101,27 @@ func main() {
 	}
 	config.SystemConfig = c
 
+	// loading the keys of access tokens
+	keyErr := auth.LoadSigningKeys(config.SystemConfig.Token)
+	if keyErr != nil {
+		utils.Log("fatal", keyErr.Message)
+		os.Exit(keyErr.Code)
+	}
+
+	// checking the password hashing settings
+	passwordErr := auth.CheckPasswordConfig(config.SystemConfig.Password)
+	if passwordErr != nil {
+		utils.Log("fatal", passwordErr.Message)
+		os.Exit(passwordErr.Code)
+	}
+
+	// creating the mailer of system emails
+	mailErr := mailer.Load(config.SystemConfig)
+	if mailErr != nil {
+		utils.Log("fatal", mailErr.Message)
+		os.Exit(mailErr.Code)
+	}
+
 	// connecting to database
 	dbErr := adapters.Connect(config.SystemConfig)
 	if dbErr != nil {
@@ -90,6 +129,19 @@ func main() {
 		os.Exit(dbErr.Code)
 	}
 
+	// loading the triggers and the functions. they are loaded again on the first request if it fails
+	if hooksErr := hooks.LoadRegistry(); hooksErr != nil {
+		utils.Log("error", "Loading triggers and functions failed: " + hooksErr.Message)
+	}
+
+	// starting the workers that send the after triggers
+	queueErr := hooks.Load(config.SystemConfig.Hooks)
+	if queueErr != nil {
+		utils.Log("fatal", queueErr.Message)
+		os.Exit(queueErr.Code)
+	}
+	hooks.StartQueueWorkers()
+
 	// creating root actor
 	actors.RootActor = actors.CreateActor("/", 0, nil)
 	go actors.RootActor.Run()
@@ -122,6 +174,10 @@ func parseRequest(r *http.Request) (requestWrapper messages.RequestWrapper, err
 	requestWrapper.Message.Command = r.Method
 	requestWrapper.Message.Headers = r.Header
 	requestWrapper.Message.Parameters = r.URL.Query()
+	requestWrapper.Message.RemoteAddr = r.RemoteAddr
+	if host, _, splitErr := net.SplitHostPort(r.RemoteAddr); splitErr == nil {
+		requestWrapper.Message.RemoteAddr = host
+	}
 
 	contentType := r.Header.Get("Content-Type")
 	if strings.Contains(res, "files") {
@@ -14,6 +14,7 @@ type Message struct {
 	Body          map[string]interface{} `json:"body,omitempty"`
 	RawBody       []byte `json:"rawbody,omitempty"`	// used for files
 	ReqBodyRaw    io.ReadCloser
+	RemoteAddr    string `json:"-"`	// ip address of the client
 	Status        int `json:"status,omitempty"` // used only in responses
 }
 
@@ -146,9 +146,43 @@ var fetchData = func(data map[string]interface{}) (object map[string]interface{}
 	if err != nil {
 		return
 	}
+
+	// class name is kept for filtering the fields of the expanded object. it is removed by RemoveClassNames.
+	object["_class"] = className
 	return
 }
 
+// removes the class names of the expanded objects after their fields are filtered. references keep their classes.
+func RemoveClassNames(data map[string]interface{}) map[string]interface{} {
+
+	for _, value := range data {
+		switch nested := value.(type) {
+		case map[string]interface{}:
+			removeClassName(nested)
+		case []map[string]interface{}:
+			for _, item := range nested {
+				removeClassName(item)
+			}
+		case []interface{}:
+			for _, item := range nested {
+				if itemAsMap, isMap := item.(map[string]interface{}); isMap {
+					removeClassName(itemAsMap)
+				}
+			}
+		}
+	}
+	return data
+}
+
+func removeClassName(object map[string]interface{}) {
+
+	if object["_type"] == "reference" {
+		return
+	}
+	delete(object, "_class")
+	RemoveClassNames(object)
+}
+
 var isValidReference = func(reference interface{}) (bool) {
 	if reference == nil {
 		return false
@@ -147,3 +147,19 @@ func TestHelperMethods(t *testing.T) {
 
 	})
 }
+
+func TestRemoveClassNames(t *testing.T) {
+
+	Convey("Should remove the class names of the expanded objects only", t, func() {
+
+		reference := map[string]interface{}{"_type": "reference", "_id": "userid", "_class": "users"}
+		author := map[string]interface{}{"_id": "authorid", "_class": "users", "avatar": reference}
+		comment := map[string]interface{}{"_id": "commentid", "_class": "comments"}
+		object := map[string]interface{}{"_id": "postid", "author": author, "comments": []interface{}{comment}}
+
+		result := RemoveClassNames(object)
+		So(result["author"], ShouldNotContainKey, "_class")
+		So(comment, ShouldNotContainKey, "_class")
+		So(reference["_class"], ShouldEqual, "users")
+	})
+}